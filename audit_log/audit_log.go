@@ -1,27 +1,213 @@
 package audit_log
 
 import (
+	"context"
 	"fmt"
-	"github.com/obgnail/audit-log/clickhouse"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/broker"
 	"github.com/obgnail/audit-log/config"
+	"github.com/obgnail/audit-log/deadletter"
 	"github.com/obgnail/audit-log/logger"
 	"github.com/obgnail/audit-log/mysql"
+	"github.com/obgnail/audit-log/store"
 	"github.com/obgnail/audit-log/syncer"
+	"github.com/obgnail/audit-log/types"
+	"gopkg.in/gorp.v1"
 )
 
+// Options 创建 AuditLogger 实例的参数, Config 为空时从 ConfigPath 读取配置
+type Options struct {
+	ConfigPath string
+	Config     *config.MainConfig
+}
+
 type AuditLogger struct {
+	cfg   *config.MainConfig
+	store store.Store
+	dbms  []*gorp.DbMap
+
 	binlogSyncer *syncer.BinlogSynchronizer
 	txInfoSyncer *syncer.TxInfoSynchronizer
+	pusher       mysql.TxPusher // 开启 outbox 时为 *mysql.Outbox, 否则为 txInfoSyncer
+}
+
+// New 创建一个独立的 AuditLogger 实例, 拥有自己的配置、store、broker 和 DbMap,
+// 不读写任何包级别的全局变量(logger 除外, 进程内共享一个, 各实例的 [log] 配置不同时返回错误).
+// 同一进程可以创建多个实例审计不同的 MySQL 集群
+func New(opts Options) (_ *AuditLogger, err error) {
+	cfg := opts.Config
+	if cfg == nil {
+		if cfg, err = config.Load(opts.ConfigPath); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err = logger.InitSharedLogger(cfg.Log); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	a := &AuditLogger{cfg: cfg}
+	defer func() {
+		if err != nil {
+			a.Close()
+		}
+	}()
+
+	if a.store, err = store.New(cfg); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if a.dbms, err = mysql.BuildDBMs(cfg.Mysql); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if a.binlogSyncer, err = syncer.NewBinlogSyncerFromConfig(cfg, a.store); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if a.txInfoSyncer, err = syncer.NewTxInfoSyncerFromConfig(cfg, a.store); err != nil {
+		return nil, errors.Trace(err)
+	}
+	a.txInfoSyncer.SetWatermark(a.binlogSyncer.Watermark())
+	a.txInfoSyncer.SetJoinWindow(a.binlogSyncer.JoinWindow())
+	if len(a.dbms) != 0 {
+		a.binlogSyncer.SetPrimaryKeyResolver(broker.NewMySQLPrimaryKeyResolver(a.dbms[0].Db))
+		a.txInfoSyncer.SetSourceResolver(syncer.NewMySQLSourceResolver(a.dbms[0].Db))
+	}
+	a.pusher = a.txInfoSyncer
+	if cfg.Outbox != nil && cfg.Outbox.Enable {
+		outbox := mysql.NewOutbox(cfg.Outbox.Table)
+		if err = mysql.CreateOutboxTables(outbox, a.dbms); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = setOutbox(cfg.Outbox, outbox, a.binlogSyncer, a.txInfoSyncer); err != nil {
+			return nil, errors.Trace(err)
+		}
+		a.pusher = outbox
+	}
+	return a, nil
+}
+
+// DBMs 返回实例的 DbMap, 与配置中的 schemas 一一对应
+func (log *AuditLogger) DBMs() []*gorp.DbMap {
+	return log.dbms
+}
+
+// DBMTransact 在第一个 schema 上执行事务, 提交成功后推送携带 ctx 的 tx_info
+func (log *AuditLogger) DBMTransact(ctx string, txFunc func(tx *gorp.Transaction) error) error {
+	if len(log.dbms) == 0 {
+		return errors.New("no schema configured")
+	}
+	return mysql.Transact(log.dbms[0], log.pusher, ctx, txFunc)
+}
+
+// DBMTransactContext 在第一个 schema 上执行事务, 审计 Context 从 ctx 中读取, 见 mysql.TransactContext
+func (log *AuditLogger) DBMTransactContext(ctx context.Context, txFunc func(tx *gorp.Transaction) error) error {
+	if len(log.dbms) == 0 {
+		return errors.New("no schema configured")
+	}
+	return mysql.TransactContext(ctx, log.dbms[0], log.pusher, txFunc)
+}
+
+// TxPusher 返回实例的 tx_info 推送者, 用于 mysql.SQLTransact、SQLXTransact、GormTransact.
+// 开启 outbox 时为 *mysql.Outbox
+func (log *AuditLogger) TxPusher() mysql.TxPusher {
+	return log.pusher
+}
+
+// Close 释放 broker、store 和 DbMap, 应在 Stop 之后调用
+func (log *AuditLogger) Close() error {
+	var firstErr error
+	if log.binlogSyncer != nil {
+		if err := log.binlogSyncer.Close(); err != nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	if log.txInfoSyncer != nil {
+		if err := log.txInfoSyncer.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	if log.store != nil {
+		if err := log.store.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	for _, dbm := range log.dbms {
+		if err := dbm.Db.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	return firstErr
+}
+
+// Start 启动 binlogSyncer 和 txInfoSyncer, 审计日志交给 handler 处理
+func (log *AuditLogger) Start(ctx context.Context, handler Handler) error {
+	if err := log.binlogSyncer.Start(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if err := log.txInfoSyncer.Start(ctx, handler.OnAuditLog); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
 }
 
-func New(binlogSyncer *syncer.BinlogSynchronizer, txInfoSyncer *syncer.TxInfoSynchronizer) *AuditLogger {
-	return &AuditLogger{binlogSyncer: binlogSyncer, txInfoSyncer: txInfoSyncer}
+// Stop 先停止 binlogSyncer, 保证已消费的 binlog 全部写入 store, 再停止 txInfoSyncer,
+// 所有数据持久化、所有审计日志处理完毕后返回. ctx 超时则返回 ctx.Err()
+func (log *AuditLogger) Stop(ctx context.Context) error {
+	if err := log.binlogSyncer.Stop(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if err := log.txInfoSyncer.Stop(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// QueryAuditLogs 查询 store 中的审计日志, 按照时间从新到旧排列, nextCursor 为空表示没有更多数据
+func (log *AuditLogger) QueryAuditLogs(q *types.AuditLogQuery) ([]*types.AuditLogRecord, string, error) {
+	records, nextCursor, err := log.txInfoSyncer.Store().QueryAuditLogs(q)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	return records, nextCursor, nil
+}
+
+// GetTxInfo 返回 gtid 对应的 tx_info 的最终状态(见 types.TxInfoStatusName), 不存在时返回 nil
+func (log *AuditLogger) GetTxInfo(gtid string) (*types.ChTxInfo, error) {
+	info, err := log.txInfoSyncer.Store().GetTxInfo(gtid)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return info, nil
+}
+
+// ListDeadLetters 按首次失败时间从早到晚列出最多 limit 条死信, limit <= 0 时列出全部
+func (log *AuditLogger) ListDeadLetters(limit int) ([]*types.DeadLetter, error) {
+	sink := log.txInfoSyncer.DeadLetterSink()
+	if sink == nil {
+		return nil, errors.New("dead letter sink not configured")
+	}
+	letters, err := sink.List(limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetters 将死信重新交给 handler 处理, 成功的死信会被删除, 返回成功的数量
+func (log *AuditLogger) ReplayDeadLetters(handler Handler, letters ...*types.DeadLetter) (int, error) {
+	sink := log.txInfoSyncer.DeadLetterSink()
+	if sink == nil {
+		return 0, errors.New("dead letter sink not configured")
+	}
+	succeeded, err := deadletter.Replay(sink, letters, handler.OnAuditLog)
+	if err != nil {
+		return succeeded, errors.Trace(err)
+	}
+	return succeeded, nil
 }
 
 func (log *AuditLogger) Sync(handler Handler) {
-	go log.txInfoSyncer.HandleAuditLog(handler.OnAuditLog)
-	log.binlogSyncer.Sync()
-	log.txInfoSyncer.Sync()
+	if err := log.Start(context.Background(), handler); err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+	}
 }
 
 func Init(path string) {
@@ -29,10 +215,56 @@ func Init(path string) {
 		panic(err)
 	}
 	onStart(logger.InitLogger)
+	onStart(store.InitStore)
 	onStart(syncer.InitBinlogSyncer)
 	onStart(syncer.InitTxInfoSyncer)
+	onStart(initWatermark)
 	onStart(mysql.InitDBM)
-	onStart(clickhouse.InitClickHouse)
+	onStart(initSourceResolver)
+	onStart(mysql.InitOutbox)
+	onStart(initOutboxRelay)
+}
+
+// initWatermark 同一个进程中的 tx syncer 直接使用 binlog syncer 的 watermark 和 join 窗口
+func initWatermark() error {
+	syncer.TxInfoSyncer.SetWatermark(syncer.BinlogSyncer.Watermark())
+	syncer.TxInfoSyncer.SetJoinWindow(syncer.BinlogSyncer.JoinWindow())
+	return nil
+}
+
+// initSourceResolver 使用第一个 schema 的连接查询外部变更的 MySQL 用户和主机, 以及没有配置主键的表的主键
+func initSourceResolver() error {
+	if mysql.DBM == nil {
+		return nil
+	}
+	if syncer.BinlogSyncer != nil {
+		syncer.BinlogSyncer.SetPrimaryKeyResolver(broker.NewMySQLPrimaryKeyResolver(mysql.DBM.Db))
+	}
+	if syncer.TxInfoSyncer != nil {
+		syncer.TxInfoSyncer.SetSourceResolver(syncer.NewMySQLSourceResolver(mysql.DBM.Db))
+	}
+	return nil
+}
+
+// initOutboxRelay 开启 outbox 时由 binlog syncer 处理 outbox 表中的审计 Context
+func initOutboxRelay() error {
+	if mysql.DBMOutbox == nil {
+		return nil
+	}
+	return setOutbox(config.Main.Outbox, mysql.DBMOutbox, syncer.BinlogSyncer, syncer.TxInfoSyncer)
+}
+
+// setOutbox 按照 cfg.Mode 让 binlog syncer 推送 tx_info(relay) 或直接组装审计日志(embed)
+func setOutbox(cfg *config.OutboxConfig, outbox *mysql.Outbox, b *syncer.BinlogSynchronizer, t *syncer.TxInfoSynchronizer) error {
+	switch cfg.Mode {
+	case "", mysql.OutboxModeRelay:
+		b.SetOutbox(outbox.Table(), t)
+	case mysql.OutboxModeEmbed:
+		b.SetContextMarker(outbox.Table(), t.EnableEmbedded())
+	default:
+		return fmt.Errorf("unknown outbox mode: %s", cfg.Mode)
+	}
+	return nil
 }
 
 func onStart(fn func() error) {
@@ -41,6 +273,11 @@ func onStart(fn func() error) {
 	}
 }
 
-func Run(handler Handler) {
-	New(syncer.BinlogSyncer, syncer.TxInfoSyncer).Sync(handler)
+func Run(handler Handler) *AuditLogger {
+	log := &AuditLogger{binlogSyncer: syncer.BinlogSyncer, txInfoSyncer: syncer.TxInfoSyncer, pusher: syncer.TxInfoSyncer}
+	if mysql.DBMOutbox != nil {
+		log.pusher = mysql.DBMOutbox
+	}
+	log.Sync(handler)
+	return log
 }
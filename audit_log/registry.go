@@ -0,0 +1,137 @@
+package audit_log
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	auditContext "github.com/obgnail/audit-log/context"
+	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/types"
+	"reflect"
+	"sync"
+)
+
+// ContextType 一种业务操作对应的 Context 类型, 例如【插入用户】
+type ContextType struct {
+	Type int    // 对应 Context.Type
+	Name string // 类型的名称, 用于日志和展示
+	// Params 参数的结构体原型, 例如 UserInsertedParams{}. Context 的 Param1、Param2(json key 为 param1、param2)
+	// 以及 Fields 按照 json tag 解码到该结构体的新实例中. 为 nil 时不解码
+	Params  interface{}
+	Handler func(event *ContextEvent) error
+}
+
+// ContextEvent 交给 ContextType.Handler 处理的审计日志
+type ContextEvent struct {
+	Type     *ContextType
+	Context  auditContext.Context
+	Params   interface{} // 指向 ContextType.Params 类型新实例的指针, 例如 *UserInsertedParams
+	Changes  []*types.RowChange
+	AuditLog *types.AuditLog
+}
+
+// Registry 按照 Context.Type 将审计日志分发给注册的 ContextType.Handler,
+// 无法解析 Context 或者没有注册的类型交给 fallback. Registry 本身也是一个 Handler
+type Registry struct {
+	mu       sync.RWMutex
+	types    map[int]*ContextType
+	fallback Handler
+}
+
+// NewRegistry fallback 为 nil 时只记录日志
+func NewRegistry(fallback Handler) *Registry {
+	return &Registry{types: make(map[int]*ContextType), fallback: fallback}
+}
+
+// Register 注册一种 Context 类型, 同一个 Type 只能注册一次
+func (r *Registry) Register(t ContextType) error {
+	if t.Handler == nil {
+		return fmt.Errorf("context type %d(%s) has no handler", t.Type, t.Name)
+	}
+	if t.Params != nil && reflect.TypeOf(t.Params).Kind() != reflect.Struct {
+		return fmt.Errorf("context type %d(%s) params must be a struct", t.Type, t.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if exist, ok := r.types[t.Type]; ok {
+		return fmt.Errorf("context type %d already registered as %s", t.Type, exist.Name)
+	}
+	r.types[t.Type] = &t
+	return nil
+}
+
+// MustRegister 与 Register 相同, 出错时 panic, 用于初始化
+func (r *Registry) MustRegister(t ContextType) {
+	if err := r.Register(t); err != nil {
+		panic(err)
+	}
+}
+
+func (r *Registry) Lookup(typ int) (*ContextType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[typ]
+	return t, ok
+}
+
+func (r *Registry) OnAuditLog(auditLog *types.AuditLog) error {
+	ctx, err := auditContext.FromString(auditLog.Context)
+	if err != nil {
+		return r.onFallback(auditLog, fmt.Sprintf("parse context %q failed: %s", auditLog.Context, err))
+	}
+	t, ok := r.Lookup(ctx.Type)
+	if !ok {
+		return r.onFallback(auditLog, fmt.Sprintf("context type %d not registered", ctx.Type))
+	}
+
+	params, err := decodeParams(t.Params, ctx)
+	if err != nil {
+		return errors.Annotatef(err, "decode params of context type %d(%s)", t.Type, t.Name)
+	}
+	event := &ContextEvent{
+		Type:     t,
+		Context:  ctx,
+		Params:   params,
+		Changes:  auditLog.Changes,
+		AuditLog: auditLog,
+	}
+	if err := t.Handler(event); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (r *Registry) onFallback(auditLog *types.AuditLog, reason string) error {
+	if r.fallback == nil {
+		logger.Warn("%s, audit log dropped, gtid: %s", reason, auditLog.GTID)
+		return nil
+	}
+	return errors.Trace(r.fallback.OnAuditLog(auditLog))
+}
+
+// decodeParams 将 Context 的 Param1、Param2 和 Fields 解码到 prototype 类型的新实例中
+func decodeParams(prototype interface{}, ctx auditContext.Context) (interface{}, error) {
+	if prototype == nil {
+		return nil, nil
+	}
+	values := make(map[string]interface{}, len(ctx.Fields)+2)
+	for k, v := range ctx.Fields {
+		values[k] = v
+	}
+	if ctx.Param1 != "" {
+		values["param1"] = ctx.Param1
+	}
+	if ctx.Param2 != "" {
+		values["param2"] = ctx.Param2
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	params := reflect.New(reflect.TypeOf(prototype)).Interface()
+	if err := json.Unmarshal(b, params); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return params, nil
+}
@@ -0,0 +1,253 @@
+package audit_log
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/obgnail/audit-log/config"
+	auditContext "github.com/obgnail/audit-log/context"
+	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/types"
+)
+
+const (
+	testTypeUserInserted = 1
+	testTypeUserDeleted  = 2
+	testTypeUnregistered = 99
+)
+
+type userInsertedParams struct {
+	UserID   string `json:"param1"`
+	TeamID   string `json:"param2"`
+	Inviter  string `json:"inviter"`
+	Quota    int    `json:"quota"`
+	Optional string `json:"optional"`
+}
+
+func initTestLogger(t *testing.T) {
+	t.Helper()
+	if logger.CommonLogger != nil {
+		return
+	}
+	l, err := logger.NewCommonLogger(&config.LogConfig{LogFile: filepath.Join(t.TempDir(), "test.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.CommonLogger = l
+}
+
+func testAuditLog(ctx string) *types.AuditLog {
+	return &types.AuditLog{
+		GTID:    "uuid:1",
+		Context: ctx,
+		Changes: []*types.RowChange{{Db: "shop", Table: "user", Action: types.EventActionInsert}},
+	}
+}
+
+// fallbackRecorder 记录交给 fallback 的审计日志
+type fallbackRecorder struct {
+	auditLogs []*types.AuditLog
+	err       error
+}
+
+func (f *fallbackRecorder) OnAuditLog(auditLog *types.AuditLog) error {
+	f.auditLogs = append(f.auditLogs, auditLog)
+	return f.err
+}
+
+// testRegistry 注册 userInserted 和 userDeleted 两种类型, 返回每种类型收到的事件
+func testRegistry(t *testing.T, fallback Handler) (*Registry, map[int][]*ContextEvent) {
+	t.Helper()
+	events := make(map[int][]*ContextEvent)
+	record := func(event *ContextEvent) error {
+		events[event.Type.Type] = append(events[event.Type.Type], event)
+		return nil
+	}
+	r := NewRegistry(fallback)
+	r.MustRegister(ContextType{Type: testTypeUserInserted, Name: "user inserted", Params: userInsertedParams{}, Handler: record})
+	r.MustRegister(ContextType{Type: testTypeUserDeleted, Name: "user deleted", Handler: record})
+	return r, events
+}
+
+func TestRegistryDispatch(t *testing.T) {
+	fallback := &fallbackRecorder{}
+	r, events := testRegistry(t, fallback)
+
+	ctx := auditContext.New(testTypeUserInserted, "u1", "t1").With("inviter", "alice").With("quota", 10)
+	inserted := testAuditLog(ctx.String())
+	if err := r.OnAuditLog(inserted); err != nil {
+		t.Fatal(err)
+	}
+	// 旧格式的 Context 同样按照类型分发, 没有 Params 原型时不解码
+	deleted := testAuditLog("2.u1.t1")
+	if err := r.OnAuditLog(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fallback.auditLogs) != 0 {
+		t.Fatalf("%d audit logs passed to fallback, want 0", len(fallback.auditLogs))
+	}
+	if len(events[testTypeUserInserted]) != 1 || len(events[testTypeUserDeleted]) != 1 {
+		t.Fatalf("dispatched events = %v, want one of each type", events)
+	}
+
+	event := events[testTypeUserInserted][0]
+	if event.AuditLog != inserted || len(event.Changes) != 1 || event.Context.Param1 != "u1" {
+		t.Fatalf("user inserted event = %+v", event)
+	}
+	params, ok := event.Params.(*userInsertedParams)
+	if !ok {
+		t.Fatalf("params type = %T, want *userInsertedParams", event.Params)
+	}
+	want := userInsertedParams{UserID: "u1", TeamID: "t1", Inviter: "alice", Quota: 10}
+	if *params != want {
+		t.Fatalf("params = %+v, want %+v", *params, want)
+	}
+
+	event = events[testTypeUserDeleted][0]
+	if event.AuditLog != deleted || event.Params != nil || event.Context.Param2 != "t1" {
+		t.Fatalf("user deleted event = %+v", event)
+	}
+}
+
+func TestRegistryFallback(t *testing.T) {
+	cases := []struct {
+		name    string
+		context string
+	}{
+		{name: "unregistered type", context: auditContext.New(testTypeUnregistered, "u1", "").String()},
+		{name: "unattributed", context: auditContext.Unattributed("root", "127.0.0.1", "uuid").String()},
+		{name: "invalid context", context: "{not json"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fallback := &fallbackRecorder{}
+			r, events := testRegistry(t, fallback)
+			auditLog := testAuditLog(c.context)
+			if err := r.OnAuditLog(auditLog); err != nil {
+				t.Fatal(err)
+			}
+			if len(fallback.auditLogs) != 1 || fallback.auditLogs[0] != auditLog {
+				t.Fatalf("fallback got %d audit logs, want the original one", len(fallback.auditLogs))
+			}
+			if len(events) != 0 {
+				t.Fatalf("registered handlers got %v", events)
+			}
+
+			// fallback 的错误返回给调用方, 以便重试
+			fallback.err = errors.New("fallback failed")
+			if err := r.OnAuditLog(auditLog); err == nil {
+				t.Fatal("fallback error not returned")
+			}
+		})
+	}
+}
+
+// TestRegistryNilFallback 没有 fallback 时丢弃审计日志, 不返回错误
+func TestRegistryNilFallback(t *testing.T) {
+	initTestLogger(t)
+	r, events := testRegistry(t, nil)
+	for _, ctx := range []string{auditContext.New(testTypeUnregistered, "", "").String(), "{not json"} {
+		if err := r.OnAuditLog(testAuditLog(ctx)); err != nil {
+			t.Fatalf("OnAuditLog(%q) = %v, want nil", ctx, err)
+		}
+	}
+	if len(events) != 0 {
+		t.Fatalf("registered handlers got %v", events)
+	}
+}
+
+func TestRegistryDecodeError(t *testing.T) {
+	cases := []struct {
+		name string
+		ctx  auditContext.Context
+	}{
+		{name: "field type mismatch", ctx: auditContext.New(testTypeUserInserted, "u1", "").With("quota", "ten")},
+		{name: "param type mismatch", ctx: auditContext.New(testTypeUserInserted, "u1", "").With("inviter", 1)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fallback := &fallbackRecorder{}
+			r, events := testRegistry(t, fallback)
+			if err := r.OnAuditLog(testAuditLog(c.ctx.String())); err == nil {
+				t.Fatal("decode error not returned")
+			}
+			if len(events) != 0 || len(fallback.auditLogs) != 0 {
+				t.Fatalf("handlers called with undecodable params: events %v, fallback %d", events, len(fallback.auditLogs))
+			}
+		})
+	}
+}
+
+func TestRegistryHandlerError(t *testing.T) {
+	r := NewRegistry(nil)
+	r.MustRegister(ContextType{Type: testTypeUserInserted, Handler: func(*ContextEvent) error {
+		return errors.New("handle failed")
+	}})
+	if err := r.OnAuditLog(testAuditLog(auditContext.New(testTypeUserInserted, "", "").String())); err == nil {
+		t.Fatal("handler error not returned")
+	}
+}
+
+func TestDecodeParams(t *testing.T) {
+	// 只有 Param1 时 param2 不出现在结果中; Fields 中的 param1 被 Param1 覆盖
+	ctx := auditContext.New(testTypeUserInserted, "u1", "").With("param1", "ignored").With("unknown", true)
+	params, err := decodeParams(userInsertedParams{}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *params.(*userInsertedParams), (userInsertedParams{UserID: "u1"}); got != want {
+		t.Fatalf("params = %+v, want %+v", got, want)
+	}
+
+	// Context 经过序列化后数字为 json.Number
+	parsed, err := auditContext.FromString(auditContext.New(testTypeUserInserted, "", "").With("quota", 7).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err = decodeParams(userInsertedParams{}, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := params.(*userInsertedParams).Quota; got != 7 {
+		t.Fatalf("quota = %d, want 7", got)
+	}
+
+	if params, err := decodeParams(nil, ctx); params != nil || err != nil {
+		t.Fatalf("decodeParams(nil) = %v, %v, want nil", params, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	handler := func(*ContextEvent) error { return nil }
+	r := NewRegistry(nil)
+	if err := r.Register(ContextType{Type: testTypeUserInserted, Name: "user inserted", Params: userInsertedParams{}, Handler: handler}); err != nil {
+		t.Fatal(err)
+	}
+	if t1, ok := r.Lookup(testTypeUserInserted); !ok || t1.Name != "user inserted" {
+		t.Fatalf("Lookup = %+v, %v", t1, ok)
+	}
+	if _, ok := r.Lookup(testTypeUserDeleted); ok {
+		t.Fatal("unregistered type found")
+	}
+
+	cases := []struct {
+		name string
+		t    ContextType
+	}{
+		{name: "no handler", t: ContextType{Type: testTypeUserDeleted}},
+		{name: "non struct params", t: ContextType{Type: testTypeUserDeleted, Params: &userInsertedParams{}, Handler: handler}},
+		{name: "duplicate type", t: ContextType{Type: testTypeUserInserted, Handler: handler}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := r.Register(c.t); err == nil {
+				t.Fatal("invalid context type registered")
+			}
+		})
+	}
+	if _, ok := r.Lookup(testTypeUserDeleted); ok {
+		t.Fatal("invalid context type registered")
+	}
+}
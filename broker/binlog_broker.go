@@ -1,115 +1,355 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
-	"github.com/Shopify/sarama"
 	"github.com/juju/errors"
 	"github.com/obgnail/audit-log/logger"
 	"github.com/obgnail/audit-log/types"
-	"github.com/obgnail/mysql-river/handler/kafka"
 	"github.com/obgnail/mysql-river/river"
-	"strings"
+	"sync"
+	"time"
 )
 
+// eventTypeXID river 在事务提交(XID event)时发送的事件类型
+const eventTypeXID = "xid"
+
+// defaultSkippedFlushInterval 定时发送被丢弃的事务的进度以及重新发送失败的事务, 见 flushIdle
+const defaultSkippedFlushInterval = 500 * time.Millisecond
+
 type BinlogBrokerConfig struct {
-	KafkaConfig *kafka.Config
-	Tables      []string
+	Transport     Transport
+	Tables        []string // 需要处理的表, 格式为 db.table(支持 * 和 ? 通配符) 或 /regexp/
+	ExcludeTables []string // 不需要处理的表, 优先于 Tables
+	ColumnRules   []ColumnRule
+	HashKey       string              // ColumnRule.Hash 使用的密钥
+	PrimaryKeys   map[string][]string // map[db.table][]column, 覆盖从表结构中查询的主键, 见 SetPrimaryKeyResolver
 }
 
-type BinlogKafkaBroker struct {
-	include       map[string]map[string]struct{} // map[db]map[table]struct{}
-	defaultBroker *kafka.Broker
+// TxPusher 推送 tx_info, 见 TxBroker
+type TxPusher interface {
+	PushTx(txInfo *types.TxInfo) error
 }
 
-func New(cfg *BinlogBrokerConfig) (*BinlogKafkaBroker, error) {
-	h := new(BinlogKafkaBroker)
-	mapDb2Table := make(map[string]map[string]struct{})
-	for _, ele := range cfg.Tables {
-		list := strings.Split(ele, ".")
-		db, table := list[0], list[1]
-		if _, ok := mapDb2Table[db]; !ok {
-			mapDb2Table[db] = make(map[string]struct{})
-		}
-		mapDb2Table[db][table] = struct{}{}
-	}
-	h.include = mapDb2Table
+// BinlogBroker 作为 river 的 handler, 将 binlog event 按事务缓存, 事务提交(XID)时作为一条 types.BinlogTransaction
+// 发送到 transport. 没有收到 XID 时在 gtid 变化(下一个事务到达)或者停止时发送, 不会按时间拆分发送.
+// 发送失败的事务按顺序保留在内存中, 定时重新发送, 之后的 event 继续缓存, 不会丢失或者打乱顺序
+type BinlogBroker struct {
+	filter      *tableFilter
+	primaryKeys *primaryKeys
+	transport   Transport
+
+	outboxTable  string
+	outboxPusher TxPusher // relay 模式
+	embed        bool     // embed 模式
 
-	var err error
-	h.defaultBroker, err = kafka.New(cfg.KafkaConfig)
+	// river 的 handler 和定时发送进度的 goroutine 会同时访问
+	mu        sync.Mutex
+	pending   *types.BinlogTransaction
+	ready     []*types.BinlogTransaction // 已经结束但还没有发送成功的事务和进度, 按顺序发送, 见 publishReady
+	skipped   string                     // 最近一个没有需要处理的 event 而没有发送的事务, 定时作为进度发送, 见 flushIdle
+	published map[string]int64           // map[server uuid]已经发送(覆盖)的最大序号, 见 covers
+}
+
+func New(cfg *BinlogBrokerConfig) (*BinlogBroker, error) {
+	if cfg.Transport == nil {
+		return nil, errors.New("binlog broker transport is nil")
+	}
+	filter, err := newTableFilter(cfg.Tables, cfg.ExcludeTables, cfg.ColumnRules, cfg.HashKey)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	h.defaultBroker.SetHandler(h)
+	h := new(BinlogBroker)
+	h.filter = filter
+	h.primaryKeys = newPrimaryKeys(cfg.PrimaryKeys)
+	h.transport = cfg.Transport
+	h.published = make(map[string]int64)
 	return h, nil
 }
 
-func (b *BinlogKafkaBroker) String() string {
-	return "kafka broker"
+// SetPrimaryKeyResolver 设置没有配置主键的表的主键查询方式, 为 nil 时只使用配置中的主键. 需要在 Pipe 之前调用
+func (b *BinlogBroker) SetPrimaryKeyResolver(resolver PrimaryKeyResolver) {
+	b.primaryKeys.setResolver(resolver)
+}
+
+// SetOutbox 开启 outbox 模式: 任意库中名为 table 的表的插入事件不再作为 binlog event 发送,
+// 而是作为所在事务的 tx_info 通过 pusher 推送. 需要在 Pipe 之前调用
+func (b *BinlogBroker) SetOutbox(table string, pusher TxPusher) {
+	b.outboxTable = table
+	b.outboxPusher = pusher
+}
+
+// SetContextMarker 开启 embed 模式: 任意库中名为 table 的表的插入事件中的审计 Context 附加到
+// 所在的事务上(BinlogTransaction.Context), 不再推送 tx_info. 需要在 Pipe 之前调用
+func (b *BinlogBroker) SetContextMarker(table string) {
+	b.outboxTable = table
+	b.embed = true
+}
+
+func (b *BinlogBroker) isOutbox(event *river.EventData) bool {
+	return b.outboxTable != "" && event.Table == b.outboxTable
 }
 
-func (b *BinlogKafkaBroker) check(db, table string) bool {
-	if _, ok := b.include[db]; !ok {
-		return false
+// onOutbox 处理 outbox 表的插入事件, 删除事件忽略
+func (b *BinlogBroker) onOutbox(event *river.EventData) error {
+	if event.EventType != river.EventTypeInsert {
+		return nil
+	}
+	var ctx string
+	switch v := event.After["context"].(type) {
+	case string:
+		ctx = v
+	case []byte:
+		ctx = string(v)
+	default:
+		logger.Warn("invalid outbox context %v, gtid: %s", event.After["context"], event.GTIDSet)
+		return nil
+	}
+
+	if b.embed {
+		b.transaction(event.GTIDSet).Context = ctx
+		return nil
+	}
+	info := &types.TxInfo{Time: int64(event.Timestamp), Context: ctx, GTID: event.GTIDSet}
+	if err := b.outboxPusher.PushTx(info); err != nil {
+		return errors.Trace(err)
 	}
-	if _, ok := b.include[db][table]; !ok {
-		return false
+	return nil
+}
+
+func (b *BinlogBroker) String() string {
+	return "binlog broker"
+}
+
+// transaction 返回 gtid 对应的当前事务, 需要持有 mu. 调用前需要先 flush 之前的事务
+func (b *BinlogBroker) transaction(gtid string) *types.BinlogTransaction {
+	if b.pending == nil {
+		b.pending = &types.BinlogTransaction{GTID: gtid}
+		// 启动后第一个事务之前的事务已经在上次运行时处理过, 从第一个事务开始覆盖
+		if uuid, n, err := types.ParseGTID(gtid); err == nil {
+			if _, ok := b.published[uuid]; !ok {
+				b.published[uuid] = n - 1
+			}
+		}
 	}
-	return true
+	return b.pending
 }
 
-func (b *BinlogKafkaBroker) Marshal(event *river.EventData) ([]byte, error) {
+// binlogEvent 将 river 的 event 转换为过滤和脱敏后的 BinlogEvent, 不需要处理的表返回 nil
+func (b *BinlogBroker) binlogEvent(event *river.EventData, seq uint32) *types.BinlogEvent {
 	switch event.EventType {
 	case river.EventTypeInsert, river.EventTypeUpdate, river.EventTypeDelete:
-		if b.check(event.Db, event.Table) {
-			binlog, err := types.NewBinlogEvent(event)
-			if err != nil {
+		if !b.filter.handled(event.Db, event.Table) {
+			return nil
+		}
+		primary := b.primaryKeys.get(event.Db, event.Table)
+		// 过滤和脱敏后再发送, 被去掉的字段和敏感数据不会进入 transport 和 store
+		filtered := *event
+		filtered.Before = b.filter.apply(event.Db, event.Table, event.Before, primary)
+		filtered.After = b.filter.apply(event.Db, event.Table, event.After, primary)
+		binlog, err := types.NewBinlogEvent(&filtered, primary, seq)
+		if err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+			return nil
+		}
+		return binlog
+	}
+	return nil
+}
+
+// covers 返回 gtid 所在的消息写入后消费者的 watermark 覆盖的 GTID 集合: 同一个 server 上一条消息之后到 gtid 的所有事务.
+// binlog 按照提交顺序读取, 这之间没有发送的事务都被丢弃了. 无法解析的 gtid 只覆盖自己, 需要持有 mu
+func (b *BinlogBroker) covers(gtid string) string {
+	uuid, n, err := types.ParseGTID(gtid)
+	if err != nil {
+		return ""
+	}
+	return types.GTIDRange(uuid, b.published[uuid], n)
+}
+
+// publish 发送事务并记录已经发送的序号, 需要持有 mu
+func (b *BinlogBroker) publish(tx *types.BinlogTransaction) error {
+	tx.Covers = b.covers(tx.GTID)
+	result, err := tx.Marshal()
+	if err != nil {
+		// 重新发送也无法序列化
+		logger.ErrorDetails(errors.Trace(err))
+		return nil
+	}
+	if err := b.transport.Publish(result); err != nil {
+		return errors.Trace(err)
+	}
+	if uuid, n, err := types.ParseGTID(tx.GTID); err == nil && n > b.published[uuid] {
+		b.published[uuid] = n
+	}
+	// 被丢弃的事务已经被覆盖
+	if b.skipped != "" && b.covered(b.skipped) {
+		b.skipped = ""
+	}
+	return nil
+}
+
+// covered gtid 是否已经被发送的消息覆盖, 需要持有 mu
+func (b *BinlogBroker) covered(gtid string) bool {
+	uuid, n, err := types.ParseGTID(gtid)
+	return err == nil && n <= b.published[uuid]
+}
+
+// publishReady 按顺序发送 ready 中的事务, 发送失败时保留失败的以及之后的事务, 之后重新发送, 需要持有 mu
+func (b *BinlogBroker) publishReady() error {
+	for len(b.ready) != 0 {
+		if err := b.publish(b.ready[0]); err != nil {
+			return errors.Trace(err)
+		}
+		b.ready[0] = nil
+		b.ready = b.ready[1:]
+	}
+	return nil
+}
+
+// flush 结束当前事务并发送, 需要持有 mu. 没有需要处理的 event 时丢弃, 只记录进度.
+// 发送失败时事务保留在 ready 中, 之后重新发送
+func (b *BinlogBroker) flush() error {
+	tx := b.pending
+	if tx == nil {
+		return nil
+	}
+	b.pending = nil
+	if len(tx.Events) == 0 {
+		// 不同 server 的进度不能合并, 之前的进度先放入 ready
+		if b.skipped != "" && !sameServer(b.skipped, tx.GTID) {
+			b.ready = append(b.ready, &types.BinlogTransaction{GTID: b.skipped})
+		}
+		b.skipped = tx.GTID
+		return nil
+	}
+	tx.RowCount = uint32(len(tx.Events))
+	b.ready = append(b.ready, tx)
+	return errors.Trace(b.publishReady())
+}
+
+// flushSkipped 重新发送失败的事务, 然后发送一个没有 event 的事务作为进度, 让消费者的 watermark 覆盖被丢弃的事务,
+// 需要持有 mu
+func (b *BinlogBroker) flushSkipped() error {
+	if b.skipped != "" {
+		b.ready = append(b.ready, &types.BinlogTransaction{GTID: b.skipped})
+		b.skipped = ""
+	}
+	return errors.Trace(b.publishReady())
+}
+
+func sameServer(gtid1, gtid2 string) bool {
+	uuid1, _, err1 := types.ParseGTID(gtid1)
+	uuid2, _, err2 := types.ParseGTID(gtid2)
+	return err1 == nil && err2 == nil && uuid1 == uuid2
+}
+
+func (b *BinlogBroker) OnEvent(event *river.EventData) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// gtid 变化说明之前的事务已经结束. 发送失败的事务保留在 ready 中, 当前 event 仍然需要缓存
+	if b.pending != nil && event.GTIDSet != b.pending.GTID {
+		if err := b.flush(); err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+		}
+	}
+	if event.EventType == eventTypeXID {
+		if err := b.flush(); err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+		}
+		return nil
+	}
+	if b.isOutbox(event) {
+		return errors.Trace(b.onOutbox(event))
+	}
+	tx := b.transaction(event.GTIDSet)
+	if binlog := b.binlogEvent(event, uint32(len(tx.Events))); binlog != nil {
+		tx.Events = append(tx.Events, binlog)
+	}
+	return nil
+}
+
+// flushIdle 定时重新发送失败的事务以及发送被丢弃的事务的进度, 当前事务还没有结束也不会发送, 避免一个事务被拆分成多条消息.
+// done 关闭后发送当前事务和剩余的进度并返回, 仍然发送失败的事务会丢失
+func (b *BinlogBroker) flushIdle(done <-chan struct{}) {
+	ticker := time.NewTicker(defaultSkippedFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			b.mu.Lock()
+			if err := b.flush(); err != nil {
+				logger.ErrorDetails(errors.Trace(err))
+			}
+			if err := b.flushSkipped(); err != nil {
 				logger.ErrorDetails(errors.Trace(err))
-				return nil, nil
+				logger.Error("%d binlog transactions not published before close", len(b.ready))
 			}
-			result, err := binlog.Marshal()
-			if err != nil {
+			b.mu.Unlock()
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			// skipped 早于 pending, 先发送不会打乱顺序
+			if err := b.flushSkipped(); err != nil {
 				logger.ErrorDetails(errors.Trace(err))
-				return nil, nil
 			}
-			return result, nil
+			b.mu.Unlock()
 		}
 	}
-	return nil, nil
 }
 
-func (b *BinlogKafkaBroker) OnAlert(msg *river.StatusMsg) error {
+func (b *BinlogBroker) OnAlert(msg *river.StatusMsg) error {
 	logger.Warn("binlog broker on alert: %+v", *msg)
 	return nil
 }
 
-func (b *BinlogKafkaBroker) OnClose(r *river.River) {
+func (b *BinlogBroker) OnClose(r *river.River) {
 	logger.ErrorDetails(r.Error)
 	return
 }
 
-// Pipe 将river中的数据流向kafka
-func (b *BinlogKafkaBroker) Pipe(river *river.River, from river.From) error {
-	if err := b.defaultBroker.Pipe(river, from); err != nil {
+// Pipe 将river中的数据按事务流向transport
+func (b *BinlogBroker) Pipe(r *river.River, from river.From) error {
+	done := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		b.flushIdle(done)
+	}()
+	defer func() {
+		close(done)
+		<-flushed
+	}()
+
+	if err := r.SetHandler(b).Sync(from); err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-// Consume 消费kafka中的数据
-func (b *BinlogKafkaBroker) Consume(fn func(*types.BinlogEvent) error) error {
-	consumer := func(msg *sarama.ConsumerMessage) error {
-		event := types.BinlogEvent{}
-		if err := json.Unmarshal(msg.Value, &event); err != nil {
+// Consume 消费transport中的事务, 直到 ctx 被取消.
+// fn 需要在事务的 event 持久化之后调用 ack, 只有被 ack 的消息才会提交
+func (b *BinlogBroker) Consume(ctx context.Context, fn func(tx *types.BinlogTransaction, ack Ack) error) error {
+	consumer := func(msg []byte, ack Ack) error {
+		tx := types.BinlogTransaction{}
+		if err := json.Unmarshal(msg, &tx); err != nil {
+			// 无法解析的消息重新消费也无法处理, 直接提交
+			ack(true)
 			return errors.Trace(err)
 		}
-		if err := fn(&event); err != nil {
+		if err := fn(&tx, ack); err != nil {
 			return errors.Trace(err)
 		}
 		return nil
 	}
-
-	if err := b.defaultBroker.Consume(consumer); err != nil {
+	if err := b.transport.Consume(ctx, consumer); err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
+
+func (b *BinlogBroker) Close() error {
+	return errors.Trace(b.transport.Close())
+}
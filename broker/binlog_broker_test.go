@@ -0,0 +1,327 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/obgnail/audit-log/types"
+	"github.com/obgnail/mysql-river/river"
+)
+
+const testServer = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+// recordTransport 记录发送的事务, fail 为 true 时发送失败
+type recordTransport struct {
+	published []*types.BinlogTransaction
+	fail      bool
+}
+
+func (t *recordTransport) Publish(msg []byte) error {
+	if t.fail {
+		return errors.New("publish failed")
+	}
+	tx := new(types.BinlogTransaction)
+	if err := json.Unmarshal(msg, tx); err != nil {
+		return err
+	}
+	t.published = append(t.published, tx)
+	return nil
+}
+
+func (t *recordTransport) Consume(ctx context.Context, fn func(msg []byte, ack Ack) error) error {
+	return nil
+}
+
+func (t *recordTransport) Close() error {
+	return nil
+}
+
+func newTestBinlogBroker(t *testing.T) (*BinlogBroker, *recordTransport) {
+	t.Helper()
+	transport := new(recordTransport)
+	b, err := New(&BinlogBrokerConfig{
+		Transport:   transport,
+		Tables:      []string{"shop.*"},
+		PrimaryKeys: map[string][]string{"shop.user": {"id"}, "shop.order": {"id"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, transport
+}
+
+// testXID 返回 gtid 对应事务的提交事件
+func testXID(gtid string) *river.EventData {
+	return &river.EventData{EventType: eventTypeXID, GTIDSet: gtid}
+}
+
+// testSkippedEvent 返回 gtid 对应事务中不需要处理的表的插入事件
+func testSkippedEvent(gtid string) *river.EventData {
+	return &river.EventData{EventType: river.EventTypeInsert, Db: "other", Table: "user", GTIDSet: gtid}
+}
+
+// closeBroker 相当于 Pipe 返回时 flushIdle 的处理
+func closeBroker(b *BinlogBroker) {
+	done := make(chan struct{})
+	close(done)
+	b.flushIdle(done)
+}
+
+type publishedTx struct {
+	gtid     string
+	covers   string
+	rowCount uint32
+	seqs     []uint32
+	context  string
+}
+
+func toPublishedTxs(txs []*types.BinlogTransaction) []publishedTx {
+	result := make([]publishedTx, 0, len(txs))
+	for _, tx := range txs {
+		p := publishedTx{gtid: tx.GTID, covers: tx.Covers, rowCount: tx.RowCount, context: tx.Context}
+		for _, event := range tx.Events {
+			p.seqs = append(p.seqs, event.Seq)
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// testRowEvent 返回 gtid 对应事务中 table 的插入事件
+func testRowEvent(gtid, table string) *river.EventData {
+	return &river.EventData{
+		EventType: river.EventTypeInsert,
+		Db:        "shop",
+		Table:     table,
+		After:     map[string]interface{}{"id": int64(1)},
+		GTIDSet:   gtid,
+	}
+}
+
+func TestBinlogBrokerCovers(t *testing.T) {
+	initTestLogger(t)
+
+	b, transport := newTestBinlogBroker(t)
+	events := []*river.EventData{
+		testRowEvent(testServer+":1", "user"),
+		testRowEvent(testServer+":2", "log"),
+		{EventType: river.EventTypeInsert, Db: "other", Table: "user", GTIDSet: testServer + ":3"},
+		testRowEvent(testServer+":4", "user"),
+		{EventType: river.EventTypeInsert, Db: "other", Table: "user", GTIDSet: testServer + ":5"},
+	}
+	for _, event := range events {
+		if err := b.OnEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.mu.Lock()
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.flushSkipped(); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Unlock()
+
+	// shop.log 也是需要处理的表, 事务 2 单独发送; 事务 3 被丢弃, 由事务 4 覆盖; 事务 5 作为进度发送
+	want := []struct{ gtid, covers string }{
+		{testServer + ":1", testServer + ":1"},
+		{testServer + ":2", testServer + ":2"},
+		{testServer + ":4", testServer + ":3-4"},
+		{testServer + ":5", testServer + ":5"},
+	}
+	if len(transport.published) != len(want) {
+		t.Fatalf("published %d transactions, want %d", len(transport.published), len(want))
+	}
+	for i, tx := range transport.published {
+		if tx.GTID != want[i].gtid || tx.Covers != want[i].covers {
+			t.Fatalf("published[%d] = (%s, %s), want (%s, %s)", i, tx.GTID, tx.Covers, want[i].gtid, want[i].covers)
+		}
+	}
+}
+
+func TestBinlogBrokerGrouping(t *testing.T) {
+	initTestLogger(t)
+
+	gtid := func(n int) string {
+		return testServer + ":" + string(rune('0'+n))
+	}
+	cases := []struct {
+		name   string
+		marker string // embed 模式的 marker 表
+		events []*river.EventData
+		close  bool // 处理完 event 之后停止
+		want   []publishedTx
+	}{
+		{
+			name:   "flush on xid",
+			events: []*river.EventData{testRowEvent(gtid(1), "user"), testRowEvent(gtid(1), "order"), testXID(gtid(1))},
+			want:   []publishedTx{{gtid: gtid(1), covers: gtid(1), rowCount: 2, seqs: []uint32{0, 1}}},
+		},
+		{
+			name:   "not flushed before xid",
+			events: []*river.EventData{testRowEvent(gtid(1), "user"), testRowEvent(gtid(1), "order")},
+			want:   []publishedTx{},
+		},
+		{
+			name:   "flush on gtid change without xid",
+			events: []*river.EventData{testRowEvent(gtid(1), "user"), testRowEvent(gtid(2), "user")},
+			want:   []publishedTx{{gtid: gtid(1), covers: gtid(1), rowCount: 1, seqs: []uint32{0}}},
+		},
+		{
+			name: "skipped transaction covered by next",
+			events: []*river.EventData{
+				testSkippedEvent(gtid(1)), testXID(gtid(1)),
+				testRowEvent(gtid(2), "user"), testXID(gtid(2)),
+			},
+			want: []publishedTx{{gtid: gtid(2), covers: testServer + ":1-2", rowCount: 1, seqs: []uint32{0}}},
+		},
+		{
+			name:   "skipped rows not counted",
+			events: []*river.EventData{testRowEvent(gtid(1), "user"), testSkippedEvent(gtid(1)), testRowEvent(gtid(1), "order"), testXID(gtid(1))},
+			want:   []publishedTx{{gtid: gtid(1), covers: gtid(1), rowCount: 2, seqs: []uint32{0, 1}}},
+		},
+		{
+			name:   "skipped progress on close",
+			events: []*river.EventData{testSkippedEvent(gtid(1)), testXID(gtid(1))},
+			close:  true,
+			want:   []publishedTx{{gtid: gtid(1), covers: gtid(1)}},
+		},
+		{
+			name:   "pending transaction on close",
+			events: []*river.EventData{testRowEvent(gtid(1), "user")},
+			close:  true,
+			want:   []publishedTx{{gtid: gtid(1), covers: gtid(1), rowCount: 1, seqs: []uint32{0}}},
+		},
+		{
+			name:   "embed context",
+			marker: "audit_context",
+			events: []*river.EventData{
+				testRowEvent(gtid(1), "user"),
+				{EventType: river.EventTypeInsert, Db: "shop", Table: "audit_context", After: map[string]interface{}{"context": "ctx"}, GTIDSet: gtid(1)},
+				testXID(gtid(1)),
+			},
+			want: []publishedTx{{gtid: gtid(1), covers: gtid(1), rowCount: 1, seqs: []uint32{0}, context: "ctx"}},
+		},
+		{
+			name:   "embed context before rows",
+			marker: "audit_context",
+			events: []*river.EventData{
+				{EventType: river.EventTypeInsert, Db: "shop", Table: "audit_context", After: map[string]interface{}{"context": "ctx"}, GTIDSet: gtid(1)},
+				testRowEvent(gtid(1), "user"),
+				testXID(gtid(1)),
+			},
+			want: []publishedTx{{gtid: gtid(1), covers: gtid(1), rowCount: 1, seqs: []uint32{0}, context: "ctx"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, transport := newTestBinlogBroker(t)
+			if c.marker != "" {
+				b.SetContextMarker(c.marker)
+			}
+			for _, event := range c.events {
+				if err := b.OnEvent(event); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.close {
+				closeBroker(b)
+			}
+			if got := toPublishedTxs(transport.published); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("published = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBinlogBrokerPublishFailure(t *testing.T) {
+	initTestLogger(t)
+
+	b, transport := newTestBinlogBroker(t)
+	transport.fail = true
+	events := []*river.EventData{
+		testRowEvent(testServer+":1", "user"), testXID(testServer + ":1"),
+		testRowEvent(testServer+":2", "user"), testRowEvent(testServer+":2", "order"),
+		testSkippedEvent(testServer + ":3"), testXID(testServer + ":3"),
+	}
+	for _, event := range events {
+		if err := b.OnEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(transport.published) != 0 {
+		t.Fatalf("published %d transactions while transport is failing", len(transport.published))
+	}
+
+	// 恢复之后按顺序发送, 发送失败期间收到的 event 没有丢失
+	transport.fail = false
+	closeBroker(b)
+	want := []publishedTx{
+		{gtid: testServer + ":1", covers: testServer + ":1", rowCount: 1, seqs: []uint32{0}},
+		{gtid: testServer + ":2", covers: testServer + ":2", rowCount: 2, seqs: []uint32{0, 1}},
+		{gtid: testServer + ":3", covers: testServer + ":3"},
+	}
+	if got := toPublishedTxs(transport.published); !reflect.DeepEqual(got, want) {
+		t.Fatalf("published = %+v, want %+v", got, want)
+	}
+}
+
+// recordPusher 记录推送的 tx_info, fail 为 true 时推送失败
+type recordPusher struct {
+	pushed []*types.TxInfo
+	fail   bool
+}
+
+func (p *recordPusher) PushTx(txInfo *types.TxInfo) error {
+	if p.fail {
+		return errors.New("push failed")
+	}
+	p.pushed = append(p.pushed, txInfo)
+	return nil
+}
+
+func TestBinlogBrokerOutboxRelay(t *testing.T) {
+	initTestLogger(t)
+
+	const gtid = testServer + ":1"
+	outbox := func(eventType string) *river.EventData {
+		return &river.EventData{
+			EventType: eventType,
+			Db:        "shop",
+			Table:     "audit_outbox",
+			Before:    map[string]interface{}{"context": "ctx"},
+			After:     map[string]interface{}{"context": []byte("ctx")},
+			GTIDSet:   gtid,
+			Timestamp: 1700000000,
+		}
+	}
+
+	b, transport := newTestBinlogBroker(t)
+	pusher := new(recordPusher)
+	b.SetOutbox("audit_outbox", pusher)
+	// outbox 的插入事件推送 tx_info, 删除事件忽略, 都不计入事务的 event
+	events := []*river.EventData{outbox(river.EventTypeInsert), outbox(river.EventTypeDelete), testRowEvent(gtid, "user"), testXID(gtid)}
+	for _, event := range events {
+		if err := b.OnEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantPushed := []*types.TxInfo{{Time: 1700000000, Context: "ctx", GTID: gtid}}
+	if !reflect.DeepEqual(pusher.pushed, wantPushed) {
+		t.Fatalf("pushed = %+v, want %+v", pusher.pushed, wantPushed)
+	}
+	wantPublished := []publishedTx{{gtid: gtid, covers: gtid, rowCount: 1, seqs: []uint32{0}}}
+	if got := toPublishedTxs(transport.published); !reflect.DeepEqual(got, wantPublished) {
+		t.Fatalf("published = %+v, want %+v", got, wantPublished)
+	}
+
+	// 推送失败时返回错误, river 停在该位置
+	pusher.fail = true
+	if err := b.OnEvent(outbox(river.EventTypeInsert)); err == nil {
+		t.Fatal("outbox push failure not returned")
+	}
+}
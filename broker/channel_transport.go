@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/logger"
+	"sync"
+)
+
+const defaultChannelTransportSize = 1024
+
+var errTransportClosed = errors.New("transport closed")
+
+// ChannelTransport 进程内基于 channel 的 Transport, 用于单进程部署和测试.
+// 消息只保存在内存中, 进程退出后未消费的消息会丢失
+type ChannelTransport struct {
+	ch chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewChannelTransport(size int) *ChannelTransport {
+	if size <= 0 {
+		size = defaultChannelTransportSize
+	}
+	return &ChannelTransport{ch: make(chan []byte, size), closed: make(chan struct{})}
+}
+
+// Publish channel 已满时会阻塞, 直到消息被消费或 transport 被关闭
+func (t *ChannelTransport) Publish(msg []byte) error {
+	select {
+	case t.ch <- msg:
+		return nil
+	case <-t.closed:
+		return errTransportClosed
+	}
+}
+
+func (t *ChannelTransport) Consume(ctx context.Context, fn func(msg []byte, ack Ack) error) error {
+	for {
+		select {
+		case msg := <-t.ch:
+			if err := fn(msg, func(bool) {}); err != nil {
+				logger.ErrorDetails(errors.Trace(err))
+			}
+		case <-ctx.Done():
+			return nil
+		case <-t.closed:
+			return nil
+		}
+	}
+}
+
+func (t *ChannelTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
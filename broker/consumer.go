@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/logger"
+	"sync"
+)
+
+// Ack 在消息被处理(持久化)后调用. commit 为 true 时标记 offset, 随后提交;
+// 为 false 时表示放弃该消息且不提交 offset, 重启后会被重新消费. 多次调用只有第一次生效.
+// 消息可以乱序 Ack, 只有之前的消息都已 Ack 时才会提交它的 offset(见 claimAcks)
+type Ack func(commit bool)
+
+// groupHandler 实现 sarama.ConsumerGroupHandler, 消息被 Ack 后才标记 offset
+type groupHandler struct {
+	fn func(msg *sarama.ConsumerMessage, ack Ack) error
+}
+
+func (h groupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup 在 session 结束时(rebalance 或停止消费)同步提交已标记的 offset
+func (h groupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	session.Commit()
+	return nil
+}
+
+// ConsumeClaim 返回前会等待所有已投递的消息被 Ack, 保证 Cleanup 时能提交它们的 offset
+func (h groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	acks := newClaimAcks(func(msg *sarama.ConsumerMessage) { session.MarkMessage(msg, "") })
+	defer acks.wait()
+
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			ack := acks.newAck(msg)
+			if err := h.fn(msg, ack); err != nil {
+				// 无法处理的消息(比如格式错误)直接跳过, 避免阻塞后面的消息
+				logger.ErrorDetails(errors.Trace(err))
+				ack(true)
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// claimAcks 一个 partition 已投递但还未标记的消息, 按投递(offset)顺序排列.
+// MarkMessage 标记的是之前所有消息的 offset, 因此只标记连续已 Ack 的最后一条消息.
+// 放弃(ack(false))的消息会阻止之后的消息被标记, 重启后从这条消息开始重新消费
+type claimAcks struct {
+	mark     func(msg *sarama.ConsumerMessage)
+	inflight sync.WaitGroup
+
+	mu      sync.Mutex
+	pending []*claimPending
+}
+
+type claimPending struct {
+	msg    *sarama.ConsumerMessage
+	acked  bool
+	commit bool
+}
+
+func newClaimAcks(mark func(msg *sarama.ConsumerMessage)) *claimAcks {
+	return &claimAcks{mark: mark}
+}
+
+func (a *claimAcks) newAck(msg *sarama.ConsumerMessage) Ack {
+	p := &claimPending{msg: msg}
+	a.mu.Lock()
+	a.pending = append(a.pending, p)
+	a.mu.Unlock()
+	a.inflight.Add(1)
+
+	var once sync.Once
+	return func(commit bool) {
+		once.Do(func() {
+			a.mu.Lock()
+			p.acked, p.commit = true, commit
+			a.advance()
+			a.mu.Unlock()
+			a.inflight.Done()
+		})
+	}
+}
+
+// advance 标记连续已提交的最后一条消息, 调用方需要持有锁
+func (a *claimAcks) advance() {
+	var last *claimPending
+	for len(a.pending) != 0 && a.pending[0].acked && a.pending[0].commit {
+		last = a.pending[0]
+		a.pending = a.pending[1:]
+	}
+	if last != nil {
+		a.mark(last.msg)
+	}
+}
+
+// wait 等待所有已投递的消息被 Ack
+func (a *claimAcks) wait() {
+	a.inflight.Wait()
+}
+
+// consumeGroup 以消费者组的方式消费 topic, 直到 ctx 被取消. offset 只有在消息被 Ack 后才会提交
+func consumeGroup(ctx context.Context, addrs []string, topic, groupID string, useOldest bool,
+	fn func(msg *sarama.ConsumerMessage, ack Ack) error) error {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V2_0_0_0
+	cfg.Consumer.Offsets.Initial = sarama.OffsetNewest
+	if useOldest {
+		cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+
+	group, err := sarama.NewConsumerGroup(addrs, groupID, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer group.Close()
+
+	handler := groupHandler{fn: fn}
+	for {
+		if err := group.Consume(ctx, []string{topic}, handler); err != nil {
+			return errors.Trace(err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// consumePartitions 从最新的 offset 开始消费 topic 的所有 partition, 直到 ctx 被取消
+func consumePartitions(ctx context.Context, addrs []string, topic string,
+	fn func(msg *sarama.ConsumerMessage) error) error {
+	consumer, err := sarama.NewConsumer(addrs, sarama.NewConfig())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer consumer.Close()
+
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	pcs := make([]sarama.PartitionConsumer, 0, len(partitions))
+	for _, partition := range partitions {
+		pc, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			for _, c := range pcs {
+				c.Close()
+			}
+			return errors.Trace(err)
+		}
+		pcs = append(pcs, pc)
+	}
+
+	var wg sync.WaitGroup
+	for _, pc := range pcs {
+		wg.Add(1)
+		go func(pc sarama.PartitionConsumer) {
+			defer wg.Done()
+			defer pc.Close()
+			for {
+				select {
+				case msg, ok := <-pc.Messages():
+					if !ok {
+						return
+					}
+					if err := fn(msg); err != nil {
+						logger.ErrorDetails(errors.Trace(err))
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(pc)
+	}
+	wg.Wait()
+	return nil
+}
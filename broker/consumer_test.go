@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestClaimAcks(t *testing.T) {
+	type ack struct {
+		offset int64
+		commit bool
+	}
+
+	cases := []struct {
+		name     string
+		messages int
+		acks     []ack
+		want     []int64 // 依次标记的 offset
+	}{
+		{
+			name:     "in order",
+			messages: 3,
+			acks:     []ack{{0, true}, {1, true}, {2, true}},
+			want:     []int64{0, 1, 2},
+		},
+		{
+			name:     "out of order",
+			messages: 3,
+			acks:     []ack{{2, true}, {1, true}, {0, true}},
+			want:     []int64{2},
+		},
+		{
+			name:     "gap not marked",
+			messages: 3,
+			acks:     []ack{{0, true}, {2, true}},
+			want:     []int64{0},
+		},
+		{
+			name:     "rejected blocks later",
+			messages: 3,
+			acks:     []ack{{1, false}, {0, true}, {2, true}},
+			want:     []int64{0},
+		},
+		{
+			name:     "repeated ack ignored",
+			messages: 2,
+			acks:     []ack{{0, false}, {0, true}, {1, true}},
+			want:     nil,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var marked []int64
+			a := newClaimAcks(func(msg *sarama.ConsumerMessage) { marked = append(marked, msg.Offset) })
+			acks := make([]Ack, c.messages)
+			for i := range acks {
+				acks[i] = a.newAck(&sarama.ConsumerMessage{Offset: int64(i)})
+			}
+			for _, ack := range c.acks {
+				acks[ack.offset](ack.commit)
+			}
+			if !reflect.DeepEqual(marked, c.want) {
+				t.Fatalf("marked offsets = %v, want %v", marked, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/logger"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileQueueOffset    = "queue.offset"
+	fileSegmentPrefix  = "queue."
+	fileSegmentSuffix  = ".data"
+	fileSegmentPattern = fileSegmentPrefix + "%010d" + fileSegmentSuffix
+
+	fileRecordHeaderSize    = 4
+	defaultFileSegmentSize  = 64 << 20
+	defaultFilePollInterval = 100 * time.Millisecond
+)
+
+// FileTransport 基于本地文件的持久化队列, 只支持一个消费者.
+// 消息追加写入 dir/queue.{segment}.data(4 字节长度 + 内容), 当前 segment 超过 segmentSize 后写入新的 segment,
+// 已提交的消费位置(segment 和其中的偏移)保存在 dir/queue.offset, 之前的 segment 全部提交后被删除.
+// 打开时会截掉最后一个 segment 末尾不完整的消息(写入时进程崩溃), 这条消息的 Publish 没有成功返回.
+// 放弃(ack(false))的消息会阻止之后的所有消息被提交, 直到重启后从这条消息开始重新消费
+type FileTransport struct {
+	dir         string
+	segmentSize int64
+	notify      chan struct{}
+
+	mu        sync.Mutex
+	segments  []*fileSegment // 按 id 从小到大排列, 最后一个为正在写入的 segment
+	readPos   filePos        // 下一条要投递的消息的位置
+	committed filePos        // 已提交的位置, 之前的消息都已处理完毕
+	pending   []*filePending // 已投递但还未提交的消息, 按投递顺序排列
+}
+
+type fileSegment struct {
+	id   uint64
+	file *os.File
+	size int64
+}
+
+// filePos 队列中的位置, offset 为在 segment 中的偏移
+type filePos struct {
+	segment uint64
+	offset  int64
+}
+
+type filePending struct {
+	end    filePos
+	acked  bool
+	commit bool
+}
+
+func NewFileTransport(dir string) (*FileTransport, error) {
+	return newFileTransport(dir, defaultFileSegmentSize)
+}
+
+func newFileTransport(dir string, segmentSize int64) (*FileTransport, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Trace(err)
+	}
+	t := &FileTransport{
+		dir:         dir,
+		segmentSize: segmentSize,
+		notify:      make(chan struct{}, 1),
+	}
+	if err := t.open(); err != nil {
+		t.Close()
+		return nil, errors.Trace(err)
+	}
+	return t, nil
+}
+
+// open 打开已有的 segment 和消费位置, 没有 segment 时创建第一个
+func (t *FileTransport) open() error {
+	ids, err := t.listSegments()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	committed, ok, err := t.loadOffset()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(ids) == 0 {
+		ids = []uint64{committed.segment}
+	}
+	if !ok {
+		committed = filePos{segment: ids[0]}
+	}
+	found := false
+	for _, id := range ids {
+		found = found || id == committed.segment
+	}
+	if !found {
+		return errors.Errorf("file transport offset segment %d not found in %s", committed.segment, t.dir)
+	}
+
+	for _, id := range ids {
+		if id < committed.segment {
+			// 已经全部提交但删除前进程退出的 segment
+			if err := os.Remove(t.segmentPath(id)); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		file, err := os.OpenFile(t.segmentPath(id), os.O_RDWR|os.O_CREATE, 0640)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return errors.Trace(err)
+		}
+		t.segments = append(t.segments, &fileSegment{id: id, file: file, size: stat.Size()})
+	}
+
+	if committed.offset > t.segments[0].size {
+		return errors.Errorf("file transport offset %d exceeds segment %d size %d",
+			committed.offset, committed.segment, t.segments[0].size)
+	}
+	from := int64(0)
+	if len(t.segments) == 1 {
+		from = committed.offset
+	}
+	if err := t.truncateTornRecord(t.segments[len(t.segments)-1], from); err != nil {
+		return errors.Trace(err)
+	}
+	t.committed, t.readPos = committed, committed
+	return nil
+}
+
+func (t *FileTransport) listSegments() ([]uint64, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, fileSegmentPrefix) || !strings.HasSuffix(name, fileSegmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, fileSegmentPrefix), fileSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (t *FileTransport) segmentPath(id uint64) string {
+	return filepath.Join(t.dir, fmt.Sprintf(fileSegmentPattern, id))
+}
+
+// truncateTornRecord 从 from 开始检查 segment 中的消息, 截掉末尾不完整的消息
+func (t *FileTransport) truncateTornRecord(seg *fileSegment, from int64) error {
+	header := make([]byte, fileRecordHeaderSize)
+	end := from
+	for end+fileRecordHeaderSize <= seg.size {
+		if _, err := seg.file.ReadAt(header, end); err != nil {
+			return errors.Trace(err)
+		}
+		next := end + fileRecordHeaderSize + int64(binary.BigEndian.Uint32(header))
+		if next > seg.size {
+			break
+		}
+		end = next
+	}
+	if end == seg.size {
+		return nil
+	}
+	logger.Warn("file transport truncates torn record in %s at %d, size: %d", seg.file.Name(), end, seg.size)
+	if err := seg.file.Truncate(end); err != nil {
+		return errors.Trace(err)
+	}
+	if err := seg.file.Sync(); err != nil {
+		return errors.Trace(err)
+	}
+	seg.size = end
+	return nil
+}
+
+// loadOffset 读取已提交的位置, 文件不存在时 ok 为 false
+func (t *FileTransport) loadOffset() (pos filePos, ok bool, err error) {
+	b, err := os.ReadFile(filepath.Join(t.dir, fileQueueOffset))
+	if os.IsNotExist(err) {
+		return filePos{}, false, nil
+	}
+	if err != nil {
+		return filePos{}, false, errors.Trace(err)
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d %d", &pos.segment, &pos.offset); err != nil {
+		return filePos{}, false, errors.Annotatef(err, "invalid file transport offset %q", b)
+	}
+	return pos, true, nil
+}
+
+func (t *FileTransport) saveOffset(pos filePos) error {
+	path := filepath.Join(t.dir, fileQueueOffset)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", pos.segment, pos.offset)), 0640); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// segment 返回 id 对应的 segment, 调用方需要持有锁
+func (t *FileTransport) segment(id uint64) *fileSegment {
+	for _, seg := range t.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// Publish 写入并 fsync 后才返回
+func (t *FileTransport) Publish(msg []byte) error {
+	record := make([]byte, fileRecordHeaderSize+len(msg))
+	binary.BigEndian.PutUint32(record, uint32(len(msg)))
+	copy(record[fileRecordHeaderSize:], msg)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.segments) == 0 {
+		return errTransportClosed
+	}
+	last := t.segments[len(t.segments)-1]
+	if last.size >= t.segmentSize {
+		file, err := os.OpenFile(t.segmentPath(last.id+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		last = &fileSegment{id: last.id + 1, file: file}
+		t.segments = append(t.segments, last)
+	}
+	// 写入失败时不更新 size, 下一条消息会覆盖写入了一部分的数据
+	if _, err := last.file.WriteAt(record, last.size); err != nil {
+		return errors.Trace(err)
+	}
+	if err := last.file.Sync(); err != nil {
+		return errors.Trace(err)
+	}
+	last.size += int64(len(record))
+
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next 读取下一条消息, 没有新消息时返回 nil
+func (t *FileTransport) next() ([]byte, *filePending, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.segments) == 0 {
+		return nil, nil, errTransportClosed
+	}
+
+	seg := t.segment(t.readPos.segment)
+	if seg == nil {
+		return nil, nil, errors.Errorf("file transport segment %d not found", t.readPos.segment)
+	}
+	if t.readPos.offset >= seg.size {
+		if seg == t.segments[len(t.segments)-1] {
+			return nil, nil, nil
+		}
+		// 当前 segment 已经读完, 之后不会再写入
+		t.readPos = filePos{segment: seg.id + 1}
+		if seg = t.segment(t.readPos.segment); seg == nil || seg.size == 0 {
+			return nil, nil, nil
+		}
+	}
+
+	header := make([]byte, fileRecordHeaderSize)
+	if _, err := seg.file.ReadAt(header, t.readPos.offset); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := seg.file.ReadAt(msg, t.readPos.offset+fileRecordHeaderSize); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	end := filePos{segment: seg.id, offset: t.readPos.offset + fileRecordHeaderSize + int64(len(msg))}
+	p := &filePending{end: end}
+	t.pending = append(t.pending, p)
+	t.readPos = end
+	return msg, p, nil
+}
+
+func (t *FileTransport) Consume(ctx context.Context, fn func(msg []byte, ack Ack) error) error {
+	ticker := time.NewTicker(defaultFilePollInterval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		msg, p, err := t.next()
+		if err == errTransportClosed {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if p == nil {
+			select {
+			case <-t.notify:
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if err := fn(msg, t.newAck(p)); err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+		}
+	}
+	return nil
+}
+
+func (t *FileTransport) newAck(p *filePending) Ack {
+	var once sync.Once
+	return func(commit bool) {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			p.acked, p.commit = true, commit
+			if err := t.advance(); err != nil {
+				logger.ErrorDetails(errors.Trace(err))
+			}
+		})
+	}
+}
+
+// advance 将提交位置推进到连续已提交的最后一条消息, 并删除已经全部提交的 segment, 调用方需要持有锁.
+// 放弃(ack(false))的消息会阻止之后的消息被提交, 重启后从这条消息开始重新消费
+func (t *FileTransport) advance() error {
+	committed := t.committed
+	for len(t.pending) != 0 && t.pending[0].acked && t.pending[0].commit {
+		committed = t.pending[0].end
+		t.pending = t.pending[1:]
+	}
+	if committed == t.committed || len(t.segments) == 0 {
+		return nil
+	}
+	// 已经读完的 segment 末尾被提交时, 提交位置移到下一个 segment 的开头, 以便删除它
+	if seg := t.segment(committed.segment); seg != t.segments[len(t.segments)-1] && committed.offset >= seg.size {
+		committed = filePos{segment: committed.segment + 1}
+	}
+	// 先保存提交位置再删除 segment, 删除前进程退出时在打开时删除
+	if err := t.saveOffset(committed); err != nil {
+		return errors.Trace(err)
+	}
+	t.committed = committed
+	if t.readPos.segment < t.committed.segment {
+		t.readPos = t.committed
+	}
+
+	for len(t.segments) > 1 && t.segments[0].id < t.committed.segment {
+		seg := t.segments[0]
+		t.segments = t.segments[1:]
+		if err := seg.file.Close(); err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+		}
+		if err := os.Remove(seg.file.Name()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (t *FileTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var firstErr error
+	for _, seg := range t.segments {
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	t.segments = nil
+	return firstErr
+}
@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/obgnail/audit-log/config"
+	"github.com/obgnail/audit-log/logger"
+)
+
+func initTestLogger(t *testing.T) {
+	t.Helper()
+	if logger.CommonLogger != nil {
+		return
+	}
+	l, err := logger.NewCommonLogger(&config.LogConfig{LogFile: filepath.Join(t.TempDir(), "test.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.CommonLogger = l
+}
+
+func TestFileTransportRecovery(t *testing.T) {
+	initTestLogger(t)
+
+	cases := []struct {
+		name         string
+		segmentSize  int64
+		publish      []string
+		acks         []bool // 依次消费并 ack 的消息, 之后的消息不消费
+		torn         bool   // 关闭后在最后一个 segment 末尾写入不完整的消息
+		wantSegments int    // 关闭前 segment 文件的数量
+		wantReplay   []string
+	}{
+		{
+			name:         "resume after committed",
+			segmentSize:  defaultFileSegmentSize,
+			publish:      []string{"a", "b", "c"},
+			acks:         []bool{true, true},
+			wantSegments: 1,
+			wantReplay:   []string{"c"},
+		},
+		{
+			name:         "torn record truncated",
+			segmentSize:  defaultFileSegmentSize,
+			publish:      []string{"a", "b"},
+			acks:         []bool{true},
+			torn:         true,
+			wantSegments: 1,
+			wantReplay:   []string{"b"},
+		},
+		{
+			name:         "rejected message blocks later commits",
+			segmentSize:  defaultFileSegmentSize,
+			publish:      []string{"a", "b", "c"},
+			acks:         []bool{false, true, true},
+			wantSegments: 1,
+			wantReplay:   []string{"a", "b", "c"},
+		},
+		{
+			name:         "committed segments removed",
+			segmentSize:  10,
+			publish:      []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd"},
+			acks:         []bool{true, true, true},
+			wantSegments: 1,
+			wantReplay:   []string{"dddddd"},
+		},
+		{
+			name:         "uncommitted segments kept",
+			segmentSize:  10,
+			publish:      []string{"aaaaaa", "bbbbbb", "cccccc"},
+			acks:         []bool{true},
+			torn:         true,
+			wantSegments: 2,
+			wantReplay:   []string{"bbbbbb", "cccccc"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tr, err := newFileTransport(dir, c.segmentSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range c.publish {
+				if err := tr.Publish([]byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, commit := range c.acks {
+				msg, p, err := tr.next()
+				if err != nil || p == nil {
+					t.Fatalf("next %d: %v, %v", i, p, err)
+				}
+				if string(msg) != c.publish[i] {
+					t.Fatalf("next %d: got %q, want %q", i, msg, c.publish[i])
+				}
+				tr.newAck(p)(commit)
+			}
+			segments, _ := filepath.Glob(filepath.Join(dir, "queue.*.data"))
+			if len(segments) != c.wantSegments {
+				t.Errorf("got %d segments, want %d", len(segments), c.wantSegments)
+			}
+			if err := tr.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if c.torn {
+				last := segments[len(segments)-1]
+				f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0640)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// 长度为 100 的消息只写入了 3 个字节
+				if _, err := f.Write([]byte{0, 0, 0, 100, 'x', 'y', 'z'}); err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+
+			tr, err = newFileTransport(dir, c.segmentSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.Close()
+			// 截掉不完整的消息后可以继续写入
+			if err := tr.Publish([]byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			var replay []string
+			for {
+				msg, p, err := tr.next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p == nil {
+					break
+				}
+				replay = append(replay, string(msg))
+			}
+			want := append(append([]string{}, c.wantReplay...), "new")
+			if !reflect.DeepEqual(replay, want) {
+				t.Errorf("replay got %q, want %q", replay, want)
+			}
+		})
+	}
+}
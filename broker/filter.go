@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const maskedValue = "******"
+
+// ColumnRule 一组表的字段规则. 字段名支持 * 和 ? 通配符
+type ColumnRule struct {
+	Table   string   // 表的匹配规则, 与 BinlogBrokerConfig.Tables 的格式相同
+	Include []string // 只保留这些字段, 为空表示保留所有字段. 主键字段总是保留
+	Exclude []string // 去掉这些字段, 主键字段总是保留
+	Mask    []string // 将值替换为 ******, 无法再判断值是否变化
+	Hash    []string // 将值替换为 HMAC-SHA256(hashKey, value), 可以判断值是否变化
+}
+
+// tablePattern 表的匹配规则, 格式为 db.table, db 和 table 支持 * 和 ? 通配符,
+// 以 / 开头和结尾时为匹配 db.table 的正则表达式, 例如 /^shop_\d+\.order_.*$/
+type tablePattern struct {
+	raw   string
+	re    *regexp.Regexp
+	db    string
+	table string
+}
+
+func parseTablePattern(s string) (*tablePattern, error) {
+	p := &tablePattern{raw: s}
+	if len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid table pattern %q: %s", s, err)
+		}
+		p.re = re
+		return p, nil
+	}
+
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid table pattern %q, must be db.table or /regexp/", s)
+	}
+	for _, part := range parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, fmt.Errorf("invalid table pattern %q: %s", s, err)
+		}
+	}
+	p.db, p.table = parts[0], parts[1]
+	return p, nil
+}
+
+func parseTablePatterns(list []string) ([]*tablePattern, error) {
+	patterns := make([]*tablePattern, 0, len(list))
+	for _, s := range list {
+		p, err := parseTablePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func (p *tablePattern) match(db, table string) bool {
+	if p.re != nil {
+		return p.re.MatchString(db + "." + table)
+	}
+	dbMatched, _ := path.Match(p.db, db)
+	tableMatched, _ := path.Match(p.table, table)
+	return dbMatched && tableMatched
+}
+
+func matchAnyTable(patterns []*tablePattern, db, table string) bool {
+	for _, p := range patterns {
+		if p.match(db, table) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyColumn(patterns []string, column string) bool {
+	for _, p := range patterns {
+		if matched, _ := path.Match(p, column); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type columnRule struct {
+	ColumnRule
+	table *tablePattern
+}
+
+// tableRule 一张表最终生效的规则
+type tableRule struct {
+	handled bool
+	columns *columnRule // 第一条匹配的字段规则, 没有时为 nil
+}
+
+// tableFilter 决定哪些表的 binlog 需要处理, 以及处理前对字段的过滤和脱敏.
+// 只在 river 的 handler 中按顺序调用, 不是并发安全的
+type tableFilter struct {
+	include     []*tablePattern
+	exclude     []*tablePattern
+	columnRules []*columnRule
+	hashKey     []byte
+	cache       map[string]*tableRule // map[db.table]rule
+}
+
+func newTableFilter(include, exclude []string, columnRules []ColumnRule, hashKey string) (*tableFilter, error) {
+	f := &tableFilter{hashKey: []byte(hashKey), cache: make(map[string]*tableRule)}
+
+	var err error
+	if f.include, err = parseTablePatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = parseTablePatterns(exclude); err != nil {
+		return nil, err
+	}
+	for _, rule := range columnRules {
+		for _, columns := range [][]string{rule.Include, rule.Exclude, rule.Mask, rule.Hash} {
+			for _, column := range columns {
+				if _, err := path.Match(column, ""); err != nil {
+					return nil, fmt.Errorf("invalid column pattern %q: %s", column, err)
+				}
+			}
+		}
+		// 没有密钥时 hash 的结果可以通过枚举原始值还原
+		if len(rule.Hash) != 0 && hashKey == "" {
+			return nil, fmt.Errorf("column rule of %q uses hash but hash key is empty", rule.Table)
+		}
+		table, err := parseTablePattern(rule.Table)
+		if err != nil {
+			return nil, err
+		}
+		f.columnRules = append(f.columnRules, &columnRule{ColumnRule: rule, table: table})
+	}
+	return f, nil
+}
+
+func (f *tableFilter) rule(db, table string) *tableRule {
+	key := db + "." + table
+	if rule, ok := f.cache[key]; ok {
+		return rule
+	}
+
+	rule := &tableRule{
+		handled: matchAnyTable(f.include, db, table) && !matchAnyTable(f.exclude, db, table),
+	}
+	for _, r := range f.columnRules {
+		if r.table.match(db, table) {
+			rule.columns = r
+			break
+		}
+	}
+	f.cache[key] = rule
+	return rule
+}
+
+// handled 判断表的 binlog 是否需要处理
+func (f *tableFilter) handled(db, table string) bool {
+	return f.rule(db, table).handled
+}
+
+// apply 返回按照字段规则过滤和脱敏后的数据, 不修改 data
+func (f *tableFilter) apply(db, table string, data map[string]interface{}, primary []string) map[string]interface{} {
+	rule := f.rule(db, table).columns
+	if rule == nil || data == nil {
+		return data
+	}
+
+	result := make(map[string]interface{}, len(data))
+	for column, value := range data {
+		if !isPrimary(primary, column) {
+			if len(rule.Include) != 0 && !matchAnyColumn(rule.Include, column) {
+				continue
+			}
+			if matchAnyColumn(rule.Exclude, column) {
+				continue
+			}
+		}
+		switch {
+		case value == nil:
+		case matchAnyColumn(rule.Hash, column):
+			value = f.hash(value)
+		case matchAnyColumn(rule.Mask, column):
+			value = maskedValue
+		}
+		result[column] = value
+	}
+	return result
+}
+
+func (f *tableFilter) hash(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+	mac := hmac.New(sha256.New, f.hashKey)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isPrimary(primary []string, column string) bool {
+	for _, p := range primary {
+		if p == column {
+			return true
+		}
+	}
+	return false
+}
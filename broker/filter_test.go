@@ -0,0 +1,185 @@
+package broker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableFilterHandled(t *testing.T) {
+	cases := []struct {
+		name    string
+		include []string
+		exclude []string
+		table   string // db.table
+		want    bool
+	}{
+		{name: "exact", include: []string{"shop.order"}, table: "shop.order", want: true},
+		{name: "exact other table", include: []string{"shop.order"}, table: "shop.user", want: false},
+		{name: "table glob", include: []string{"shop.*"}, table: "shop.user", want: true},
+		{name: "db glob", include: []string{"shop_?.order"}, table: "shop_1.order", want: true},
+		{name: "db glob mismatch", include: []string{"shop_?.order"}, table: "shop_10.order", want: false},
+		{name: "regexp", include: []string{`/^shop_\d+\.order_.*$/`}, table: "shop_10.order_2022", want: true},
+		{name: "regexp mismatch", include: []string{`/^shop_\d+\.order_.*$/`}, table: "shop_x.order_2022", want: false},
+		{name: "no include", table: "shop.order", want: false},
+		{name: "exclude over include", include: []string{"shop.*"}, exclude: []string{"shop.order"}, table: "shop.order", want: false},
+		{name: "exclude other table", include: []string{"shop.*"}, exclude: []string{"shop.order"}, table: "shop.user", want: true},
+		{name: "exclude glob over exact include", include: []string{"shop.order_log"}, exclude: []string{"shop.*_log"}, table: "shop.order_log", want: false},
+		{name: "exclude regexp over glob include", include: []string{"*.*"}, exclude: []string{`/^mysql\./`}, table: "mysql.user", want: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := newTableFilter(c.include, c.exclude, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, table := splitTable(t, c.table)
+			if got := f.handled(db, table); got != c.want {
+				t.Fatalf("handled(%s) = %v, want %v", c.table, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTableFilterApply(t *testing.T) {
+	hashed := func(key string, value interface{}) string {
+		f := &tableFilter{hashKey: []byte(key)}
+		return f.hash(value)
+	}
+	data := map[string]interface{}{
+		"id":       int64(1),
+		"name":     "alice",
+		"email":    "alice@example.com",
+		"password": "secret",
+		"note":     nil,
+	}
+
+	cases := []struct {
+		name  string
+		rules []ColumnRule
+		table string
+		want  map[string]interface{}
+	}{
+		{
+			name:  "no rule",
+			table: "shop.user",
+			want:  data,
+		},
+		{
+			name:  "rule of other table",
+			rules: []ColumnRule{{Table: "shop.order", Exclude: []string{"*"}}},
+			table: "shop.user",
+			want:  data,
+		},
+		{
+			name:  "include keeps primary key",
+			rules: []ColumnRule{{Table: "shop.user", Include: []string{"name"}}},
+			table: "shop.user",
+			want:  map[string]interface{}{"id": int64(1), "name": "alice"},
+		},
+		{
+			name:  "exclude keeps primary key",
+			rules: []ColumnRule{{Table: "shop.*", Exclude: []string{"*"}}},
+			table: "shop.user",
+			want:  map[string]interface{}{"id": int64(1)},
+		},
+		{
+			name:  "exclude over include",
+			rules: []ColumnRule{{Table: "shop.user", Include: []string{"name", "email"}, Exclude: []string{"email"}}},
+			table: "shop.user",
+			want:  map[string]interface{}{"id": int64(1), "name": "alice"},
+		},
+		{
+			name:  "mask and hash",
+			rules: []ColumnRule{{Table: "shop.user", Mask: []string{"pass*", "note"}, Hash: []string{"email"}}},
+			table: "shop.user",
+			want: map[string]interface{}{
+				"id":       int64(1),
+				"name":     "alice",
+				"email":    hashed("key", "alice@example.com"),
+				"password": maskedValue,
+				"note":     nil,
+			},
+		},
+		{
+			name:  "hash over mask",
+			rules: []ColumnRule{{Table: "shop.user", Include: []string{"email"}, Mask: []string{"email"}, Hash: []string{"email"}}},
+			table: "shop.user",
+			want:  map[string]interface{}{"id": int64(1), "email": hashed("key", "alice@example.com")},
+		},
+		{
+			name: "first matched rule",
+			rules: []ColumnRule{
+				{Table: "/^shop\\.user$/", Include: []string{"name"}},
+				{Table: "shop.*", Exclude: []string{"*"}},
+			},
+			table: "shop.user",
+			want:  map[string]interface{}{"id": int64(1), "name": "alice"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := newTableFilter([]string{"*.*"}, nil, c.rules, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, table := splitTable(t, c.table)
+			got := f.apply(db, table, data, []string{"id"})
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("apply(%s) = %v, want %v", c.table, got, c.want)
+			}
+		})
+	}
+}
+
+func TestTableFilterHash(t *testing.T) {
+	f, err := newTableFilter(nil, nil, nil, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.hash("alice") != f.hash([]byte("alice")) {
+		t.Fatal("hash of string and []byte with the same content differs")
+	}
+	if f.hash("alice") == f.hash("bob") {
+		t.Fatal("hash of different values is the same")
+	}
+	other, err := newTableFilter(nil, nil, nil, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.hash("alice") == other.hash("alice") {
+		t.Fatal("hash with different keys is the same")
+	}
+}
+
+func TestNewTableFilterInvalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		include []string
+		rules   []ColumnRule
+		hashKey string
+	}{
+		{name: "table without db", include: []string{"order"}},
+		{name: "empty table", include: []string{"shop."}},
+		{name: "invalid regexp", include: []string{"/shop[/"}},
+		{name: "invalid glob", include: []string{"shop.[order"}},
+		{name: "invalid column pattern", rules: []ColumnRule{{Table: "shop.user", Mask: []string{"[name"}}}},
+		{name: "hash without key", rules: []ColumnRule{{Table: "shop.user", Hash: []string{"email"}}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := newTableFilter(c.include, nil, c.rules, c.hashKey); err == nil {
+				t.Fatal("newTableFilter succeeded, want error")
+			}
+		})
+	}
+}
+
+func splitTable(t *testing.T, s string) (string, string) {
+	t.Helper()
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		t.Fatalf("invalid table %q", s)
+	}
+	return parts[0], parts[1]
+}
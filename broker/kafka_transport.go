@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+	"github.com/obgnail/mysql-river/handler/kafka"
+)
+
+// KafkaTransport 基于 kafka 的 Transport.
+// groupID 不为空时以消费者组的方式消费并提交 offset, 否则每次启动都从最新的 offset 开始消费
+type KafkaTransport struct {
+	addrs     []string
+	topic     string
+	groupID   string
+	useOldest bool
+	producer  sarama.SyncProducer
+}
+
+func NewKafkaTransport(addrs []string, topic, groupID string, useOldest bool) (*KafkaTransport, error) {
+	producer, err := kafka.NewProducer(addrs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	t := &KafkaTransport{
+		addrs:     addrs,
+		topic:     topic,
+		groupID:   groupID,
+		useOldest: useOldest,
+		producer:  producer,
+	}
+	return t, nil
+}
+
+func (t *KafkaTransport) Publish(msg []byte) error {
+	if _, _, err := kafka.SendMessage(t.producer, t.topic, msg); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (t *KafkaTransport) Consume(ctx context.Context, fn func(msg []byte, ack Ack) error) error {
+	if t.groupID != "" {
+		consumer := func(msg *sarama.ConsumerMessage, ack Ack) error {
+			return fn(msg.Value, ack)
+		}
+		if err := consumeGroup(ctx, t.addrs, t.topic, t.groupID, t.useOldest, consumer); err != nil {
+			return errors.Trace(err)
+		}
+		return nil
+	}
+
+	consumer := func(msg *sarama.ConsumerMessage) error {
+		return fn(msg.Value, func(bool) {})
+	}
+	if err := consumePartitions(ctx, t.addrs, t.topic, consumer); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (t *KafkaTransport) Close() error {
+	if err := t.producer.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
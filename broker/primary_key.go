@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"database/sql"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/logger"
+	"sync"
+)
+
+// PrimaryKeyResolver 查询表的主键字段, 按照在主键中的顺序排列, 没有主键时返回空
+type PrimaryKeyResolver interface {
+	ResolvePrimaryKey(db, table string) ([]string, error)
+}
+
+// MySQLPrimaryKeyResolver 从 information_schema 中查询表的主键字段
+type MySQLPrimaryKeyResolver struct {
+	db *sql.DB
+}
+
+func NewMySQLPrimaryKeyResolver(db *sql.DB) *MySQLPrimaryKeyResolver {
+	return &MySQLPrimaryKeyResolver{db: db}
+}
+
+func (r *MySQLPrimaryKeyResolver) ResolvePrimaryKey(db, table string) ([]string, error) {
+	query := "SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE " +
+		"WHERE TABLE_SCHEMA=? AND TABLE_NAME=? AND CONSTRAINT_NAME='PRIMARY' ORDER BY ORDINAL_POSITION;"
+	rows, err := r.db.Query(query, db, table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, errors.Trace(err)
+		}
+		columns = append(columns, column)
+	}
+	return columns, errors.Trace(rows.Err())
+}
+
+// primaryKeys 表的主键字段: 配置中的主键优先, 没有配置的表通过 resolver 从表结构中查询并缓存.
+// 缓存在进程内一直有效, 修改表的主键后需要重启
+type primaryKeys struct {
+	configured map[string][]string // map[db.table][]column
+	resolver   PrimaryKeyResolver
+
+	mu       sync.Mutex
+	resolved map[string][]string // map[db.table][]column
+}
+
+func newPrimaryKeys(configured map[string][]string) *primaryKeys {
+	return &primaryKeys{configured: configured, resolved: make(map[string][]string)}
+}
+
+func (p *primaryKeys) setResolver(resolver PrimaryKeyResolver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resolver = resolver
+}
+
+// get 查询失败时返回空且不缓存, 下一个 event 会重新查询
+func (p *primaryKeys) get(db, table string) []string {
+	name := db + "." + table
+	if columns, ok := p.configured[name]; ok {
+		return columns
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if columns, ok := p.resolved[name]; ok {
+		return columns
+	}
+	if p.resolver == nil {
+		return nil
+	}
+	columns, err := p.resolver.ResolvePrimaryKey(db, table)
+	if err != nil {
+		logger.ErrorDetails(errors.Annotatef(err, "resolve primary key of %s", name))
+		return nil
+	}
+	p.resolved[name] = columns
+	return columns
+}
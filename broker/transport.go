@@ -0,0 +1,22 @@
+package broker
+
+import (
+	"context"
+)
+
+const (
+	TransportKafka   = "kafka"
+	TransportChannel = "channel"
+	TransportFile    = "file"
+)
+
+// Transport 一个 topic 的消息传输通道, broker 通过它发送和消费消息
+type Transport interface {
+	// Publish 发送一条消息, 返回 nil 表示消息已经被传输通道接收
+	Publish(msg []byte) error
+	// Consume 依次将消息交给 fn, 直到 ctx 被取消. fn 处理完消息后需要调用 ack,
+	// 只有被 ack(true) 的消息才会被提交, 未提交的消息在重启后会被重新消费
+	Consume(ctx context.Context, fn func(msg []byte, ack Ack) error) error
+	// Close 释放传输通道占用的资源
+	Close() error
+}
@@ -1,52 +1,54 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
-	"github.com/Shopify/sarama"
 	"github.com/juju/errors"
 	"github.com/obgnail/audit-log/types"
-	"github.com/obgnail/mysql-river/handler/kafka"
 )
 
-type TxKafkaBroker struct {
-	txInfoTopic string
-	addrs       []string
-	producer    sarama.SyncProducer
+// TxBroker 通过 transport 发送和消费 tx_info
+type TxBroker struct {
+	transport Transport
 }
 
-func NewTxKafkaBroker(addrs []string, txInfoTopic string) (*TxKafkaBroker, error) {
-	producer, err := kafka.NewProducer(addrs)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	h := &TxKafkaBroker{producer: producer, txInfoTopic: txInfoTopic, addrs: addrs}
-	return h, nil
+func NewTxBroker(transport Transport) *TxBroker {
+	return &TxBroker{transport: transport}
 }
 
-func (k *TxKafkaBroker) PushTx(txInfo *types.TxInfo) error {
+func (k *TxBroker) PushTx(txInfo *types.TxInfo) error {
 	result, err := txInfo.Marshal()
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if _, _, err = kafka.SendMessage(k.producer, k.txInfoTopic, result); err != nil {
+	if err = k.transport.Publish(result); err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-func (k *TxKafkaBroker) Consume(fn func(info *types.TxInfo) error) error {
-	f := func(msg *sarama.ConsumerMessage) error {
+// Consume 消费 tx_info, 直到 ctx 被取消. fn 需要在 tx_info 处理完毕(审计日志交给 handler, 或者状态写入 store)
+// 之后调用 ack, 只有被 ack 的消息才会提交. fn 返回错误时不提交该消息, 重启后重新消费
+func (k *TxBroker) Consume(ctx context.Context, fn func(info *types.TxInfo, ack Ack) error) error {
+	f := func(msg []byte, ack Ack) error {
 		info := types.TxInfo{}
-		if err := json.Unmarshal(msg.Value, &info); err != nil {
+		if err := json.Unmarshal(msg, &info); err != nil {
+			// 无法解析的消息重新消费也无法处理, 直接提交
+			ack(true)
 			return errors.Trace(err)
 		}
-		if err := fn(&info); err != nil {
+		if err := fn(&info, ack); err != nil {
+			ack(false)
 			return errors.Trace(err)
 		}
 		return nil
 	}
-	if err := kafka.Consume(k.addrs, k.txInfoTopic, kafka.NewestOffsetGetter, f); err != nil {
+	if err := k.transport.Consume(ctx, f); err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
+
+func (k *TxBroker) Close() error {
+	return errors.Trace(k.transport.Close())
+}
@@ -11,8 +11,8 @@ import (
 
 var CH clickhouse.Conn
 
-func InitClickHouse() (err error) {
-	click := config.ClickHouse
+// New 根据配置创建一个新的 clickhouse 连接, 并根据 click.Migration 执行或检查表结构
+func New(click *config.ClickHouseConfig) (clickhouse.Conn, error) {
 	conn, err := clickhouse.Open(&clickhouse.Options{
 		Addr: click.Addrs,
 		Auth: clickhouse.Auth{
@@ -33,7 +33,7 @@ func InitClickHouse() (err error) {
 		},
 	})
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	//ChContext = clickhouse.Context(context.Background(), clickhouse.WithSettings(clickhouse.Settings{
 	//	"max_block_size": 10,
@@ -51,9 +51,21 @@ func InitClickHouse() (err error) {
 		time.Sleep(5 * time.Second)
 	}
 	if err != nil {
-		log.Fatalln(err)
+		conn.Close()
+		return nil, errors.Trace(err)
 	}
 
-	CH = conn
+	if err = runMigration(conn, click.Migration); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func InitClickHouse() (err error) {
+	CH, err = New(config.ClickHouse)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	return nil
 }
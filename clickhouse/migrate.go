@@ -0,0 +1,338 @@
+package clickhouse
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/juju/errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MigrationApply  = "apply"  // 启动时执行未执行过的 migration
+	MigrationVerify = "verify" // 启动时检查, 存在未执行的 migration 则报错
+	MigrationSkip   = "skip"   // 不做任何处理
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// Migration 一个版本的表结构变更, 对应 migrations 目录下的一个 {version}_{name}.sql 文件
+type Migration struct {
+	Version    uint32
+	Name       string
+	Statements []string
+	Func       func(conn clickhouse.Conn) error // 在 Statements 之后执行, 用于无法使用幂等的 sql 表达的变更
+	Offline    bool                             // 需要停止所有的 syncer 后通过 MigrateOffline 执行, 见 Migrate
+}
+
+// migrationFuncs 各个版本在 sql 之后执行的变更
+var migrationFuncs = map[uint32]func(conn clickhouse.Conn) error{
+	7: migrateTxInfoEngine,
+}
+
+// offlineMigrations 复制表数据的 migration, 复制过程中写入的数据会丢失
+var offlineMigrations = map[uint32]bool{
+	7: true,
+}
+
+// Migrations 返回所有的 migration, 按照版本号从小到大排列
+func Migrations() ([]Migration, error) {
+	migrations, err := loadMigrations(migrationFS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return migrations, nil
+}
+
+// loadMigrations 读取 fsys 中 migrations 目录下的 migration
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		fileName := entry.Name()
+		parts := strings.SplitN(strings.TrimSuffix(fileName, ".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name: %s", fileName)
+		}
+		version, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version: %s", fileName)
+		}
+		content, err := fs.ReadFile(fsys, path.Join("migrations", fileName))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		migrations = append(migrations, Migration{
+			Version:    uint32(version),
+			Name:       parts[1],
+			Statements: splitStatements(string(content)),
+			Func:       migrationFuncs[uint32(version)],
+			Offline:    offlineMigrations[uint32(version)],
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version: %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements 按照分号拆分 sql, clickhouse 一次只能执行一条语句.
+// 字符串、带引号的标识符和注释中的分号不作为语句的结束, 只有注释的语句不执行
+func splitStatements(content string) []string {
+	var (
+		statements []string
+		current    strings.Builder
+		hasCode    bool // current 中是否有注释以外的内容
+	)
+	flush := func() {
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(current.String()))
+		}
+		current.Reset()
+		hasCode = false
+	}
+
+	for i := 0; i < len(content); {
+		end := i + 1
+		switch c := content[i]; {
+		case strings.HasPrefix(content[i:], "--"):
+			end = skipUntil(content, i+2, "\n")
+		case strings.HasPrefix(content[i:], "/*"):
+			end = skipUntil(content, i+2, "*/")
+		case c == '\'' || c == '"' || c == '`':
+			end = closingQuote(content, i)
+			hasCode = true
+		case c == ';':
+			current.WriteByte(c)
+			flush()
+			i = end
+			continue
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			hasCode = true
+		}
+		current.WriteString(content[i:end])
+		i = end
+	}
+	flush()
+	return statements
+}
+
+// skipUntil 返回 content[start:] 中 sep 结束的位置(包括 sep), 没有 sep 时返回 len(content)
+func skipUntil(content string, start int, sep string) int {
+	if n := strings.Index(content[start:], sep); n >= 0 {
+		return start + n + len(sep)
+	}
+	return len(content)
+}
+
+// closingQuote 返回 content[start] 处的引号对应的结束引号之后的位置, 支持反斜杠转义和两个连续引号的转义
+func closingQuote(content string, start int) int {
+	quote := content[start]
+	for i := start + 1; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(content) && content[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(content)
+}
+
+func ensureMigrationTable(conn clickhouse.Conn) error {
+	sql := "CREATE TABLE IF NOT EXISTS schema_migrations " +
+		"(`version` UInt32, `name` String, `applied_at` DateTime DEFAULT now()) " +
+		"ENGINE = MergeTree() ORDER BY version;"
+	if err := conn.Exec(context.Background(), sql); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func appliedVersions(conn clickhouse.Conn) (map[uint32]struct{}, error) {
+	var rows []struct {
+		Version uint32 `ch:"version"`
+	}
+	if err := conn.Select(context.Background(), &rows, "SELECT version FROM schema_migrations;"); err != nil {
+		return nil, errors.Trace(err)
+	}
+	applied := make(map[uint32]struct{}, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = struct{}{}
+	}
+	return applied, nil
+}
+
+// PendingMigrations 返回尚未执行的 migration
+func PendingMigrations(conn clickhouse.Conn) ([]Migration, error) {
+	if err := ensureMigrationTable(conn); err != nil {
+		return nil, errors.Trace(err)
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	applied, err := appliedVersions(conn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate 按照版本顺序执行尚未执行的 migration, 每个 migration 执行成功后记录到 schema_migrations.
+// migration 中的语句和 Func 都是幂等的, 中途失败后可以重新执行.
+// 遇到 Offline 的 migration 时停止并返回错误, 需要停止所有的 syncer 后执行 MigrateOffline(见 cmd/migrate),
+// 启动时自动执行会和其他实例的写入以及 migration 同时进行. 还没有执行过任何 migration(新部署)时没有数据需要复制, 直接执行
+func Migrate(conn clickhouse.Conn) error {
+	return errors.Trace(migrate(conn, false))
+}
+
+// MigrateOffline 执行所有尚未执行的 migration, 包括 Offline 的 migration.
+// 调用之前需要停止所有的 syncer, 并且同一时间只能有一个 MigrateOffline
+func MigrateOffline(conn clickhouse.Conn) error {
+	return errors.Trace(migrate(conn, true))
+}
+
+func migrate(conn clickhouse.Conn, offline bool) error {
+	pending, err := PendingMigrations(conn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// 0001 还没有执行, 表都是新建的
+	fresh := len(pending) != 0 && pending[0].Version == 1
+	for _, m := range pending {
+		if m.Offline && !offline && !fresh {
+			return fmt.Errorf("migration %d_%s must be applied offline: stop all syncers and run cmd/migrate",
+				m.Version, m.Name)
+		}
+		for _, stmt := range m.Statements {
+			if err := conn.Exec(context.Background(), stmt); err != nil {
+				return errors.Annotatef(err, "migration %d_%s", m.Version, m.Name)
+			}
+		}
+		if m.Func != nil {
+			if err := m.Func(conn); err != nil {
+				return errors.Annotatef(err, "migration %d_%s", m.Version, m.Name)
+			}
+		}
+		sql := "INSERT INTO schema_migrations (version, name) VALUES ($1, $2);"
+		if err := conn.Exec(context.Background(), sql, m.Version, m.Name); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// VerifyMigrations 检查所有的 migration 是否都已经执行
+func VerifyMigrations(conn clickhouse.Conn) error {
+	pending, err := PendingMigrations(conn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(pending) != 0 {
+		return fmt.Errorf("clickhouse schema is outdated, %d pending migrations, first: %d_%s",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+func runMigration(conn clickhouse.Conn, mode string) error {
+	switch mode {
+	case MigrationApply, "":
+		return errors.Trace(Migrate(conn))
+	case MigrationVerify:
+		return errors.Trace(VerifyMigrations(conn))
+	case MigrationSkip:
+		return nil
+	default:
+		return fmt.Errorf("unknown clickhouse migration mode: %s", mode)
+	}
+}
+
+// tableEngine 返回当前数据库中 table 的 engine_full, table 不存在时返回 ""
+func tableEngine(conn clickhouse.Conn, table string) (string, error) {
+	var rows []struct {
+		Engine string `ch:"engine_full"`
+	}
+	sql := "SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = $1;"
+	if err := conn.Select(context.Background(), &rows, sql, table); err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(rows) == 0 {
+		return "", nil
+	}
+	return rows[0].Engine, nil
+}
+
+// migrateTxInfoEngine 将 tx_info 的 engine 改为 ReplacingMergeTree(version), 重复的 tx_info 只保留版本最大的一行.
+// clickhouse 不支持修改 engine, 需要复制到新表之后交换表名; 每一步执行之前检查表结构, 中途失败后可以重新执行.
+// 复制过程中写入 tx_info 的数据会丢失, 因此是 Offline 的 migration, 见 MigrateOffline
+func migrateTxInfoEngine(conn clickhouse.Conn) error {
+	engine, err := tableEngine(conn, "tx_info")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if engine == "" {
+		// 上次在 RENAME 之后失败
+		unversioned, err := tableEngine(conn, "tx_info_unversioned")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if unversioned == "" {
+			return fmt.Errorf("table tx_info not found")
+		}
+		sql := "RENAME TABLE tx_info_unversioned TO tx_info;"
+		if err := conn.Exec(context.Background(), sql); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(migrateTxInfoEngine(conn))
+	}
+
+	var statements []string
+	if !strings.Contains(engine, "ReplacingMergeTree(version)") {
+		statements = append(statements,
+			"DROP TABLE IF EXISTS tx_info_versioned;",
+			"CREATE TABLE tx_info_versioned\n"+
+				"(`gtid` String, `context` String, `time` DateTime64(3, 'Asia/Shanghai'), `status` UInt8, `version` UInt64)\n"+
+				"ENGINE = ReplacingMergeTree(version) PARTITION BY toYYYYMM(time) ORDER BY gtid\n"+
+				"TTL toDateTime(time) + INTERVAL 60 DAY;",
+			"INSERT INTO tx_info_versioned (gtid, context, time, `status`, version)\n"+
+				"SELECT gtid, context, time, `status`, version FROM tx_info FINAL;",
+			"RENAME TABLE tx_info TO tx_info_unversioned, tx_info_versioned TO tx_info;",
+		)
+	}
+	statements = append(statements, "DROP TABLE IF EXISTS tx_info_unversioned;")
+	for _, stmt := range statements {
+		if err := conn.Exec(context.Background(), stmt); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
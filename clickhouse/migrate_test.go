@@ -0,0 +1,147 @@
+package clickhouse
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSplitStatements(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "multi-line statements",
+			content: "CREATE TABLE t\n(\n    `id` UInt32\n) ENGINE = MergeTree() ORDER BY id;\n\nALTER TABLE t ADD COLUMN c String;\n",
+			want: []string{
+				"CREATE TABLE t\n(\n    `id` UInt32\n) ENGINE = MergeTree() ORDER BY id;",
+				"ALTER TABLE t ADD COLUMN c String;",
+			},
+		},
+		{
+			name:    "statements on one line",
+			content: "SELECT 1; SELECT 2;",
+			want:    []string{"SELECT 1;", "SELECT 2;"},
+		},
+		{
+			name:    "last statement without semicolon",
+			content: "SELECT 1;\nSELECT 2\n",
+			want:    []string{"SELECT 1;", "SELECT 2"},
+		},
+		{
+			name:    "semicolon in string",
+			content: "ALTER TABLE t COMMENT COLUMN c 'a;\nb;';\nSELECT 'it''s;', 'x\\';';",
+			want:    []string{"ALTER TABLE t COMMENT COLUMN c 'a;\nb;';", "SELECT 'it''s;', 'x\\';';"},
+		},
+		{
+			name:    "semicolon in quoted identifier",
+			content: "SELECT `a;b`, \"c;d\" FROM t;",
+			want:    []string{"SELECT `a;b`, \"c;d\" FROM t;"},
+		},
+		{
+			name:    "semicolon in comments",
+			content: "-- first;\nSELECT 1 /* inline; */ + 1;\n/* block;\ncomment; */\nSELECT 2; -- trailing;\n",
+			want:    []string{"-- first;\nSELECT 1 /* inline; */ + 1;", "/* block;\ncomment; */\nSELECT 2;"},
+		},
+		{
+			name:    "comment only",
+			content: "-- nothing to do;\n/* still nothing */\n",
+			want:    nil,
+		},
+		{
+			name:    "empty statements",
+			content: ";\n  ;\nSELECT 1;;",
+			want:    []string{"SELECT 1;"},
+		},
+		{
+			name:    "comment marker in string",
+			content: "SELECT '--not a comment;', '/*;*/';",
+			want:    []string{"SELECT '--not a comment;', '/*;*/';"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := splitStatements(c.content); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("splitStatements = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/10_ten.sql":             {Data: []byte("SELECT 10;")},
+		"migrations/0002_two.sql":           {Data: []byte("SELECT 2;\nSELECT 22;")},
+		"migrations/0001_one_with_name.sql": {Data: []byte("SELECT 1;")},
+		"migrations/0007_offline.sql":       {Data: []byte("SELECT 7;")},
+	}
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type summary struct {
+		version    uint32
+		name       string
+		statements []string
+		offline    bool
+		hasFunc    bool
+	}
+	got := make([]summary, 0, len(migrations))
+	for _, m := range migrations {
+		got = append(got, summary{m.Version, m.Name, m.Statements, m.Offline, m.Func != nil})
+	}
+	// 按照版本号排序, 而不是文件名
+	want := []summary{
+		{1, "one_with_name", []string{"SELECT 1;"}, false, false},
+		{2, "two", []string{"SELECT 2;", "SELECT 22;"}, false, false},
+		{7, "offline", []string{"SELECT 7;"}, true, true},
+		{10, "ten", []string{"SELECT 10;"}, false, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("loadMigrations = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadMigrationsInvalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		files []string
+	}{
+		{name: "missing name", files: []string{"migrations/0001.sql"}},
+		{name: "invalid version", files: []string{"migrations/v1_init.sql"}},
+		{name: "duplicate version", files: []string{"migrations/0001_a.sql", "migrations/1_b.sql"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, file := range c.files {
+				fsys[file] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+			}
+			if _, err := loadMigrations(fsys); err == nil {
+				t.Fatalf("loadMigrations(%v) succeeded", c.files)
+			}
+		})
+	}
+}
+
+// TestMigrations 检查 migrations 目录下的 migration: 版本号从 1 开始连续, 每个都有需要执行的语句
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations")
+	}
+	for i, m := range migrations {
+		if m.Version != uint32(i+1) {
+			t.Fatalf("migration %s has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if len(m.Statements) == 0 && m.Func == nil {
+			t.Fatalf("migration %d_%s has nothing to do", m.Version, m.Name)
+		}
+	}
+}
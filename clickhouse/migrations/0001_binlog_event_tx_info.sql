@@ -1,4 +1,4 @@
-CREATE TABLE binlog_event
+CREATE TABLE IF NOT EXISTS binlog_event
 (
     `db`     String,
     `table`  String,
@@ -10,7 +10,7 @@ CREATE TABLE binlog_event
       PARTITION BY toYYYYMMDD(time) ORDER BY gtid
       TTL time + INTERVAL 30 DAY;
 
-CREATE TABLE tx_info
+CREATE TABLE IF NOT EXISTS tx_info
 (
     `gtid`    String,
     `context` String,
@@ -19,4 +19,3 @@ CREATE TABLE tx_info
 ) ENGINE = ReplacingMergeTree()
       PARTITION BY toYYYYMM(time) ORDER BY gtid
       TTL toDateTime(time) + INTERVAL 60 DAY;
-
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS dead_letter
+(
+    `id`              String,
+    `gtid`            String,
+    `audit_log`       String,
+    `error`           String,
+    `attempts`        UInt32,
+    `first_failed_at` DateTime64(3, 'Asia/Shanghai'),
+    `last_failed_at`  DateTime64(3, 'Asia/Shanghai')
+) ENGINE = ReplacingMergeTree(last_failed_at)
+      ORDER BY id;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    `gtid`            String,
+    `seq`             UInt32,
+    `time`            DateTime64(3, 'Asia/Shanghai'),
+    `context`         String,
+    `context_type`    Int64,
+    `context_param_1` String,
+    `context_param_2` String,
+    `db`              String,
+    `table`           String,
+    `action`          Int32,
+    `primary_key`     String,
+    `columns`         String
+) ENGINE = ReplacingMergeTree()
+      PARTITION BY toYYYYMM(time) ORDER BY (gtid, seq);
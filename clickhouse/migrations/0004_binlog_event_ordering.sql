@@ -0,0 +1,4 @@
+ALTER TABLE binlog_event
+    ADD COLUMN IF NOT EXISTS `seq` UInt32 AFTER `time`,
+    ADD COLUMN IF NOT EXISTS `log_file` String AFTER `seq`,
+    ADD COLUMN IF NOT EXISTS `log_pos` UInt32 AFTER `log_file`;
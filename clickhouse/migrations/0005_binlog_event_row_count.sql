@@ -0,0 +1,2 @@
+ALTER TABLE binlog_event
+    ADD COLUMN IF NOT EXISTS `row_count` UInt32 AFTER `log_pos`;
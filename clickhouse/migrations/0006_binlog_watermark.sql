@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS binlog_watermark
+(
+    `id`         UInt8,
+    `gtid_set`   String,
+    `updated_at` DateTime64(3, 'Asia/Shanghai')
+) ENGINE = ReplacingMergeTree(updated_at)
+      ORDER BY id;
@@ -0,0 +1,3 @@
+-- tx_info 的 engine 改为 ReplacingMergeTree(version) 由 migrateTxInfoEngine 完成(需要检查当前的表结构).
+-- 需要复制 tx_info, 停止所有的 syncer 后通过 cmd/migrate 执行, 见 MigrateOffline
+ALTER TABLE tx_info ADD COLUMN IF NOT EXISTS `version` UInt64;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS audit_log_dispatched
+(
+    `id`            String,
+    `gtid`          String,
+    `dispatched_at` DateTime64(3, 'Asia/Shanghai')
+) ENGINE = ReplacingMergeTree(dispatched_at)
+      ORDER BY id
+      TTL toDateTime(dispatched_at) + INTERVAL 60 DAY;
@@ -0,0 +1,7 @@
+ALTER TABLE audit_log ADD INDEX IF NOT EXISTS idx_time time TYPE minmax GRANULARITY 1;
+
+ALTER TABLE audit_log ADD INDEX IF NOT EXISTS idx_db_table (db, table) TYPE bloom_filter GRANULARITY 4;
+
+ALTER TABLE audit_log MATERIALIZE INDEX idx_time;
+
+ALTER TABLE audit_log MATERIALIZE INDEX idx_db_table;
@@ -0,0 +1,39 @@
+// migrate 执行所有尚未执行的 clickhouse migration, 包括启动时不会自动执行的 Offline migration(见 clickhouse.MigrateOffline).
+// 执行之前需要停止所有的 Binlog Syncer 和 TxInfo Syncer
+package main
+
+import (
+	"flag"
+	"github.com/obgnail/audit-log/clickhouse"
+	"github.com/obgnail/audit-log/config"
+	"log"
+)
+
+func main() {
+	configPath := flag.String("config", "./config/config.toml", "config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("load config failed: %s", err)
+	}
+	// 连接时不执行 migration, 由下面的 MigrateOffline 执行
+	cfg.ClickHouse.Migration = clickhouse.MigrationSkip
+	conn, err := clickhouse.New(cfg.ClickHouse)
+	if err != nil {
+		log.Fatalf("connect clickhouse failed: %s", err)
+	}
+	defer conn.Close()
+
+	pending, err := clickhouse.PendingMigrations(conn)
+	if err != nil {
+		log.Fatalf("list pending migrations failed: %s", err)
+	}
+	for _, m := range pending {
+		log.Printf("apply migration %d_%s, offline: %v", m.Version, m.Name, m.Offline)
+	}
+	if err := clickhouse.MigrateOffline(conn); err != nil {
+		log.Fatalf("migrate failed: %s", err)
+	}
+	log.Printf("%d migrations applied", len(pending))
+}
@@ -12,8 +12,14 @@ type MainConfig struct {
 	PositionSaver *PosAutoSaverConfig    `toml:"position_saver"`
 	HealthChecker *HealthCheckerConfig   `toml:"health_checker"`
 	AuditLog      *AuditLogHandlerConfig `toml:"audit_log"`
+	Transport     *TransportConfig       `toml:"transport"`
 	Kafka         *KafkaConfig           `toml:"kafka"`
 	ClickHouse    *ClickHouseConfig      `toml:"clickhouse"`
+	Store         *StoreConfig           `toml:"store"`
+	DeadLetter    *DeadLetterConfig      `toml:"dead_letter"`
+	Unattributed  *UnattributedConfig    `toml:"unattributed"`
+	Outbox        *OutboxConfig          `toml:"outbox"`
+	Join          *JoinConfig            `toml:"join"`
 }
 
 type LogConfig struct {
@@ -44,15 +50,35 @@ type HealthCheckerConfig struct {
 }
 
 type AuditLogHandlerConfig struct {
-	HandleTables []string `toml:"handle_tables"`
+	HandleTables  []string            `toml:"handle_tables"`  // db.table, 支持 * 和 ? 通配符, 以 / 开头和结尾时为正则表达式
+	ExcludeTables []string            `toml:"exclude_tables"` // 格式与 handle_tables 相同, 优先于 handle_tables
+	ColumnRules   []*ColumnRuleConfig `toml:"column_rules"`   // 按顺序匹配, 使用第一条匹配的规则
+	HashKey       string              `toml:"hash_key"`       // column_rules 中 hash 使用的密钥, 使用 hash 时不能为空
+	PrimaryKeys   map[string][]string `toml:"primary_keys"`   // map[db.table][]column, 覆盖从表结构中读取的主键
+}
+
+// ColumnRuleConfig 一组表的字段过滤和脱敏规则, 字段名支持 * 和 ? 通配符, 主键字段不会被过滤
+type ColumnRuleConfig struct {
+	Table   string   `toml:"table"`   // 格式与 handle_tables 相同
+	Include []string `toml:"include"` // 只保留这些字段, 为空表示保留所有字段
+	Exclude []string `toml:"exclude"` // 去掉这些字段
+	Mask    []string `toml:"mask"`    // 值替换为 ******
+	Hash    []string `toml:"hash"`    // 值替换为 HMAC-SHA256(hash_key, value)
+}
+
+// TransportConfig binlog 和 tx_info 的传输方式
+type TransportConfig struct {
+	Type        string `toml:"type"`         // kafka(默认) / channel / file
+	ChannelSize int    `toml:"channel_size"` // type = "channel" 时 channel 的容量
+	Dir         string `toml:"dir"`          // type = "file" 时队列文件的存储目录, 每个 topic 一个子目录
 }
 
 type KafkaConfig struct {
 	Addrs           []string `toml:"addrs"`
 	BinlogTopic     string   `toml:"binlog_topic"`
+	BinlogGroupID   string   `toml:"binlog_group_id"` // 默认为 audit_log_binlog
 	TxInfoTopic     string   `toml:"tx_info_topic"`
-	OffsetStoreDir  string   `toml:"offset_store_dir"`
-	Offset          *int64   `toml:"offsetStore"` // if it has no offset, set nil
+	TxInfoGroupID   string   `toml:"tx_info_group_id"` // 默认为 audit_log_tx_info
 	UseOldestOffset bool     `toml:"use_oldest_offset"`
 }
 
@@ -62,6 +88,48 @@ type ClickHouseConfig struct {
 	Password string   `toml:"password"`
 	DB       string   `toml:"db"`
 	Debug    bool     `toml:"debug"`
+
+	Migration string `toml:"migration"` // apply(默认): 启动时执行表结构变更(需要停止服务的变更除外, 见 cmd/migrate); verify: 只检查; skip: 不处理
+
+	RetryInterval    int `toml:"retry_interval"`     // 写入失败后首次重试的间隔(秒), 之后每次翻倍
+	RetryMaxInterval int `toml:"retry_max_interval"` // 重试间隔的上限(秒)
+}
+
+// StoreConfig binlog_event、tx_info、audit_log 等数据的存储方式
+type StoreConfig struct {
+	Type string `toml:"type"` // clickhouse(默认) / sqlite / memory
+	Path string `toml:"path"` // type = "sqlite" 时数据库文件的路径
+}
+
+// DeadLetterConfig handler 处理审计日志失败时的重试策略以及死信的存储位置
+type DeadLetterConfig struct {
+	MaxAttempts      int    `toml:"max_attempts"`       // 最多处理次数, 0 表示一直重试
+	RetryInterval    int    `toml:"retry_interval"`     // 首次重试的间隔(秒), 之后每次翻倍
+	RetryMaxInterval int    `toml:"retry_max_interval"` // 重试间隔的上限(秒)
+	Sink             string `toml:"sink"`               // file / store(与审计日志使用同一个 store)
+	Dir              string `toml:"dir"`                // sink = "file" 时死信的存储目录
+}
+
+// UnattributedConfig 没有 tx_info 的事务(其他服务、migration、手动执行的 sql)也生成审计日志
+type UnattributedConfig struct {
+	Enable        bool `toml:"enable"`
+	GracePeriod   int  `toml:"grace_period"`   // tx_info 的消费追上 binlog 多久(秒)后仍没有 tx_info 则认为是外部变更, 需要大于 tx_info 的延迟
+	CheckInterval int  `toml:"check_interval"` // 检查的间隔(秒)
+	Lookback      int  `toml:"lookback"`       // 只检查最近多久(秒)的 binlog_event
+}
+
+// OutboxConfig 审计 Context 在事务中写入 outbox 表, 由 binlog syncer 从 binlog 中读取,
+// 不再在事务提交后直接推送 tx_info, kafka 不可用时也不会丢失
+type OutboxConfig struct {
+	Enable bool   `toml:"enable"`
+	Mode   string `toml:"mode"`  // relay(默认): 推送 tx_info; embed: 审计 Context 附加到 binlog event 上, 直接生成审计日志
+	Table  string `toml:"table"` // outbox 表名, 默认为 audit_outbox, 在 schemas 的每个库中创建, 不需要加入 handle_tables
+}
+
+// JoinConfig 在内存中按 GTID 关联 binlog 事务和 tx_info 的窗口, 超出窗口的 tx_info 从 store 中查询
+type JoinConfig struct {
+	Window    int `toml:"window"`     // binlog 事务在窗口中保留的时间(秒), 默认 300
+	MaxEvents int `toml:"max_events"` // 窗口中最多保留的 binlog event 数量, 默认 100000
 }
 
 var (
@@ -86,20 +154,29 @@ func FindConfigPath(configPath string) string {
 	panic("not found config file in path")
 }
 
-func InitConfig(path string) error {
+// Load 读取配置文件, 不修改包级别的全局配置
+func Load(path string) (*MainConfig, error) {
 	path = FindConfigPath(path)
 	var cfg MainConfig
 	f, err := os.Open(path)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	defer f.Close()
 	_, err = toml.NewDecoder(f).Decode(&cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &cfg, nil
+}
+
+func InitConfig(path string) error {
+	cfg, err := Load(path)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	Main = &cfg
+	Main = cfg
 	MySQL = Main.Mysql
 	PositionSaver = Main.PositionSaver
 	HealthChecker = Main.HealthChecker
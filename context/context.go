@@ -1,47 +1,153 @@
 package context
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 )
 
+// Version 当前 Context 序列化格式的版本.
+// 0: 旧的 type.param1.param2 格式; 1: json
+const Version = 1
+
+// TypeUnattributed 没有 tx_info 的事务(其他服务、migration、手动执行的 sql 等外部变更)使用的 Context.Type
+const TypeUnattributed = -1
+
 var (
 	CorruptedDataError = fmt.Errorf("CorruptedDataError")
 	MismatchError      = fmt.Errorf("MismatchError")
+	NotFoundError      = fmt.Errorf("NotFoundError")
+	VersionError       = fmt.Errorf("VersionError")
 )
 
 type Context struct {
-	Type   int    `db:"context_type"`
-	Param1 string `db:"context_param_1"`
-	Param2 string `db:"context_param_2"`
+	Version   int                    `json:"v" db:"-"`
+	Type      int                    `json:"type" db:"context_type"`
+	Param1    string                 `json:"param1,omitempty" db:"context_param_1"`
+	Param2    string                 `json:"param2,omitempty" db:"context_param_2"`
+	Actor     string                 `json:"actor,omitempty" db:"actor"`           // 执行操作的用户
+	Tenant    string                 `json:"tenant,omitempty" db:"tenant"`         // 用户所属的租户
+	ClientIP  string                 `json:"client_ip,omitempty" db:"client_ip"`   // 发起请求的客户端 IP
+	TraceID   string                 `json:"trace_id,omitempty" db:"trace_id"`     // 分布式追踪的 trace ID
+	RequestID string                 `json:"request_id,omitempty" db:"request_id"` // 触发操作的请求
+	Fields    map[string]interface{} `json:"fields,omitempty" db:"-"`              // 业务自定义的字段, 值需要能被 json 序列化
 }
 
 func New(Type int, param1, param2 string) Context {
 	return Context{
-		Type:   Type,
-		Param1: param1,
-		Param2: param2,
+		Version: Version,
+		Type:    Type,
+		Param1:  param1,
+		Param2:  param2,
 	}
 }
 
-// 将 Context 序列化成可读字符串
-func (c Context) String() string {
-	var b strings.Builder
-	b.WriteString(strconv.Itoa(c.Type))
-	b.WriteByte('.')
-	if len(c.Param1) > 0 {
-		b.WriteString(c.Param1)
+// Unattributed 外部变更的 Context. user、host 为执行事务的 MySQL 用户和主机, 无法获取时为空;
+// serverUUID 为执行事务的 MySQL 实例, 来自 GTID
+func Unattributed(user, host, serverUUID string) Context {
+	c := Context{
+		Version:  Version,
+		Type:     TypeUnattributed,
+		Actor:    user,
+		ClientIP: host,
+		Fields:   map[string]interface{}{"source": "external"},
 	}
-	b.WriteByte('.')
-	if len(c.Param2) > 0 {
-		b.WriteString(c.Param2)
+	if serverUUID != "" {
+		c.Fields["server_uuid"] = serverUUID
 	}
-	return b.String()
+	return c
 }
 
-// 根据可读字符串生成 Context
+// With 返回增加了自定义字段的 Context, 不修改 c
+func (c Context) With(key string, value interface{}) Context {
+	fields := make(map[string]interface{}, len(c.Fields)+1)
+	for k, v := range c.Fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	c.Fields = fields
+	return c
+}
+
+// Get 返回自定义字段. 经过序列化后数字类型的值为 json.Number, 可以使用 GetInt 读取
+func (c Context) Get(key string) (interface{}, bool) {
+	v, ok := c.Fields[key]
+	return v, ok
+}
+
+func (c Context) GetString(key string) (string, bool) {
+	v, ok := c.Fields[key].(string)
+	return v, ok
+}
+
+func (c Context) GetBool(key string) (bool, bool) {
+	v, ok := c.Fields[key].(bool)
+	return v, ok
+}
+
+func (c Context) GetInt(key string) (int64, bool) {
+	switch v := c.Fields[key].(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), v == float64(int64(v))
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// Marshal 将 Context 序列化成当前版本的 json 字符串
+func (c Context) Marshal() (string, error) {
+	c.Version = Version
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// 将 Context 序列化成 json 字符串, Fields 无法序列化时忽略 Fields
+func (c Context) String() string {
+	s, err := c.Marshal()
+	if err != nil {
+		c.Fields = nil
+		s, _ = c.Marshal()
+	}
+	return s
+}
+
+// 根据字符串生成 Context, 兼容旧的 type.param1.param2 格式
 func FromString(s string) (Context, error) {
+	if strings.HasPrefix(s, "{") {
+		return fromJSON(s)
+	}
+	return fromLegacyString(s)
+}
+
+func fromJSON(s string) (Context, error) {
+	c := Context{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&c); err != nil {
+		return Context{}, CorruptedDataError
+	}
+	if c.Version < 1 || c.Version > Version {
+		return c, VersionError
+	}
+	return c, nil
+}
+
+// fromLegacyString 解析旧的 type.param1.param2 格式
+func fromLegacyString(s string) (Context, error) {
 	c := Context{}
 	parts := strings.Split(s, ".")
 	if len(parts) != 3 {
@@ -72,8 +178,9 @@ func BuildContext(ctxType int, params ...string) Context {
 		param2 = params[1]
 	}
 	return Context{
-		Type:   ctxType,
-		Param1: param1,
-		Param2: param2,
+		Version: Version,
+		Type:    ctxType,
+		Param1:  param1,
+		Param2:  param2,
 	}
 }
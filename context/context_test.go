@@ -0,0 +1,90 @@
+package context
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFromString(t *testing.T) {
+	cases := []struct {
+		name    string
+		s       string
+		want    Context
+		wantErr error
+	}{
+		{
+			name: "legacy",
+			s:    "1.project.task",
+			want: Context{Type: 1, Param1: "project", Param2: "task"},
+		},
+		{
+			name: "legacy empty params",
+			s:    "2..",
+			want: Context{Type: 2},
+		},
+		{
+			name: "legacy param1 only",
+			s:    "3.project.",
+			want: Context{Type: 3, Param1: "project"},
+		},
+		{
+			name:    "legacy too many parts",
+			s:       "1.project.task.alice.req-1",
+			wantErr: CorruptedDataError,
+		},
+		{
+			name:    "legacy too few parts",
+			s:       "1.project",
+			wantErr: CorruptedDataError,
+		},
+		{
+			name:    "legacy invalid type",
+			s:       "x.project.task",
+			wantErr: MismatchError,
+		},
+		{
+			name: "json",
+			s:    `{"v":1,"type":1,"param1":"project","actor":"alice","request_id":"req-1"}`,
+			want: Context{Version: 1, Type: 1, Param1: "project", Actor: "alice", RequestID: "req-1"},
+		},
+		{
+			name:    "json corrupted",
+			s:       `{"v":1,"type":`,
+			wantErr: CorruptedDataError,
+		},
+		{
+			name:    "json unknown version",
+			s:       `{"v":2,"type":1}`,
+			want:    Context{Version: 2, Type: 1},
+			wantErr: VersionError,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := FromString(c.s)
+			if err != c.wantErr {
+				t.Fatalf("FromString(%q) error = %v, want %v", c.s, err, c.wantErr)
+			}
+			if c.wantErr == CorruptedDataError || c.wantErr == MismatchError {
+				return
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("FromString(%q) = %+v, want %+v", c.s, got, c.want)
+			}
+		})
+	}
+}
+
+func TestFromStringRoundTrip(t *testing.T) {
+	c := New(1, "project", "task").With("count", 3)
+	got, err := FromString(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := got.GetInt("count"); !ok || n != 3 {
+		t.Fatalf("GetInt(count) = %d, %v, want 3, true", n, ok)
+	}
+	if got.Type != c.Type || got.Param1 != c.Param1 || got.Param2 != c.Param2 {
+		t.Fatalf("FromString(String()) = %+v, want %+v", got, c)
+	}
+}
@@ -0,0 +1,65 @@
+package context
+
+import (
+	gocontext "context"
+)
+
+type (
+	contextKey   struct{}
+	actorKey     struct{}
+	tenantKey    struct{}
+	clientIPKey  struct{}
+	traceIDKey   struct{}
+	requestIDKey struct{}
+)
+
+// NewContext 将审计 Context 附加到 ctx 中, 通常在 http/grpc 中间件或业务入口处调用
+func NewContext(ctx gocontext.Context, c Context) gocontext.Context {
+	return gocontext.WithValue(ctx, contextKey{}, c)
+}
+
+// WithActor 将执行操作的用户附加到 ctx 中, 优先于 NewContext 中的 Actor, 通常在鉴权中间件中调用
+func WithActor(ctx gocontext.Context, actor string) gocontext.Context {
+	return gocontext.WithValue(ctx, actorKey{}, actor)
+}
+
+// WithTenant 将租户附加到 ctx 中, 优先于 NewContext 中的 Tenant
+func WithTenant(ctx gocontext.Context, tenant string) gocontext.Context {
+	return gocontext.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// WithClientIP 将客户端 IP 附加到 ctx 中, 优先于 NewContext 中的 ClientIP
+func WithClientIP(ctx gocontext.Context, clientIP string) gocontext.Context {
+	return gocontext.WithValue(ctx, clientIPKey{}, clientIP)
+}
+
+// WithTraceID 将 trace ID 附加到 ctx 中, 优先于 NewContext 中的 TraceID, 通常在 tracing 中间件中调用
+func WithTraceID(ctx gocontext.Context, traceID string) gocontext.Context {
+	return gocontext.WithValue(ctx, traceIDKey{}, traceID)
+}
+
+// WithRequestID 将请求 ID 附加到 ctx 中, 优先于 NewContext 中的 RequestID, 通常在 tracing 中间件中调用
+func WithRequestID(ctx gocontext.Context, requestID string) gocontext.Context {
+	return gocontext.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// FromContext 返回 ctx 中附加的审计 Context, ok 表示 ctx 中是否有通过 NewContext 附加的 Context
+func FromContext(ctx gocontext.Context) (c Context, ok bool) {
+	c, ok = ctx.Value(contextKey{}).(Context)
+	overrides := []struct {
+		key   interface{}
+		field *string
+	}{
+		{actorKey{}, &c.Actor},
+		{tenantKey{}, &c.Tenant},
+		{clientIPKey{}, &c.ClientIP},
+		{traceIDKey{}, &c.TraceID},
+		{requestIDKey{}, &c.RequestID},
+	}
+	for _, o := range overrides {
+		if v, found := ctx.Value(o.key).(string); found {
+			*o.field = v
+		}
+	}
+	return c, ok
+}
@@ -0,0 +1,83 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const fileExt = ".json"
+
+// FileSink 每条死信保存为 dir 下的一个 json 文件
+type FileSink struct {
+	dir string
+}
+
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &FileSink{dir: dir}, nil
+}
+
+func (s *FileSink) path(id string) string {
+	return filepath.Join(s.dir, id+fileExt)
+}
+
+// Put 先写临时文件再 rename, 避免进程崩溃时留下不完整的文件
+func (s *FileSink) Put(letter *types.DeadLetter) error {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := s.path(letter.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0640); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(tmp, s.path(letter.ID)); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (s *FileSink) List(limit int) ([]*types.DeadLetter, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	letters := make([]*types.DeadLetter, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), fileExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		letter := new(types.DeadLetter)
+		if err := json.Unmarshal(b, letter); err != nil {
+			return nil, errors.Trace(err)
+		}
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FirstFailedAt.Before(letters[j].FirstFailedAt)
+	})
+	if limit > 0 && len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (s *FileSink) Delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package deadletter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkPut(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 上次写入时崩溃留下的临时文件不会被列出, 也不影响之后的写入
+	if err := os.WriteFile(filepath.Join(dir, "a"+fileExt+".tmp"), []byte("{"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Put(testLetter("a", testTime)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "a"+fileExt {
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Fatalf("files after put = %v, want [a%s]", names, fileExt)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "b"+fileExt+".tmp"), []byte("{"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	letters, err := sink.List(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "a" || !letters[0].FirstFailedAt.Equal(testTime) {
+		t.Fatalf("List = %v, want [a]", letterIDs(letters))
+	}
+}
@@ -0,0 +1,73 @@
+package deadletter
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/config"
+	"github.com/obgnail/audit-log/mysql/utils/uuid"
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+)
+
+const (
+	SinkFile       = "file"
+	SinkStore      = "store"
+	SinkClickHouse = "clickhouse" // SinkStore 的旧名称, store 为 clickhouse 时二者相同
+)
+
+// Sink 存储处理失败的审计日志
+type Sink interface {
+	// Put 写入或更新(ID 相同)一条死信
+	Put(letter *types.DeadLetter) error
+	// List 按首次失败时间从早到晚列出最多 limit 条死信, limit <= 0 时列出全部
+	List(limit int) ([]*types.DeadLetter, error)
+	// Delete 删除一条死信
+	Delete(id string) error
+}
+
+// New 根据配置创建 Sink, s 仅在 sink = "store" 时使用
+func New(cfg *config.DeadLetterConfig, s store.Store) (Sink, error) {
+	switch cfg.Sink {
+	case SinkFile, "":
+		sink, err := NewFileSink(cfg.Dir)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return sink, nil
+	case SinkStore, SinkClickHouse:
+		return NewStoreSink(s), nil
+	default:
+		return nil, fmt.Errorf("unknown dead letter sink: %s", cfg.Sink)
+	}
+}
+
+func NewDeadLetter(auditLog *types.AuditLog, err error, attempts int) *types.DeadLetter {
+	// 同一个事务的死信使用相同的 ID, 重复失败时覆盖之前的死信
+	id := auditLog.ID
+	if id == "" {
+		id = uuid.V4()
+	}
+	letter := &types.DeadLetter{ID: id, AuditLog: auditLog}
+	letter.Fail(err, attempts)
+	return letter
+}
+
+// Replay 将死信重新交给 fn 处理, 成功的从 sink 中删除, 失败的更新错误信息和重试次数后写回 sink.
+// 返回处理成功的数量
+func Replay(sink Sink, letters []*types.DeadLetter, fn func(auditLog *types.AuditLog) error) (int, error) {
+	succeeded := 0
+	for _, letter := range letters {
+		if err := fn(letter.AuditLog); err != nil {
+			letter.Fail(err, 1)
+			if err := sink.Put(letter); err != nil {
+				return succeeded, errors.Trace(err)
+			}
+			continue
+		}
+		if err := sink.Delete(letter.ID); err != nil {
+			return succeeded, errors.Trace(err)
+		}
+		succeeded++
+	}
+	return succeeded, nil
+}
@@ -0,0 +1,181 @@
+package deadletter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+)
+
+// testTime 毫秒精度的时间, store 只保存到毫秒
+var testTime = time.UnixMilli(1700000000000)
+
+func testLetter(id string, firstFailedAt time.Time) *types.DeadLetter {
+	return &types.DeadLetter{
+		ID:            id,
+		AuditLog:      &types.AuditLog{ID: id, GTID: "uuid:" + id, Time: testTime, Context: "ctx"},
+		Error:         "handle failed",
+		Attempts:      3,
+		FirstFailedAt: firstFailedAt,
+		LastFailedAt:  firstFailedAt,
+	}
+}
+
+// sinks 返回需要测试的所有 Sink, 每次调用都返回空的 Sink
+func sinks(t *testing.T) map[string]Sink {
+	file, err := NewFileSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Sink{
+		SinkFile:  file,
+		SinkStore: NewStoreSink(store.NewMemoryStore()),
+	}
+}
+
+func letterIDs(letters []*types.DeadLetter) []string {
+	ids := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		ids = append(ids, letter.ID)
+	}
+	return ids
+}
+
+func TestSink(t *testing.T) {
+	for name, sink := range sinks(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, letter := range []*types.DeadLetter{
+				testLetter("b", testTime.Add(time.Minute)),
+				testLetter("c", testTime.Add(2*time.Minute)),
+				testLetter("a", testTime),
+			} {
+				if err := sink.Put(letter); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// ID 相同时覆盖
+			updated := testLetter("a", testTime)
+			updated.Attempts = 4
+			if err := sink.Put(updated); err != nil {
+				t.Fatal(err)
+			}
+
+			cases := []struct {
+				limit int
+				want  []string
+			}{
+				{limit: 2, want: []string{"a", "b"}},
+				{limit: 3, want: []string{"a", "b", "c"}},
+				{limit: 10, want: []string{"a", "b", "c"}},
+				{limit: 0, want: []string{"a", "b", "c"}},
+				{limit: -1, want: []string{"a", "b", "c"}},
+			}
+			for _, c := range cases {
+				letters, err := sink.List(c.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ids := letterIDs(letters); !reflect.DeepEqual(ids, c.want) {
+					t.Fatalf("List(%d) = %v, want %v", c.limit, ids, c.want)
+				}
+				if first := letters[0]; first.Attempts != 4 || first.AuditLog == nil || first.AuditLog.GTID != "uuid:a" {
+					t.Fatalf("overwritten letter = %+v", first)
+				}
+			}
+
+			if err := sink.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			// 删除不存在的死信不会出错
+			if err := sink.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			letters, err := sink.List(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := letterIDs(letters); !reflect.DeepEqual(ids, []string{"a", "c"}) {
+				t.Fatalf("List after delete = %v, want [a c]", ids)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	for name, sink := range sinks(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, letter := range []*types.DeadLetter{
+				testLetter("a", testTime),
+				testLetter("b", testTime.Add(time.Minute)),
+				testLetter("c", testTime.Add(2*time.Minute)),
+			} {
+				if err := sink.Put(letter); err != nil {
+					t.Fatal(err)
+				}
+			}
+			letters, err := sink.List(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var replayed []string
+			succeeded, err := Replay(sink, letters, func(auditLog *types.AuditLog) error {
+				replayed = append(replayed, auditLog.ID)
+				if auditLog.ID == "b" {
+					return errors.New("still failing")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if succeeded != 2 || !reflect.DeepEqual(replayed, []string{"a", "b", "c"}) {
+				t.Fatalf("Replay = %d, replayed %v, want 2 of [a b c]", succeeded, replayed)
+			}
+
+			// 成功的被删除, 失败的更新错误信息、重试次数和最后失败时间, 首次失败时间不变
+			remaining, err := sink.List(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(remaining) != 1 || remaining[0].ID != "b" {
+				t.Fatalf("remaining letters = %v, want [b]", letterIDs(remaining))
+			}
+			failed := remaining[0]
+			if failed.Attempts != 4 || failed.Error != "still failing" {
+				t.Fatalf("failed letter attempts = %d, error = %q, want 4, still failing", failed.Attempts, failed.Error)
+			}
+			if !failed.FirstFailedAt.Equal(testTime.Add(time.Minute)) || !failed.LastFailedAt.After(failed.FirstFailedAt) {
+				t.Fatalf("failed letter first failed at %v, last failed at %v", failed.FirstFailedAt, failed.LastFailedAt)
+			}
+		})
+	}
+}
+
+// failingSink Delete 总是失败
+type failingSink struct {
+	Sink
+}
+
+func (s failingSink) Delete(id string) error {
+	return errors.New("delete failed")
+}
+
+func TestReplaySinkError(t *testing.T) {
+	sink := failingSink{NewStoreSink(store.NewMemoryStore())}
+	letters := []*types.DeadLetter{testLetter("a", testTime), testLetter("b", testTime)}
+	handled := 0
+	succeeded, err := Replay(sink, letters, func(*types.AuditLog) error {
+		handled++
+		return nil
+	})
+	if err == nil {
+		t.Fatal("sink error not returned")
+	}
+	if succeeded != 0 || handled != 1 {
+		t.Fatalf("Replay = %d, handled %d, want to stop after the first letter", succeeded, handled)
+	}
+}
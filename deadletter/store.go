@@ -0,0 +1,50 @@
+package deadletter
+
+import (
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+)
+
+// StoreSink 将死信保存在 store 的 dead_letter 表中
+type StoreSink struct {
+	store store.Store
+}
+
+func NewStoreSink(store store.Store) *StoreSink {
+	return &StoreSink{store: store}
+}
+
+func (s *StoreSink) Put(letter *types.DeadLetter) error {
+	chLetter, err := letter.ChDeadLetter()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := s.store.InsertDeadLetter(chLetter); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (s *StoreSink) List(limit int) ([]*types.DeadLetter, error) {
+	chLetters, err := s.store.ListDeadLetters(limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	letters := make([]*types.DeadLetter, 0, len(chLetters))
+	for i := range chLetters {
+		letter, err := chLetters[i].DeadLetter()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+func (s *StoreSink) Delete(id string) error {
+	if err := s.store.DeleteDeadLetter(id); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	ctx "context"
 	"fmt"
 	"github.com/juju/errors"
 	"github.com/obgnail/audit-log/audit_log"
@@ -9,14 +10,23 @@ import (
 	"github.com/obgnail/audit-log/mysql/utils/uuid"
 	"github.com/obgnail/audit-log/types"
 	"gopkg.in/gorp.v1"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
 	audit_log.Init("./config/config.toml")
 
-	audit_log.Run(audit_log.FunctionHandler(func(auditLog *types.AuditLog) error {
+	auditLogger := audit_log.Run(audit_log.FunctionHandler(func(auditLog *types.AuditLog) error {
 		fmt.Printf("get audit log: %+v\n", *auditLog)
+		for _, change := range auditLog.Changes {
+			fmt.Printf("%s %s.%s %v\n", change.Action, change.Db, change.Table, change.PrimaryKey)
+			for _, column := range change.Columns {
+				fmt.Printf("    %s\n", column)
+			}
+		}
 		return nil
 	}))
 
@@ -26,8 +36,14 @@ func main() {
 	insertUser()
 	//dropTable()
 
-	forever := make(chan struct{})
-	<-forever
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	// 等待已消费的数据全部持久化后退出
+	stopCtx, cancel := ctx.WithTimeout(ctx.Background(), 30*time.Second)
+	defer cancel()
+	checkErr(auditLogger.Stop(stopCtx))
 }
 
 func createTable() {
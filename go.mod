@@ -6,10 +6,13 @@ require (
 	github.com/BurntSushi/toml v1.2.1
 	github.com/ClickHouse/clickhouse-go/v2 v2.0.12
 	github.com/Shopify/sarama v1.37.0
+	github.com/jmoiron/sqlx v1.3.5
 	github.com/juju/errors v0.0.0-20220203013757-bd733f3c86b9
+	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/obgnail/mysql-river v0.0.0-20230209124253-5cfe7a909806
 	github.com/satori/go.uuid v1.2.0
 	gopkg.in/gorp.v1 v1.7.2
+	gorm.io/gorm v1.25.5
 )
 
 require (
@@ -29,9 +32,10 @@ require (
 	github.com/jcmturner/gofork v1.7.6 // indirect
 	github.com/jcmturner/gokrb5/v8 v8.4.3 // indirect
 	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/klauspost/compress v1.15.11 // indirect
 	github.com/lib/pq v1.8.1-0.20200908161135-083382b7e6fc // indirect
-	github.com/mattn/go-sqlite3 v1.14.12 // indirect
 	github.com/paulmach/orb v0.4.0 // indirect
 	github.com/pierrec/lz4/v4 v4.1.17 // indirect
 	github.com/pingcap/errors v0.11.5-0.20210425183316-da1aaba5fb63 // indirect
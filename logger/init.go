@@ -6,21 +6,57 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 )
 
 var CommonLogger *Logger
 
+var (
+	sharedMu  sync.Mutex
+	sharedCfg *cfg.LogConfig // 创建 CommonLogger 使用的配置
+)
+
 func InitLogger() error {
+	return errors.Trace(InitSharedLogger(cfg.Main.Log))
+}
+
+// InitSharedLogger 根据配置创建进程内共享的 CommonLogger. 已经创建过时, 配置相同则直接返回,
+// 配置不同则返回错误: 同一进程中的多个实例只能使用相同的日志配置
+func InitSharedLogger(logCfg *cfg.LogConfig) error {
+	if logCfg == nil {
+		return errors.New("log config is nil")
+	}
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	if sharedCfg != nil {
+		if *sharedCfg != *logCfg {
+			return errors.Errorf("log config %+v conflicts with the shared logger's config %+v", *logCfg, *sharedCfg)
+		}
+		return nil
+	}
+	l, err := NewCommonLogger(logCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	CommonLogger = l
+	c := *logCfg
+	sharedCfg = &c
+	return nil
+}
+
+// NewCommonLogger 根据配置创建 logger, 同时输出到标准输出和日志文件
+func NewCommonLogger(logCfg *cfg.LogConfig) (*Logger, error) {
 	sep := "/github.com"
 	pathPrefix := "/github.com/obgnail/audit-log"
 
-	logFile, err := os.OpenFile(cfg.Main.Log.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	logFile, err := os.OpenFile(logCfg.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
 	logLevel := InfoLevel
-	switch strings.ToUpper(cfg.Main.Log.LogLevel) {
+	switch strings.ToUpper(logCfg.LogLevel) {
 	case "TRACE":
 		logLevel = TraceLevel
 	case "INFO":
@@ -39,11 +75,11 @@ func InitLogger() error {
 		Encoder:    &PlainEncoder{EnableBuffer: false}, //先禁用buffer,如果开启需要处理系统信号量
 	}
 
-	CommonLogger, _, err = NewLogger(auditConfig)
+	l, _, err := NewLogger(auditConfig)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
-	return nil
+	return l, nil
 }
 
 func Error(format string, args ...interface{}) {
@@ -0,0 +1,128 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	auditContext "github.com/obgnail/audit-log/context"
+	mysqlDriver "github.com/obgnail/audit-log/mysql/go-mysql-driver"
+	"gorm.io/gorm"
+)
+
+// SQLTransact 在 database/sql 的 db 上执行事务, 审计 Context 从 ctx 中读取(见 auditContext.NewContext),
+// ctx 中没有审计 Context 时返回 auditContext.NotFoundError. 提交成功后通过 pusher 推送 tx_info.
+// ctx 被取消或超时时 database/sql 会回滚事务. pusher 为 Outbox 时审计 Context 在事务中写入 outbox 表
+func SQLTransact(ctx context.Context, db *sql.DB, pusher TxPusher, txFunc func(tx *sql.Tx) error) error {
+	auditCtx, hookCtx, gtid, err := beginAudit(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tx, err := db.BeginTx(hookCtx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = commitOrRollback(tx, func() error {
+		if err := recordOutbox(pusher, tx.Exec, auditCtx); err != nil {
+			return err
+		}
+		return txFunc(tx)
+	})
+	if err != nil {
+		return err
+	}
+	pushTxInfo(pusher, auditCtx, *gtid)
+	return nil
+}
+
+// SQLXTransact 与 SQLTransact 相同, 用于 sqlx
+func SQLXTransact(ctx context.Context, db *sqlx.DB, pusher TxPusher, txFunc func(tx *sqlx.Tx) error) error {
+	auditCtx, hookCtx, gtid, err := beginAudit(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tx, err := db.BeginTxx(hookCtx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = commitOrRollback(tx, func() error {
+		if err := recordOutbox(pusher, tx.Exec, auditCtx); err != nil {
+			return err
+		}
+		return txFunc(tx)
+	})
+	if err != nil {
+		return err
+	}
+	pushTxInfo(pusher, auditCtx, *gtid)
+	return nil
+}
+
+// GormTransact 与 SQLTransact 相同, 用于 GORM, 事务由 gorm.DB.Transaction 管理.
+// db 不能已经处于事务中, 否则 GORM 使用 SavePoint, 外层事务提交前拿不到 GTID, 不会推送 tx_info
+func GormTransact(ctx context.Context, db *gorm.DB, pusher TxPusher, txFunc func(tx *gorm.DB) error) error {
+	auditCtx, hookCtx, gtid, err := beginAudit(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = db.WithContext(hookCtx).Transaction(func(tx *gorm.DB) error {
+		if err := recordOutbox(pusher, gormExec(tx), auditCtx); err != nil {
+			return err
+		}
+		return txFunc(tx)
+	})
+	if err != nil {
+		return err
+	}
+	pushTxInfo(pusher, auditCtx, *gtid)
+	return nil
+}
+
+func gormExec(tx *gorm.DB) execFunc {
+	return func(query string, args ...interface{}) (sql.Result, error) {
+		return nil, tx.Exec(query, args...).Error
+	}
+}
+
+// beginAudit 读取 ctx 中的审计 Context, 返回注册了 CommitHook 的 hookCtx,
+// 使用 hookCtx 开始的事务提交成功后 gtid 中为事务的 GTID
+func beginAudit(ctx context.Context) (auditCtx string, hookCtx context.Context, gtid *string, err error) {
+	c, ok := auditContext.FromContext(ctx)
+	if !ok {
+		return "", nil, nil, auditContext.NotFoundError
+	}
+	if err = ctx.Err(); err != nil {
+		return "", nil, nil, err
+	}
+	gtid = new(string)
+	hookCtx = mysqlDriver.WithCommitHook(ctx, func(g string) { *gtid = g })
+	return c.String(), hookCtx, gtid, nil
+}
+
+type sqlTx interface {
+	Commit() error
+	Rollback() error
+}
+
+// commitOrRollback 执行 txFunc, 返回错误或 panic 时回滚, 否则提交
+func commitOrRollback(tx sqlTx, txFunc func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			switch p := p.(type) {
+			case error:
+				err = p
+			default:
+				err = fmt.Errorf("%s", p)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			tx.Rollback()
+		}
+	}()
+	return txFunc()
+}
@@ -0,0 +1,331 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	auditContext "github.com/obgnail/audit-log/context"
+	"github.com/obgnail/audit-log/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	gormLogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+const testGTID = "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"
+
+// fakeServer 只实现握手和 COM_QUERY 的 MySQL 服务端, 所有语句都返回 OK.
+// COMMIT 的 OK 包中携带事务的 GTID(session_track_gtids), failCommit 时返回 ERR
+type fakeServer struct {
+	ln net.Listener
+
+	mu         sync.Mutex
+	queries    []string
+	failCommit bool
+}
+
+func newFakeServer(t *testing.T, failCommit bool) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, failCommit: failCommit}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+// openDB 使用 go-mysql-driver 打开连接到 s 的连接池
+func (s *fakeServer) openDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("mysql", fmt.Sprintf("root@tcp(%s)/test", s.ln.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// txQueries 返回事务中执行的语句, 不包括开始事务前设置 session_track_gtids 的语句
+func (s *fakeServer) txQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, q := range s.queries {
+		if q == "START TRANSACTION" {
+			return append([]string(nil), s.queries[i:]...)
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	if err := writeTestPacket(conn, 0, handshakePacket()); err != nil {
+		return
+	}
+	if _, _, err := readTestPacket(conn); err != nil {
+		return
+	}
+	if err := writeTestPacket(conn, 2, okPacket("")); err != nil {
+		return
+	}
+	for {
+		seq, data, err := readTestPacket(conn)
+		if err != nil || len(data) == 0 {
+			return
+		}
+		resp := okPacket("")
+		switch data[0] {
+		case 0x01: // COM_QUIT
+			return
+		case 0x03: // COM_QUERY
+			resp = s.query(string(data[1:]))
+		}
+		if err := writeTestPacket(conn, seq+1, resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) query(q string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = append(s.queries, q)
+	if q != "COMMIT" {
+		return okPacket("")
+	}
+	if s.failCommit {
+		return errPacket(1180, "Got error during COMMIT")
+	}
+	return okPacket(testGTID)
+}
+
+func readTestPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[3], data, nil
+}
+
+func writeTestPacket(w io.Writer, seq byte, data []byte) error {
+	header := []byte{byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16), seq}
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+func handshakePacket() []byte {
+	// CLIENT_PROTOCOL_41 | CLIENT_TRANSACTIONS | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH | CLIENT_SESSION_TRACK
+	caps := uint32(1<<9 | 1<<13 | 1<<15 | 1<<19 | 1<<23)
+	p := []byte{10}
+	p = append(p, "8.0.30-fake\x00"...)
+	p = append(p, 1, 0, 0, 0)    // connection id
+	p = append(p, "abcdefgh"...) // auth plugin data part 1
+	p = append(p, 0)
+	p = append(p, byte(caps), byte(caps>>8))
+	p = append(p, 0x21, 0x02, 0x00) // charset, status
+	p = append(p, byte(caps>>16), byte(caps>>24), 21)
+	p = append(p, make([]byte, 10)...)
+	p = append(p, "ijklmnopqrst\x00"...) // auth plugin data part 2
+	p = append(p, "mysql_native_password\x00"...)
+	return p
+}
+
+// okPacket gtid 不为空时在 session state 中携带 SESSION_TRACK_GTIDS
+func okPacket(gtid string) []byte {
+	status := uint16(0x0002) // SERVER_STATUS_AUTOCOMMIT
+	if gtid != "" {
+		status |= 0x4000 // SERVER_SESSION_STATE_CHANGED
+	}
+	p := []byte{0x00, 0, 0} // header, affected rows, last insert id
+	p = append(p, byte(status), byte(status>>8))
+	p = append(p, 0, 0) // warnings
+	p = append(p, 0)    // info
+	if gtid == "" {
+		return p
+	}
+	data := append([]byte{0, byte(len(gtid))}, gtid...)     // encoding specification, gtid
+	entry := append([]byte{0x03, byte(len(data))}, data...) // SESSION_TRACK_GTIDS
+	p = append(p, byte(len(entry)))
+	return append(p, entry...)
+}
+
+func errPacket(code uint16, message string) []byte {
+	p := []byte{0xff}
+	p = append(p, byte(code), byte(code>>8))
+	p = append(p, "#HY000"...)
+	return append(p, message...)
+}
+
+// pushRecorder 记录推送的 tx_info
+type pushRecorder struct {
+	txInfos []*types.TxInfo
+}
+
+func (p *pushRecorder) PushTx(txInfo *types.TxInfo) error {
+	p.txInfos = append(p.txInfos, txInfo)
+	return nil
+}
+
+// testDialector 使用已经打开的 *sql.DB 的最小 GORM Dialector
+type testDialector struct {
+	db *sql.DB
+}
+
+func (d testDialector) Name() string { return "mysql" }
+
+func (d testDialector) Initialize(db *gorm.DB) error {
+	db.ConnPool = d.db
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	return nil
+}
+
+func (d testDialector) Migrator(db *gorm.DB) gorm.Migrator { return nil }
+
+func (d testDialector) DataTypeOf(*schema.Field) string { return "" }
+
+func (d testDialector) DefaultValueOf(*schema.Field) clause.Expression { return clause.Expr{} }
+
+func (d testDialector) BindVarTo(writer clause.Writer, stmt *gorm.Statement, v interface{}) {
+	writer.WriteByte('?')
+}
+
+func (d testDialector) QuoteTo(writer clause.Writer, s string) {
+	writer.WriteString("`" + s + "`")
+}
+
+func (d testDialector) Explain(sql string, vars ...interface{}) string { return sql }
+
+// testTransact 在 db 上用一种 adapter 执行事务, txFunc 中执行 exec 后返回 txErr
+type testTransact func(t *testing.T, ctx context.Context, db *sql.DB, pusher TxPusher, exec string, txErr error) error
+
+var testAdapters = map[string]testTransact{
+	"sql": func(t *testing.T, ctx context.Context, db *sql.DB, pusher TxPusher, exec string, txErr error) error {
+		return SQLTransact(ctx, db, pusher, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(exec); err != nil {
+				return err
+			}
+			return txErr
+		})
+	},
+	"sqlx": func(t *testing.T, ctx context.Context, db *sql.DB, pusher TxPusher, exec string, txErr error) error {
+		return SQLXTransact(ctx, sqlx.NewDb(db, "mysql"), pusher, func(tx *sqlx.Tx) error {
+			if _, err := tx.Exec(exec); err != nil {
+				return err
+			}
+			return txErr
+		})
+	},
+	"gorm": func(t *testing.T, ctx context.Context, db *sql.DB, pusher TxPusher, exec string, txErr error) error {
+		gormDB, err := gorm.Open(testDialector{db: db}, &gorm.Config{Logger: gormLogger.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return GormTransact(ctx, gormDB, pusher, func(tx *gorm.DB) error {
+			if err := tx.Exec(exec).Error; err != nil {
+				return err
+			}
+			return txErr
+		})
+	},
+}
+
+func TestTransactCommitHook(t *testing.T) {
+	const exec = "UPDATE user SET name = 'bob' WHERE id = 1"
+	auditCtx := auditContext.New(1, "u1", "")
+	cases := []struct {
+		name        string
+		txErr       error
+		failCommit  bool
+		wantQueries []string
+		wantPushed  bool
+	}{
+		{
+			name:        "commit",
+			wantQueries: []string{"START TRANSACTION", exec, "COMMIT"},
+			wantPushed:  true,
+		},
+		{
+			name:        "rollback",
+			txErr:       errors.New("tx failed"),
+			wantQueries: []string{"START TRANSACTION", exec, "ROLLBACK"},
+		},
+		{
+			name:        "commit failed",
+			failCommit:  true,
+			wantQueries: []string{"START TRANSACTION", exec, "COMMIT"},
+		},
+	}
+	for name, transact := range testAdapters {
+		for _, c := range cases {
+			t.Run(name+"/"+c.name, func(t *testing.T) {
+				server := newFakeServer(t, c.failCommit)
+				pusher := &pushRecorder{}
+
+				ctx := auditContext.NewContext(context.Background(), auditCtx)
+				err := transact(t, ctx, server.openDB(t), pusher, exec, c.txErr)
+				if wantErr := c.txErr != nil || c.failCommit; (err != nil) != wantErr {
+					t.Fatalf("transact error = %v, want error: %v", err, wantErr)
+				}
+				if queries := server.txQueries(); !reflect.DeepEqual(queries, c.wantQueries) {
+					t.Fatalf("queries = %q, want %q", queries, c.wantQueries)
+				}
+
+				// 只有 COMMIT 成功后 CommitHook 才拿到 GTID, 推送 tx_info
+				if !c.wantPushed {
+					if len(pusher.txInfos) != 0 {
+						t.Fatalf("pushed %+v after %s", pusher.txInfos[0], c.name)
+					}
+					return
+				}
+				if len(pusher.txInfos) != 1 {
+					t.Fatalf("pushed %d tx infos, want 1", len(pusher.txInfos))
+				}
+				if txInfo := pusher.txInfos[0]; txInfo.GTID != testGTID || txInfo.Context != auditCtx.String() {
+					t.Fatalf("pushed tx info = %+v, want gtid %s, context %s", txInfo, testGTID, auditCtx.String())
+				}
+			})
+		}
+	}
+}
+
+// TestTransactWithoutContext ctx 中没有审计 Context 时不开始事务
+func TestTransactWithoutContext(t *testing.T) {
+	for name, transact := range testAdapters {
+		t.Run(name, func(t *testing.T) {
+			server := newFakeServer(t, false)
+			pusher := &pushRecorder{}
+			err := transact(t, context.Background(), server.openDB(t), pusher, "DO 0", nil)
+			if errors.Cause(err) != auditContext.NotFoundError {
+				t.Fatalf("transact error = %v, want %v", err, auditContext.NotFoundError)
+			}
+			if queries := server.txQueries(); len(queries) != 0 || len(pusher.txInfos) != 0 {
+				t.Fatalf("queries = %q, pushed %d tx infos, want none", queries, len(pusher.txInfos))
+			}
+		})
+	}
+}
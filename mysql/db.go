@@ -2,16 +2,19 @@ package mysql
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/juju/errors"
+	auditContext "github.com/obgnail/audit-log/context"
 	"github.com/obgnail/audit-log/logger"
+	mysqlDriver "github.com/obgnail/audit-log/mysql/go-mysql-driver"
 	"github.com/obgnail/audit-log/syncer"
 	"github.com/obgnail/audit-log/types"
 	uuid "github.com/satori/go.uuid"
 	"gopkg.in/gorp.v1"
-	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,11 +22,82 @@ const (
 	sqlDefaultSep = " ,"
 )
 
+// TxPusher 在事务提交后推送 tx_info
+type TxPusher interface {
+	PushTx(txInfo *types.TxInfo) error
+}
+
 func DBMTransact(ctx string, txFunc func(tx *gorp.Transaction) error) (err error) {
-	tx, err := DBM.Begin()
+	return Transact(DBM, dbmPusher(), ctx, txFunc)
+}
+
+// DBMTransactContext 与 DBMTransact 相同, 审计 Context 从 ctx 中读取, 见 TransactContext
+func DBMTransactContext(ctx context.Context, txFunc func(tx *gorp.Transaction) error) error {
+	return TransactContext(ctx, DBM, dbmPusher(), txFunc)
+}
+
+func dbmPusher() TxPusher {
+	if DBMOutbox != nil {
+		return DBMOutbox
+	}
+	return syncer.TxInfoSyncer
+}
+
+// Transact 在 dbm 上执行事务, 提交成功后通过 pusher 推送携带 ctx 的 tx_info.
+// pusher 为 Outbox 时 ctx 在事务中写入 outbox 表, 见 Outbox
+func Transact(dbm *gorp.DbMap, pusher TxPusher, ctx string, txFunc func(tx *gorp.Transaction) error) (err error) {
+	return transact(context.Background(), dbm, pusher, ctx, txFunc)
+}
+
+// TransactContext 在 dbm 上执行事务, 审计 Context 从 ctx 中读取(见 auditContext.NewContext),
+// ctx 中没有审计 Context 时返回 auditContext.NotFoundError.
+// ctx 被取消或超时时回滚事务并返回 ctx.Err(): 正在执行的语句结束后, 之后的语句和提交都会失败
+func TransactContext(ctx context.Context, dbm *gorp.DbMap, pusher TxPusher, txFunc func(tx *gorp.Transaction) error) error {
+	c, ok := auditContext.FromContext(ctx)
+	if !ok {
+		return errors.Trace(auditContext.NotFoundError)
+	}
+	return transact(ctx, dbm, pusher, c.String(), txFunc)
+}
+
+func transact(ctx context.Context, dbm *gorp.DbMap, pusher TxPusher, auditCtx string, txFunc func(tx *gorp.Transaction) error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	tx, err := dbm.Begin()
 	if err != nil {
 		return
 	}
+	// 提交成功后由驱动通过 CommitHook 写入 GTID
+	var gtid string
+	if err = registerCommitHook(tx, func(g string) { gtid = g }); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	// gorp.Transaction 不是并发安全的, 提交和 ctx 结束时的回滚需要互斥
+	var (
+		mu         sync.Mutex
+		finished   bool
+		rolledBack bool
+	)
+	stop := make(chan struct{})
+	defer close(stop)
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				mu.Lock()
+				defer mu.Unlock()
+				if !finished {
+					finished, rolledBack = true, true
+					tx.Rollback()
+				}
+			case <-stop:
+			}
+		}()
+	}
+
 	defer func() {
 		if p := recover(); p != nil {
 			switch p := p.(type) {
@@ -33,38 +107,58 @@ func DBMTransact(ctx string, txFunc func(tx *gorp.Transaction) error) (err error
 				err = fmt.Errorf("%s", p)
 			}
 		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if rolledBack {
+			err = ctx.Err()
+			return
+		}
+		finished = true
+		if err == nil {
+			err = ctx.Err()
+		}
 		if err != nil {
 			tx.Rollback()
 			return
 		}
-		txiField := reflectTxi(tx)
-
 		err = tx.Commit()
 		if err != nil {
 			tx.Rollback()
 			return
 		}
-
-		GTIDField := txiField.FieldByName("GTID")
-		GTIDValue := GTIDField.String()
-		if checkGTID(GTIDValue) {
-			t := types.NewTxInfo(ctx, GTIDValue)
-			if err := syncer.TxInfoSyncer.PushTx(t); err != nil {
-				logger.ErrorDetails(errors.Trace(err))
-				logger.Error("GTIDField: %s, GTIDValue: %s\n", GTIDField, GTIDValue)
-			}
-		}
+		pushTxInfo(pusher, auditCtx, gtid)
 	}()
+	if err = recordOutbox(pusher, tx.Exec, auditCtx); err != nil {
+		return
+	}
 	return txFunc(tx)
 }
 
-func reflectTxi(tx *gorp.Transaction) reflect.Value {
-	obj := reflect.ValueOf(tx)
-	elem := obj.Elem()
-	txField := elem.FieldByName("tx")
-	txElem := txField.Elem()
-	txiField := txElem.FieldByName("txi").Elem().Elem()
-	return txiField
+// registerCommitHook 为 gorp 事务注册 CommitHook. gorp.v1 开始事务时不支持 context,
+// 在事务中使用携带 hook 的 context 执行一条不读写数据的语句, 由驱动注册到当前事务上
+func registerCommitHook(tx *gorp.Transaction, hook mysqlDriver.CommitHook) error {
+	stmt, err := tx.Prepare("DO 0")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.ExecContext(mysqlDriver.WithCommitHook(context.Background(), hook)); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// pushTxInfo 推送已提交事务的 tx_info, 推送失败只记录日志
+func pushTxInfo(pusher TxPusher, auditCtx string, gtid string) {
+	if !checkGTID(gtid) {
+		return
+	}
+	t := types.NewTxInfo(auditCtx, gtid)
+	if err := pusher.PushTx(t); err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+		logger.Error("push tx info failed, GTID: %s, context: %s", gtid, auditCtx)
+	}
 }
 
 func checkGTID(GTID string) bool {
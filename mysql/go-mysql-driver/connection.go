@@ -44,6 +44,7 @@ type mysqlConn struct {
 	closed   atomicBool  // set when conn is closed, before closech is closed
 
 	GTID string
+	tx   *mysqlTx // current transaction, for registering CommitHook (see registerCommitHooks)
 }
 
 // Handles parameters set in DSN after the connection is established
@@ -108,7 +109,8 @@ func (mc *mysqlConn) begin(readOnly bool) (driver.Tx, error) {
 	}
 	err := mc.exec(q)
 	if err == nil {
-		return &mysqlTx{mc, ""}, err
+		mc.tx = &mysqlTx{mc: mc}
+		return mc.tx, err
 	}
 	return nil, mc.markBadConn(err)
 }
@@ -503,7 +505,12 @@ func (mc *mysqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver
 		}
 	}
 
-	return mc.begin(opts.ReadOnly)
+	tx, err := mc.begin(opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	mc.tx.addCommitHooks(ctx)
+	return tx, nil
 }
 
 func (mc *mysqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
@@ -515,6 +522,7 @@ func (mc *mysqlConn) QueryContext(ctx context.Context, query string, args []driv
 	if err := mc.watchCancel(ctx); err != nil {
 		return nil, err
 	}
+	mc.registerCommitHooks(ctx)
 
 	rows, err := mc.query(query, dargs)
 	if err != nil {
@@ -534,6 +542,7 @@ func (mc *mysqlConn) ExecContext(ctx context.Context, query string, args []drive
 	if err := mc.watchCancel(ctx); err != nil {
 		return nil, err
 	}
+	mc.registerCommitHooks(ctx)
 	defer mc.finish()
 
 	return mc.Exec(query, dargs)
@@ -568,6 +577,7 @@ func (stmt *mysqlStmt) QueryContext(ctx context.Context, args []driver.NamedValu
 	if err := stmt.mc.watchCancel(ctx); err != nil {
 		return nil, err
 	}
+	stmt.mc.registerCommitHooks(ctx)
 
 	rows, err := stmt.query(dargs)
 	if err != nil {
@@ -587,6 +597,7 @@ func (stmt *mysqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue
 	if err := stmt.mc.watchCancel(ctx); err != nil {
 		return nil, err
 	}
+	stmt.mc.registerCommitHooks(ctx)
 	defer stmt.mc.finish()
 
 	return stmt.Exec(dargs)
@@ -656,3 +667,11 @@ func (mc *mysqlConn) ResetSession(ctx context.Context) error {
 	mc.reset = true
 	return nil
 }
+
+// registerCommitHooks registers the hooks carried by ctx (see WithCommitHook)
+// on the current transaction. It is a no-op outside a transaction.
+func (mc *mysqlConn) registerCommitHooks(ctx context.Context) {
+	if mc.tx != nil {
+		mc.tx.addCommitHooks(ctx)
+	}
+}
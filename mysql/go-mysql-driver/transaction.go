@@ -8,9 +8,72 @@
 
 package mysql
 
+import "context"
+
+// CommitHook is called after the transaction is committed successfully,
+// with the GTID of the transaction. gtid is empty when the transaction
+// did not generate one (e.g. read only transactions).
+//
+// A hook is carried by a context (see WithCommitHook) and registered on the
+// transaction by BeginTx, or by any statement executed with the context
+// inside the transaction:
+//
+//	// database/sql, sqlx, GORM
+//	tx, err := db.BeginTx(mysql.WithCommitHook(ctx, hook), nil)
+//
+//	// libraries that begin the transaction without a context (e.g. gorp.v1)
+//	stmt, err := tx.Prepare("DO 0")
+//	_, err = stmt.ExecContext(mysql.WithCommitHook(ctx, hook))
+//
+// A hook registered several times on the same transaction is called once.
+type CommitHook func(gtid string)
+
+type commitHookKey struct{}
+
+// commitHookEntry is the hook added by one WithCommitHook call, linked to the
+// hooks already carried by the parent context.
+type commitHookEntry struct {
+	hook   CommitHook
+	parent *commitHookEntry
+}
+
+// WithCommitHook returns a copy of ctx carrying hook. Transactions begun with
+// the returned context, or executing a statement with it, call hook after
+// they are committed.
+func WithCommitHook(ctx context.Context, hook CommitHook) context.Context {
+	parent, _ := ctx.Value(commitHookKey{}).(*commitHookEntry)
+	return context.WithValue(ctx, commitHookKey{}, &commitHookEntry{hook: hook, parent: parent})
+}
+
 type mysqlTx struct {
-	mc   *mysqlConn
-	GTID string
+	mc    *mysqlConn
+	gtid  string
+	hooks []*commitHookEntry
+}
+
+// addCommitHooks registers the hooks carried by ctx which are not registered yet.
+func (tx *mysqlTx) addCommitHooks(ctx context.Context) {
+	entry, _ := ctx.Value(commitHookKey{}).(*commitHookEntry)
+	var added []*commitHookEntry
+	for ; entry != nil; entry = entry.parent {
+		if tx.hasCommitHook(entry) {
+			// the parents were registered together with entry
+			break
+		}
+		added = append(added, entry)
+	}
+	for i := len(added) - 1; i >= 0; i-- {
+		tx.hooks = append(tx.hooks, added[i])
+	}
+}
+
+func (tx *mysqlTx) hasCommitHook(entry *commitHookEntry) bool {
+	for _, e := range tx.hooks {
+		if e == entry {
+			return true
+		}
+	}
+	return false
 }
 
 func (tx *mysqlTx) Commit() (err error) {
@@ -18,9 +81,15 @@ func (tx *mysqlTx) Commit() (err error) {
 		return ErrInvalidConn
 	}
 	err = tx.mc.exec("COMMIT")
-	tx.GTID = tx.mc.GTID
+	tx.gtid = tx.mc.GTID
 	tx.mc.GTID = ""
+	tx.mc.tx = nil
 	tx.mc = nil
+	if err == nil {
+		for _, entry := range tx.hooks {
+			entry.hook(tx.gtid)
+		}
+	}
 	return
 }
 
@@ -29,6 +98,7 @@ func (tx *mysqlTx) Rollback() (err error) {
 		return ErrInvalidConn
 	}
 	err = tx.mc.exec("ROLLBACK")
+	tx.mc.tx = nil
 	tx.mc = nil
 	return
 }
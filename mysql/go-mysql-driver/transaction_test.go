@@ -0,0 +1,48 @@
+// Go MySQL Driver - A MySQL-Driver for Go's database/sql package
+//
+// Copyright 2012 The Go-MySQL-Driver Authors. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package mysql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAddCommitHooks(t *testing.T) {
+	var called []string
+	hook := func(name string) CommitHook {
+		return func(gtid string) { called = append(called, name+":"+gtid) }
+	}
+	ctx1 := WithCommitHook(context.Background(), hook("a"))
+	ctx2 := WithCommitHook(ctx1, hook("b"))
+	other := WithCommitHook(context.Background(), hook("c"))
+
+	tx := &mysqlTx{}
+	tx.addCommitHooks(ctx1)                 // BeginTx
+	tx.addCommitHooks(ctx2)                 // statement with a derived context
+	tx.addCommitHooks(ctx2)                 // same context again
+	tx.addCommitHooks(context.Background()) // statement without hooks
+	tx.addCommitHooks(other)                // unrelated hook
+	for _, entry := range tx.hooks {
+		entry.hook("uuid:1")
+	}
+
+	expected := []string{"a:uuid:1", "b:uuid:1", "c:uuid:1"}
+	if !reflect.DeepEqual(called, expected) {
+		t.Fatalf("expected hooks %v, got %v", expected, called)
+	}
+}
+
+func TestRegisterCommitHooksOutsideTx(t *testing.T) {
+	mc := &mysqlConn{}
+	mc.registerCommitHooks(WithCommitHook(context.Background(), func(string) {}))
+	if mc.tx != nil {
+		t.Fatal("expected no transaction")
+	}
+}
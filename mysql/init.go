@@ -22,6 +22,16 @@ func BuildDBMs(config *config.MySqlConfig) (dbms []*gorp.DbMap, err error) {
 }
 
 func buildDBM(config *config.MySqlConfig, schema string) (*gorp.DbMap, error) {
+	db, err := OpenDB(config, schema)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dbm := &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{}}
+	return dbm, nil
+}
+
+// OpenDB 根据配置打开 schema 的连接池, 用于 database/sql、sqlx、GORM, 见 SQLTransact
+func OpenDB(config *config.MySqlConfig, schema string) (*sql.DB, error) {
 	connStr := fmt.Sprintf(
 		`%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=Asia%%2FShanghai&charset=utf8mb4`,
 		config.User, config.Password, config.Host, config.Port, schema,
@@ -37,8 +47,7 @@ func buildDBM(config *config.MySqlConfig, schema string) (*gorp.DbMap, error) {
 	if connMaxLifetime > 0 {
 		db.SetConnMaxLifetime(time.Duration(connMaxLifetime) * time.Second)
 	}
-	dbm := &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{}}
-	return dbm, nil
+	return db, nil
 }
 
 var DBMList []*gorp.DbMap
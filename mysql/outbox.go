@@ -0,0 +1,105 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/config"
+	"github.com/obgnail/audit-log/types"
+	"gopkg.in/gorp.v1"
+)
+
+const defaultOutboxTable = "audit_outbox"
+
+const (
+	OutboxModeRelay = "relay" // binlog broker 将 outbox 中的审计 Context 作为 tx_info 推送
+	OutboxModeEmbed = "embed" // binlog broker 将审计 Context 附加到同一事务的 binlog event 上, 不再需要 tx_info
+)
+
+// execFunc 在事务中执行语句, 例如 gorp.Transaction.Exec、sql.Tx.Exec
+type execFunc func(query string, args ...interface{}) (sql.Result, error)
+
+// Outbox outbox 模式的 TxPusher. 审计 Context 在事务开始时写入 outbox 表(插入后立即删除, 表中不保留数据),
+// 随事务一起进入 binlog, 由 binlog broker 读取后推送 tx_info(relay, 见 broker.BinlogBroker.SetOutbox)
+// 或者附加到同一事务的 binlog event 上(embed, 见 broker.BinlogBroker.SetContextMarker).
+// 事务提交成功后审计 Context 就不会丢失, kafka 不可用时 binlog broker 会停在该位置, 恢复后继续推送
+type Outbox struct {
+	table string
+}
+
+func NewOutbox(table string) *Outbox {
+	if table == "" {
+		table = defaultOutboxTable
+	}
+	return &Outbox{table: table}
+}
+
+func (o *Outbox) Table() string {
+	return o.table
+}
+
+// PushTx tx_info 由 binlog broker 推送, 事务提交后不需要再推送
+func (o *Outbox) PushTx(txInfo *types.TxInfo) error {
+	return nil
+}
+
+// CreateTable 在 db 中创建 outbox 表, 表已存在时不做任何事情
+func (o *Outbox) CreateTable(db *sql.DB) error {
+	ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` ("+
+		"`id` BIGINT NOT NULL AUTO_INCREMENT, "+
+		"`context` TEXT NOT NULL, "+
+		"PRIMARY KEY (`id`)"+
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;", o.table)
+	if _, err := db.Exec(ddl); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// record 在事务开始时写入审计 Context. embed 模式下 broker 按事务附加 Context, marker 在事务中的位置不影响结果
+func (o *Outbox) record(exec execFunc, auditCtx string) error {
+	insert := fmt.Sprintf("INSERT INTO `%s` (`context`) VALUES (?);", o.table)
+	if _, err := exec(insert, auditCtx); err != nil {
+		return errors.Trace(err)
+	}
+	del := fmt.Sprintf("DELETE FROM `%s` WHERE `id`=LAST_INSERT_ID();", o.table)
+	if _, err := exec(del); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// recordOutbox pusher 为 Outbox 时在事务中写入审计 Context, 否则不做任何事情
+func recordOutbox(pusher TxPusher, exec execFunc, auditCtx string) error {
+	o, ok := pusher.(*Outbox)
+	if !ok {
+		return nil
+	}
+	return o.record(exec, auditCtx)
+}
+
+// DBMOutbox 不为 nil 时 DBMTransact、DBMTransactContext 使用 outbox 模式, 见 InitOutbox
+var DBMOutbox *Outbox
+
+// InitOutbox 配置中开启 outbox 时在 DBMList 的每个 schema 中创建 outbox 表, 需要在 InitDBM 之后调用
+func InitOutbox() error {
+	cfg := config.Main.Outbox
+	if cfg == nil || !cfg.Enable {
+		return nil
+	}
+	o := NewOutbox(cfg.Table)
+	if err := CreateOutboxTables(o, DBMList); err != nil {
+		return errors.Trace(err)
+	}
+	DBMOutbox = o
+	return nil
+}
+
+func CreateOutboxTables(o *Outbox, dbms []*gorp.DbMap) error {
+	for _, dbm := range dbms {
+		if err := o.CreateTable(dbm.Db); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
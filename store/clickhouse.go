@@ -0,0 +1,121 @@
+package store
+
+import (
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/types"
+	"time"
+)
+
+// ClickHouseStore 数据保存在 clickhouse 中, 表结构见 clickhouse/migrations
+type ClickHouseStore struct {
+	conn driver.Conn
+}
+
+func NewClickHouseStore(conn driver.Conn) *ClickHouseStore {
+	return &ClickHouseStore{conn: conn}
+}
+
+func (s *ClickHouseStore) Conn() driver.Conn {
+	return s.conn
+}
+
+func (s *ClickHouseStore) InsertBinlogEvents(events []types.ChBinlogEvent) error {
+	return errors.Trace(types.InsertBinlogEvents(s.conn, events))
+}
+
+func (s *ClickHouseStore) ListBinlogEvents(gtidList []string) ([]types.ChBinlogEvent, error) {
+	events, err := types.ListBinlogEvents(s.conn, gtidList)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return events, nil
+}
+
+func (s *ClickHouseStore) ListUnattributedGTIDs(since, until time.Time, limit int) ([]string, error) {
+	gtids, err := types.ListUnattributedGTIDs(s.conn, since, until, limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return gtids, nil
+}
+
+func (s *ClickHouseStore) SaveWatermark(gtidSet string) error {
+	return errors.Trace(types.SaveWatermark(s.conn, gtidSet))
+}
+
+func (s *ClickHouseStore) GetWatermark() (string, error) {
+	gtidSet, err := types.GetWatermark(s.conn)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return gtidSet, nil
+}
+
+func (s *ClickHouseStore) InsertTxInfo(info types.ChTxInfo) error {
+	return errors.Trace(types.InsertTxInfo(s.conn, info))
+}
+
+func (s *ClickHouseStore) BatchInsertTxInfo(infos []types.ChTxInfo) error {
+	return errors.Trace(types.BatchInsertTxInfo(s.conn, infos))
+}
+
+func (s *ClickHouseStore) ListPendingTxInfo(since time.Time, limit int) ([]types.ChTxInfo, error) {
+	infos, err := types.ListPendingTxInfo(s.conn, since, limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return infos, nil
+}
+
+func (s *ClickHouseStore) GetTxInfo(gtid string) (*types.ChTxInfo, error) {
+	info, err := types.GetTxInfo(s.conn, gtid)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return info, nil
+}
+
+func (s *ClickHouseStore) InsertAuditLogs(auditLogs []types.ChAuditLog) error {
+	return errors.Trace(types.InsertAuditLogs(s.conn, auditLogs))
+}
+
+func (s *ClickHouseStore) QueryAuditLogs(q *types.AuditLogQuery) ([]*types.AuditLogRecord, string, error) {
+	records, nextCursor, err := types.QueryAuditLogs(s.conn, q)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	return records, nextCursor, nil
+}
+
+func (s *ClickHouseStore) SaveDispatched(id, gtid string) error {
+	return errors.Trace(types.SaveDispatched(s.conn, id, gtid))
+}
+
+func (s *ClickHouseStore) IsDispatched(id string) (bool, error) {
+	dispatched, err := types.IsDispatched(s.conn, id)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return dispatched, nil
+}
+
+func (s *ClickHouseStore) InsertDeadLetter(letter types.ChDeadLetter) error {
+	return errors.Trace(types.InsertDeadLetter(s.conn, letter))
+}
+
+func (s *ClickHouseStore) ListDeadLetters(limit int) ([]types.ChDeadLetter, error) {
+	letters, err := types.ListDeadLetters(s.conn, limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return letters, nil
+}
+
+func (s *ClickHouseStore) DeleteDeadLetter(id string) error {
+	return errors.Trace(types.DeleteDeadLetter(s.conn, id))
+}
+
+func (s *ClickHouseStore) Close() error {
+	return errors.Trace(s.conn.Close())
+}
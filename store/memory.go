@@ -0,0 +1,250 @@
+package store
+
+import (
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/types"
+	"sort"
+	"sync"
+	"time"
+)
+
+type auditLogKey struct {
+	gtid string
+	seq  uint32
+}
+
+// MemoryStore 数据只保存在内存中, 用于单元测试
+type MemoryStore struct {
+	mu           sync.RWMutex
+	binlogEvents map[string]map[uint32]types.ChBinlogEvent // map[gtid]map[seq]event
+	txInfos      map[string]types.ChTxInfo                 // map[gtid]info
+	auditLogs    map[auditLogKey]types.ChAuditLog
+	deadLetters  map[string]types.ChDeadLetter // map[id]letter
+	watermark    string
+	dispatched   map[string]struct{} // map[audit log id]
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		binlogEvents: make(map[string]map[uint32]types.ChBinlogEvent),
+		txInfos:      make(map[string]types.ChTxInfo),
+		auditLogs:    make(map[auditLogKey]types.ChAuditLog),
+		deadLetters:  make(map[string]types.ChDeadLetter),
+		dispatched:   make(map[string]struct{}),
+	}
+}
+
+func (s *MemoryStore) InsertBinlogEvents(events []types.ChBinlogEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range events {
+		// 与 clickhouse、sqlite 相同, 重新消费的 event 覆盖之前的数据
+		seqs, ok := s.binlogEvents[event.GTID]
+		if !ok {
+			seqs = make(map[uint32]types.ChBinlogEvent)
+			s.binlogEvents[event.GTID] = seqs
+		}
+		seqs[event.Seq] = event
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListBinlogEvents(gtidList []string) ([]types.ChBinlogEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []types.ChBinlogEvent
+	for _, gtid := range gtidList {
+		for _, event := range s.binlogEvents[gtid] {
+			result = append(result, event)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.GTID != b.GTID {
+			return a.GTID < b.GTID
+		}
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		if a.LogFile != b.LogFile {
+			return a.LogFile < b.LogFile
+		}
+		return a.LogPos < b.LogPos
+	})
+	return result, nil
+}
+
+func (s *MemoryStore) ListUnattributedGTIDs(since, until time.Time, limit int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	gtids := make([]string, 0)
+	for gtid, events := range s.binlogEvents {
+		if len(gtids) >= limit {
+			break
+		}
+		if _, ok := s.txInfos[gtid]; ok {
+			continue
+		}
+		for _, event := range events {
+			if !event.Time.Before(since) && event.Time.Before(until) {
+				gtids = append(gtids, gtid)
+				break
+			}
+		}
+	}
+	return gtids, nil
+}
+
+func (s *MemoryStore) SaveWatermark(gtidSet string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watermark = gtidSet
+	return nil
+}
+
+func (s *MemoryStore) GetWatermark() (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.watermark, nil
+}
+
+func (s *MemoryStore) InsertTxInfo(info types.ChTxInfo) error {
+	return s.BatchInsertTxInfo([]types.ChTxInfo{info})
+}
+
+func (s *MemoryStore) BatchInsertTxInfo(infos []types.ChTxInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, info := range infos {
+		if old, ok := s.txInfos[info.GTID]; ok && old.Version > info.Version {
+			continue
+		}
+		s.txInfos[info.GTID] = info
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListPendingTxInfo(since time.Time, limit int) ([]types.ChTxInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]types.ChTxInfo, 0)
+	for _, info := range s.txInfos {
+		if info.Status == types.StatusTxInfoPending && !info.Time.Before(since) {
+			result = append(result, info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) GetTxInfo(gtid string) (*types.ChTxInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.txInfos[gtid]
+	if !ok {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+func (s *MemoryStore) InsertAuditLogs(auditLogs []types.ChAuditLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range auditLogs {
+		s.auditLogs[auditLogKey{gtid: l.GTID, seq: l.Seq}] = l
+	}
+	return nil
+}
+
+func (s *MemoryStore) QueryAuditLogs(q *types.AuditLogQuery) ([]*types.AuditLogRecord, string, error) {
+	filter, err := q.Filter()
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+
+	s.mu.RLock()
+	rows := make([]types.ChAuditLog, 0)
+	for _, l := range s.auditLogs {
+		if filter(&l) {
+			rows = append(rows, l)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.After(b.Time)
+		}
+		if a.GTID != b.GTID {
+			return a.GTID > b.GTID
+		}
+		return a.Seq > b.Seq
+	})
+	limit := q.PageLimit()
+	if len(rows) > limit+1 {
+		rows = rows[:limit+1]
+	}
+	records, nextCursor, err := types.NewAuditLogPage(rows, limit)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	return records, nextCursor, nil
+}
+
+func (s *MemoryStore) SaveDispatched(id, gtid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dispatched[id] = struct{}{}
+	return nil
+}
+
+func (s *MemoryStore) IsDispatched(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.dispatched[id]
+	return ok, nil
+}
+
+func (s *MemoryStore) InsertDeadLetter(letter types.ChDeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetters[letter.ID] = letter
+	return nil
+}
+
+func (s *MemoryStore) ListDeadLetters(limit int) ([]types.ChDeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]types.ChDeadLetter, 0, len(s.deadLetters))
+	for _, letter := range s.deadLetters {
+		result = append(result, letter)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FirstFailedAt.Before(result[j].FirstFailedAt)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) DeleteDeadLetter(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deadLetters, id)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
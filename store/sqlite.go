@@ -0,0 +1,459 @@
+//go:build sqlite
+// +build sqlite
+
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/types"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteSchema = []string{
+	"CREATE TABLE IF NOT EXISTS binlog_event (" +
+		"db TEXT NOT NULL, `table` TEXT NOT NULL, action INTEGER NOT NULL, gtid TEXT NOT NULL, " +
+		"data TEXT NOT NULL, time INTEGER NOT NULL, seq INTEGER NOT NULL, " +
+		"log_file TEXT NOT NULL, log_pos INTEGER NOT NULL, row_count INTEGER NOT NULL DEFAULT 0);",
+	"CREATE INDEX IF NOT EXISTS idx_binlog_event_gtid ON binlog_event (gtid);",
+	// 重新消费的 binlog event 覆盖之前的数据, 创建唯一索引前先删除已有的重复数据
+	"DELETE FROM binlog_event WHERE rowid NOT IN (SELECT MAX(rowid) FROM binlog_event GROUP BY gtid, seq);",
+	"CREATE UNIQUE INDEX IF NOT EXISTS uk_binlog_event_gtid_seq ON binlog_event (gtid, seq);",
+	"CREATE INDEX IF NOT EXISTS idx_binlog_event_time ON binlog_event (time);",
+
+	"CREATE TABLE IF NOT EXISTS binlog_watermark (id INTEGER PRIMARY KEY, gtid_set TEXT NOT NULL, updated_at INTEGER NOT NULL);",
+
+	"CREATE TABLE IF NOT EXISTS tx_info (" +
+		"gtid TEXT PRIMARY KEY, context TEXT NOT NULL, time INTEGER NOT NULL, `status` INTEGER NOT NULL, " +
+		"version INTEGER NOT NULL DEFAULT 0);",
+	"CREATE INDEX IF NOT EXISTS idx_tx_info_status_time ON tx_info (`status`, time);",
+
+	"CREATE TABLE IF NOT EXISTS audit_log (" +
+		"gtid TEXT NOT NULL, seq INTEGER NOT NULL, time INTEGER NOT NULL, context TEXT NOT NULL, " +
+		"context_type INTEGER NOT NULL, context_param_1 TEXT NOT NULL, context_param_2 TEXT NOT NULL, " +
+		"db TEXT NOT NULL, `table` TEXT NOT NULL, action INTEGER NOT NULL, " +
+		"primary_key TEXT NOT NULL, columns TEXT NOT NULL, PRIMARY KEY (gtid, seq));",
+	"CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log (time, gtid, seq);",
+
+	"CREATE TABLE IF NOT EXISTS audit_log_dispatched (" +
+		"id TEXT PRIMARY KEY, gtid TEXT NOT NULL, dispatched_at INTEGER NOT NULL);",
+
+	"CREATE TABLE IF NOT EXISTS dead_letter (" +
+		"id TEXT PRIMARY KEY, gtid TEXT NOT NULL, audit_log TEXT NOT NULL, error TEXT NOT NULL, " +
+		"attempts INTEGER NOT NULL, first_failed_at INTEGER NOT NULL, last_failed_at INTEGER NOT NULL);",
+}
+
+// sqliteAddColumns 之后加入的字段, 用于升级已有的数据库文件, 字段已存在时忽略
+var sqliteAddColumns = []string{
+	"ALTER TABLE binlog_event ADD COLUMN row_count INTEGER NOT NULL DEFAULT 0;",
+	"ALTER TABLE tx_info ADD COLUMN version INTEGER NOT NULL DEFAULT 0;",
+}
+
+// SQLiteStore 数据保存在内嵌的 sqlite 数据库中, 用于小规模部署. 时间以 unix 毫秒保存
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (Store, error) {
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return s, nil
+}
+
+// NewSQLiteStore 打开 path 对应的数据库并创建表, path 为 ":memory:" 时使用内存数据库
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// sqlite 同一时间只允许一个写入者, 内存数据库在不同连接之间也不共享
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	for _, stmt := range sqliteAddColumns {
+		if _, err := db.Exec(stmt); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return errors.Trace(err)
+	}
+	return errors.Trace(tx.Commit())
+}
+
+func (s *SQLiteStore) InsertBinlogEvents(events []types.ChBinlogEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return s.withTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("INSERT OR REPLACE INTO binlog_event " +
+			"(db, `table`, action, gtid, data, time, seq, log_file, log_pos, row_count) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer stmt.Close()
+		for _, e := range events {
+			_, err := stmt.Exec(e.Db, e.Table, e.Action, e.GTID, e.Data, e.Time.UnixMilli(), e.Seq, e.LogFile, e.LogPos, e.RowCount)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) ListBinlogEvents(gtidList []string) ([]types.ChBinlogEvent, error) {
+	if len(gtidList) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(gtidList))
+	for i, gtid := range gtidList {
+		args[i] = gtid
+	}
+	query := "SELECT db, `table`, action, gtid, data, time, seq, log_file, log_pos, row_count FROM binlog_event " +
+		"WHERE gtid IN (" + placeholders(len(gtidList)) + ") ORDER BY gtid, seq, log_file, log_pos;"
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var result []types.ChBinlogEvent
+	for rows.Next() {
+		var (
+			e types.ChBinlogEvent
+			t int64
+		)
+		if err := rows.Scan(&e.Db, &e.Table, &e.Action, &e.GTID, &e.Data, &t, &e.Seq, &e.LogFile, &e.LogPos, &e.RowCount); err != nil {
+			return nil, errors.Trace(err)
+		}
+		e.Time = time.UnixMilli(t)
+		result = append(result, e)
+	}
+	return result, errors.Trace(rows.Err())
+}
+
+func (s *SQLiteStore) ListUnattributedGTIDs(since, until time.Time, limit int) ([]string, error) {
+	query := "SELECT DISTINCT gtid FROM binlog_event " +
+		"WHERE time>=? AND time<? AND gtid NOT IN (SELECT gtid FROM tx_info) LIMIT ?;"
+	rows, err := s.db.Query(query, since.UnixMilli(), until.UnixMilli(), limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	gtids := make([]string, 0)
+	for rows.Next() {
+		var gtid string
+		if err := rows.Scan(&gtid); err != nil {
+			return nil, errors.Trace(err)
+		}
+		gtids = append(gtids, gtid)
+	}
+	return gtids, errors.Trace(rows.Err())
+}
+
+func (s *SQLiteStore) SaveWatermark(gtidSet string) error {
+	query := "INSERT OR REPLACE INTO binlog_watermark (id, gtid_set, updated_at) VALUES (0, ?, ?);"
+	if _, err := s.db.Exec(query, gtidSet, time.Now().UnixMilli()); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetWatermark() (string, error) {
+	var gtidSet string
+	err := s.db.QueryRow("SELECT gtid_set FROM binlog_watermark WHERE id=0;").Scan(&gtidSet)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return gtidSet, nil
+}
+
+func (s *SQLiteStore) InsertTxInfo(info types.ChTxInfo) error {
+	return s.BatchInsertTxInfo([]types.ChTxInfo{info})
+}
+
+// BatchInsertTxInfo 只有版本号不小于已有数据时才会覆盖
+func (s *SQLiteStore) BatchInsertTxInfo(infos []types.ChTxInfo) error {
+	if len(infos) == 0 {
+		return nil
+	}
+	return s.withTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("INSERT INTO tx_info (gtid, context, time, `status`, version) VALUES (?, ?, ?, ?, ?) " +
+			"ON CONFLICT (gtid) DO UPDATE SET context=excluded.context, time=excluded.time, " +
+			"`status`=excluded.`status`, version=excluded.version WHERE excluded.version>=tx_info.version;")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer stmt.Close()
+		for _, info := range infos {
+			if _, err := stmt.Exec(info.GTID, info.Context, info.Time.UnixMilli(), info.Status, int64(info.Version)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) ListPendingTxInfo(since time.Time, limit int) ([]types.ChTxInfo, error) {
+	query := "SELECT gtid, context, time, `status`, version FROM tx_info " +
+		"WHERE `status`=? AND time>=? ORDER BY time DESC LIMIT ?;"
+	rows, err := s.db.Query(query, types.StatusTxInfoPending, since.UnixMilli(), limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	result := make([]types.ChTxInfo, 0)
+	for rows.Next() {
+		info, err := scanTxInfo(rows)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		result = append(result, info)
+	}
+	return result, errors.Trace(rows.Err())
+}
+
+func (s *SQLiteStore) GetTxInfo(gtid string) (*types.ChTxInfo, error) {
+	query := "SELECT gtid, context, time, `status`, version FROM tx_info WHERE gtid=?;"
+	info, err := scanTxInfo(s.db.QueryRow(query, gtid))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &info, nil
+}
+
+// rowScanner *sql.Row 或 *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTxInfo(row rowScanner) (types.ChTxInfo, error) {
+	var (
+		info    types.ChTxInfo
+		t       int64
+		version int64
+	)
+	if err := row.Scan(&info.GTID, &info.Context, &t, &info.Status, &version); err != nil {
+		return info, err
+	}
+	info.Time = time.UnixMilli(t)
+	info.Version = uint64(version)
+	return info, nil
+}
+
+func (s *SQLiteStore) InsertAuditLogs(auditLogs []types.ChAuditLog) error {
+	if len(auditLogs) == 0 {
+		return nil
+	}
+	return s.withTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("INSERT OR REPLACE INTO audit_log " +
+			"(gtid, seq, time, context, context_type, context_param_1, context_param_2, " +
+			"db, `table`, action, primary_key, columns) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer stmt.Close()
+		for _, l := range auditLogs {
+			_, err := stmt.Exec(l.GTID, l.Seq, l.Time.UnixMilli(), l.Context, l.ContextType, l.ContextParam1,
+				l.ContextParam2, l.Db, l.Table, l.Action, l.PrimaryKey, l.Columns)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) QueryAuditLogs(q *types.AuditLogQuery) ([]*types.AuditLogRecord, string, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	addCond := func(cond string, values ...interface{}) {
+		conds = append(conds, cond)
+		args = append(args, values...)
+	}
+
+	if !q.StartTime.IsZero() {
+		addCond("time>=?", q.StartTime.UnixMilli())
+	}
+	if !q.EndTime.IsZero() {
+		addCond("time<?", q.EndTime.UnixMilli())
+	}
+	if q.ContextType != nil {
+		addCond("context_type=?", int64(*q.ContextType))
+	}
+	if q.ContextParam1 != "" {
+		addCond("context_param_1=?", q.ContextParam1)
+	}
+	if q.ContextParam2 != "" {
+		addCond("context_param_2=?", q.ContextParam2)
+	}
+	if q.Db != "" {
+		addCond("db=?", q.Db)
+	}
+	if q.Table != "" {
+		addCond("`table`=?", q.Table)
+	}
+	if q.Action != nil {
+		addCond("action=?", int32(*q.Action))
+	}
+	pkConds, err := q.PrimaryKeyConds()
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	for _, cond := range pkConds {
+		// 按字段比较, 与 json 中 key 的顺序和数字的类型无关
+		path := `$."` + strings.ReplaceAll(cond.Column, `"`, `\"`) + `"`
+		addCond("CAST(json_extract(primary_key, ?) AS TEXT)=?", path, cond.Value)
+	}
+	cursor, err := q.DecodeCursor()
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	if cursor != nil {
+		addCond("(time, gtid, seq)<(?, ?, ?)", cursor.Time, cursor.GTID, cursor.Seq)
+	}
+
+	limit := q.PageLimit()
+	var query strings.Builder
+	query.WriteString("SELECT gtid, seq, time, context, context_type, context_param_1, context_param_2, " +
+		"db, `table`, action, primary_key, columns FROM audit_log")
+	if len(conds) != 0 {
+		query.WriteString(" WHERE ")
+		query.WriteString(strings.Join(conds, " AND "))
+	}
+	// 多查一条用于判断是否还有下一页
+	query.WriteString(fmt.Sprintf(" ORDER BY time DESC, gtid DESC, seq DESC LIMIT %d;", limit+1))
+
+	rows, err := s.db.Query(query.String(), args...)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	defer rows.Close()
+
+	result := make([]types.ChAuditLog, 0)
+	for rows.Next() {
+		var (
+			l types.ChAuditLog
+			t int64
+		)
+		err := rows.Scan(&l.GTID, &l.Seq, &t, &l.Context, &l.ContextType, &l.ContextParam1, &l.ContextParam2,
+			&l.Db, &l.Table, &l.Action, &l.PrimaryKey, &l.Columns)
+		if err != nil {
+			return nil, "", errors.Trace(err)
+		}
+		l.Time = time.UnixMilli(t)
+		result = append(result, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", errors.Trace(err)
+	}
+
+	records, nextCursor, err := types.NewAuditLogPage(result, limit)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	return records, nextCursor, nil
+}
+
+func (s *SQLiteStore) SaveDispatched(id, gtid string) error {
+	query := "INSERT OR REPLACE INTO audit_log_dispatched (id, gtid, dispatched_at) VALUES (?, ?, ?);"
+	if _, err := s.db.Exec(query, id, gtid, time.Now().UnixMilli()); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) IsDispatched(id string) (bool, error) {
+	var count int
+	if err := s.db.QueryRow("SELECT count(*) FROM audit_log_dispatched WHERE id=?;", id).Scan(&count); err != nil {
+		return false, errors.Trace(err)
+	}
+	return count > 0, nil
+}
+
+func (s *SQLiteStore) InsertDeadLetter(letter types.ChDeadLetter) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO dead_letter "+
+		"(id, gtid, audit_log, error, attempts, first_failed_at, last_failed_at) VALUES (?, ?, ?, ?, ?, ?, ?);",
+		letter.ID,
+		letter.GTID,
+		letter.AuditLog,
+		letter.Error,
+		letter.Attempts,
+		letter.FirstFailedAt.UnixMilli(),
+		letter.LastFailedAt.UnixMilli(),
+	)
+	return errors.Trace(err)
+}
+
+func (s *SQLiteStore) ListDeadLetters(limit int) ([]types.ChDeadLetter, error) {
+	if limit <= 0 {
+		// sqlite 中 LIMIT 为负数时不限制
+		limit = -1
+	}
+	rows, err := s.db.Query("SELECT id, gtid, audit_log, error, attempts, first_failed_at, last_failed_at "+
+		"FROM dead_letter ORDER BY first_failed_at LIMIT ?;", limit)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	result := make([]types.ChDeadLetter, 0)
+	for rows.Next() {
+		var (
+			l                           types.ChDeadLetter
+			firstFailedAt, lastFailedAt int64
+		)
+		if err := rows.Scan(&l.ID, &l.GTID, &l.AuditLog, &l.Error, &l.Attempts, &firstFailedAt, &lastFailedAt); err != nil {
+			return nil, errors.Trace(err)
+		}
+		l.FirstFailedAt = time.UnixMilli(firstFailedAt)
+		l.LastFailedAt = time.UnixMilli(lastFailedAt)
+		result = append(result, l)
+	}
+	return result, errors.Trace(rows.Err())
+}
+
+func (s *SQLiteStore) DeleteDeadLetter(id string) error {
+	_, err := s.db.Exec("DELETE FROM dead_letter WHERE id=?;", id)
+	return errors.Trace(err)
+}
+
+func (s *SQLiteStore) Close() error {
+	return errors.Trace(s.db.Close())
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
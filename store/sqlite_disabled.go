@@ -0,0 +1,12 @@
+//go:build !sqlite
+// +build !sqlite
+
+package store
+
+import (
+	"github.com/juju/errors"
+)
+
+func newSQLiteStore(path string) (Store, error) {
+	return nil, errors.New("sqlite store is not compiled in, build with -tags sqlite")
+}
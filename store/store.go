@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/clickhouse"
+	"github.com/obgnail/audit-log/config"
+	"github.com/obgnail/audit-log/types"
+	"time"
+)
+
+const (
+	TypeClickHouse = "clickhouse"
+	TypeSQLite     = "sqlite"
+	TypeMemory     = "memory"
+)
+
+// Store binlog_event、tx_info、audit_log 以及死信的存储.
+// 写入相同主键(binlog_event 为 (gtid, seq))的数据时, 新数据覆盖旧数据; tx_info 保留版本号最大的数据
+type Store interface {
+	InsertBinlogEvents(events []types.ChBinlogEvent) error
+	// ListBinlogEvents 返回多个事务中的所有 binlog event, 同一个事务中的 event 按照执行的顺序排列
+	ListBinlogEvents(gtidList []string) ([]types.ChBinlogEvent, error)
+	// ListUnattributedGTIDs 返回 [since, until) 时间内有 binlog event 但没有 tx_info 的事务, 最多 limit 个
+	ListUnattributedGTIDs(since, until time.Time, limit int) ([]string, error)
+
+	// SaveWatermark 保存已经写入 store 的 GTID 集合, 见 types.Watermark
+	SaveWatermark(gtidSet string) error
+	// GetWatermark 返回最近一次保存的 GTID 集合, 没有保存过时返回空字符串
+	GetWatermark() (string, error)
+
+	InsertTxInfo(info types.ChTxInfo) error
+	BatchInsertTxInfo(infos []types.ChTxInfo) error
+	// ListPendingTxInfo 返回 since 之后最新版本为 pending 的 tx_info, 按照时间从新到旧排列, 最多 limit 条
+	ListPendingTxInfo(since time.Time, limit int) ([]types.ChTxInfo, error)
+	// GetTxInfo 返回 gtid 最新版本的 tx_info, 不存在时返回 nil
+	GetTxInfo(gtid string) (*types.ChTxInfo, error)
+
+	InsertAuditLogs(auditLogs []types.ChAuditLog) error
+	// QueryAuditLogs 按照时间从新到旧查询审计日志, nextCursor 为空表示没有更多数据
+	QueryAuditLogs(q *types.AuditLogQuery) (records []*types.AuditLogRecord, nextCursor string, err error)
+
+	// SaveDispatched 记录已经交给 handler 的审计日志, 见 types.AuditLogID
+	SaveDispatched(id, gtid string) error
+	// IsDispatched 审计日志是否已经交给过 handler
+	IsDispatched(id string) (bool, error)
+
+	InsertDeadLetter(letter types.ChDeadLetter) error
+	// ListDeadLetters 按首次失败时间从早到晚列出最多 limit 条死信, limit <= 0 时列出全部
+	ListDeadLetters(limit int) ([]types.ChDeadLetter, error)
+	DeleteDeadLetter(id string) error
+
+	Close() error
+}
+
+// New 根据配置创建 Store, 未配置 store 时使用 clickhouse. sqlite 需要使用 -tags sqlite 编译(依赖 cgo)
+func New(cfg *config.MainConfig) (Store, error) {
+	typ := TypeClickHouse
+	if cfg.Store != nil && cfg.Store.Type != "" {
+		typ = cfg.Store.Type
+	}
+
+	switch typ {
+	case TypeClickHouse:
+		conn, err := clickhouse.New(cfg.ClickHouse)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return NewClickHouseStore(conn), nil
+	case TypeSQLite:
+		s, err := newSQLiteStore(cfg.Store.Path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return s, nil
+	case TypeMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", typ)
+	}
+}
+
+var S Store
+
+func InitStore() (err error) {
+	S, err = New(config.Main)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/obgnail/audit-log/types"
+)
+
+// testTime 毫秒精度的时间, sqlite 只保存到毫秒
+var testTime = time.UnixMilli(1700000000000)
+
+// testStoreContract 验证 Store 接口的约定, 每个 Store 的实现都需要通过. newStore 每次返回一个空的 Store
+func testStoreContract(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("binlog events", func(t *testing.T) { testBinlogEvents(t, newStore(t)) })
+	t.Run("unattributed gtids", func(t *testing.T) { testUnattributedGTIDs(t, newStore(t)) })
+	t.Run("watermark", func(t *testing.T) { testWatermark(t, newStore(t)) })
+	t.Run("tx info", func(t *testing.T) { testTxInfo(t, newStore(t)) })
+	t.Run("audit logs", func(t *testing.T) { testAuditLogs(t, newStore(t)) })
+	t.Run("dispatched", func(t *testing.T) { testDispatched(t, newStore(t)) })
+	t.Run("dead letters", func(t *testing.T) { testDeadLetters(t, newStore(t)) })
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStoreContract(t, func(*testing.T) Store { return NewMemoryStore() })
+}
+
+func binlogEvent(gtid string, seq, logPos uint32, rowCount uint32) types.ChBinlogEvent {
+	return types.ChBinlogEvent{
+		Db:       "shop",
+		Table:    "user",
+		Action:   int32(types.EventActionInsert),
+		GTID:     gtid,
+		Data:     "{}",
+		Time:     testTime,
+		Seq:      seq,
+		LogFile:  "mysql-bin.000001",
+		LogPos:   logPos,
+		RowCount: rowCount,
+	}
+}
+
+func testBinlogEvents(t *testing.T, s Store) {
+	events := []types.ChBinlogEvent{
+		binlogEvent("uuid:2", 0, 300, 1),
+		binlogEvent("uuid:1", 1, 200, 2),
+		binlogEvent("uuid:1", 0, 100, 2),
+	}
+	if err := s.InsertBinlogEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	// 重新消费写入的 event 按 (gtid, seq) 覆盖, 其他列不同也不会重复
+	redelivered := binlogEvent("uuid:1", 0, 150, 2)
+	redelivered.Time = testTime.Add(time.Second)
+	if err := s.InsertBinlogEvents([]types.ChBinlogEvent{redelivered}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.ListBinlogEvents([]string{"uuid:1", "uuid:2", "uuid:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type key struct {
+		gtid   string
+		seq    uint32
+		logPos uint32
+	}
+	want := []key{{"uuid:1", 0, 150}, {"uuid:1", 1, 200}, {"uuid:2", 0, 300}}
+	keys := make([]key, 0, len(got))
+	for _, event := range got {
+		keys = append(keys, key{event.GTID, event.Seq, event.LogPos})
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("ListBinlogEvents = %v, want %v", keys, want)
+	}
+	if !got[0].Time.Equal(redelivered.Time) || got[0].RowCount != 2 {
+		t.Fatalf("redelivered event = %+v, want %+v", got[0], redelivered)
+	}
+	if !types.CompleteBinlogEvents(got[:2]) {
+		t.Fatalf("events of uuid:1 not complete: %+v", got[:2])
+	}
+
+	if got, err := s.ListBinlogEvents(nil); err != nil || len(got) != 0 {
+		t.Fatalf("ListBinlogEvents(nil) = %v, %v, want empty", got, err)
+	}
+}
+
+func testUnattributedGTIDs(t *testing.T, s Store) {
+	var events []types.ChBinlogEvent
+	for i, gtid := range []string{"uuid:1", "uuid:2", "uuid:3", "uuid:4"} {
+		event := binlogEvent(gtid, 0, 100, 1)
+		event.Time = testTime.Add(time.Duration(i) * time.Minute)
+		events = append(events, event)
+	}
+	if err := s.InsertBinlogEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertTxInfo(types.NewChTxInfo(testTime, "ctx", "uuid:2", types.StatusTxInfoPending)); err != nil {
+		t.Fatal(err)
+	}
+
+	// [since, until) 只包含 uuid:1 到 uuid:3, uuid:2 已经有 tx_info
+	since, until := testTime, testTime.Add(3*time.Minute)
+	got, err := s.ListUnattributedGTIDs(since, until, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameStrings(got, []string{"uuid:1", "uuid:3"}) {
+		t.Fatalf("ListUnattributedGTIDs = %v, want [uuid:1 uuid:3]", got)
+	}
+	if got, err := s.ListUnattributedGTIDs(since, until, 1); err != nil || len(got) != 1 {
+		t.Fatalf("ListUnattributedGTIDs with limit 1 = %v, %v", got, err)
+	}
+}
+
+// sameStrings 不考虑顺序比较
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		if count[s]--; count[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func testWatermark(t *testing.T, s Store) {
+	if got, err := s.GetWatermark(); err != nil || got != "" {
+		t.Fatalf("GetWatermark before save = %q, %v, want empty", got, err)
+	}
+	for _, gtidSet := range []string{"uuid:1-5", "uuid:1-9"} {
+		if err := s.SaveWatermark(gtidSet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := s.GetWatermark(); err != nil || got != "uuid:1-9" {
+		t.Fatalf("GetWatermark = %q, %v, want uuid:1-9", got, err)
+	}
+}
+
+func testTxInfo(t *testing.T, s Store) {
+	if got, err := s.GetTxInfo("uuid:1"); err != nil || got != nil {
+		t.Fatalf("GetTxInfo before insert = %v, %v, want nil", got, err)
+	}
+
+	pending := types.NewChTxInfo(testTime, "ctx", "uuid:1", types.StatusTxInfoPending)
+	processed, err := pending.Transit(types.StatusTxInfoProcessed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 版本更大的数据先写入, 之后写入的旧版本不会覆盖
+	if err := s.InsertTxInfo(processed); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertTxInfo(pending); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetTxInfo("uuid:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Status != types.StatusTxInfoProcessed || got.Version != processed.Version || !got.Time.Equal(testTime) {
+		t.Fatalf("GetTxInfo = %+v, want %+v", got, processed)
+	}
+
+	infos := []types.ChTxInfo{
+		types.NewChTxInfo(testTime.Add(-time.Hour), "ctx", "uuid:2", types.StatusTxInfoPending),
+		types.NewChTxInfo(testTime.Add(time.Minute), "ctx", "uuid:3", types.StatusTxInfoPending),
+		types.NewChTxInfo(testTime.Add(2*time.Minute), "ctx", "uuid:4", types.StatusTxInfoPending),
+		types.NewChTxInfo(testTime.Add(3*time.Minute), "ctx", "uuid:5", types.StatusTxInfoIgnored),
+	}
+	if err := s.BatchInsertTxInfo(infos); err != nil {
+		t.Fatal(err)
+	}
+	// since 之后的 pending, 按时间从新到旧; 已经转移到其他状态的不返回
+	list, err := s.ListPendingTxInfo(testTime, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gtids := txInfoGTIDs(list); !reflect.DeepEqual(gtids, []string{"uuid:4", "uuid:3"}) {
+		t.Fatalf("ListPendingTxInfo = %v, want [uuid:4 uuid:3]", gtids)
+	}
+	list, err = s.ListPendingTxInfo(testTime, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gtids := txInfoGTIDs(list); !reflect.DeepEqual(gtids, []string{"uuid:4"}) {
+		t.Fatalf("ListPendingTxInfo with limit 1 = %v, want [uuid:4]", gtids)
+	}
+}
+
+func txInfoGTIDs(infos []types.ChTxInfo) []string {
+	gtids := make([]string, 0, len(infos))
+	for _, info := range infos {
+		gtids = append(gtids, info.GTID)
+	}
+	return gtids
+}
+
+func auditLogRow(gtid string, seq uint32, t time.Time, table string) types.ChAuditLog {
+	return types.ChAuditLog{
+		GTID:       gtid,
+		Seq:        seq,
+		Time:       t,
+		Context:    "ctx",
+		Db:         "shop",
+		Table:      table,
+		Action:     int32(types.EventActionInsert),
+		PrimaryKey: `{"id":1}`,
+		Columns:    `[]`,
+	}
+}
+
+func testAuditLogs(t *testing.T, s Store) {
+	rows := []types.ChAuditLog{
+		auditLogRow("uuid:1", 0, testTime, "user"),
+		auditLogRow("uuid:1", 1, testTime, "order"),
+		auditLogRow("uuid:2", 0, testTime.Add(time.Minute), "user"),
+	}
+	if err := s.InsertAuditLogs(rows); err != nil {
+		t.Fatal(err)
+	}
+	// 相同的 (gtid, seq) 覆盖
+	overwrite := auditLogRow("uuid:1", 0, testTime, "user")
+	overwrite.Context = "new ctx"
+	if err := s.InsertAuditLogs([]types.ChAuditLog{overwrite}); err != nil {
+		t.Fatal(err)
+	}
+
+	type key struct {
+		gtid string
+		seq  int
+	}
+	var (
+		got    []key
+		cursor string
+		pages  int
+	)
+	for {
+		records, next, err := s.QueryAuditLogs(&types.AuditLogQuery{Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			got = append(got, key{r.GTID, r.Seq})
+			if r.GTID == "uuid:1" && r.Seq == 0 && r.Context != "new ctx" {
+				t.Fatalf("overwritten audit log context = %s", r.Context)
+			}
+		}
+		pages++
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	want := []key{{"uuid:2", 0}, {"uuid:1", 1}, {"uuid:1", 0}}
+	if !reflect.DeepEqual(got, want) || pages != 2 {
+		t.Fatalf("QueryAuditLogs = %v in %d pages, want %v in 2 pages", got, pages, want)
+	}
+
+	records, _, err := s.QueryAuditLogs(&types.AuditLogQuery{Table: "order"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].GTID != "uuid:1" || records[0].Seq != 1 {
+		t.Fatalf("QueryAuditLogs by table = %+v", records)
+	}
+}
+
+func testDispatched(t *testing.T, s Store) {
+	if ok, err := s.IsDispatched("id"); err != nil || ok {
+		t.Fatalf("IsDispatched before save = %v, %v", ok, err)
+	}
+	// 重复保存不会出错
+	for i := 0; i < 2; i++ {
+		if err := s.SaveDispatched("id", "uuid:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := s.IsDispatched("id"); err != nil || !ok {
+		t.Fatalf("IsDispatched = %v, %v, want true", ok, err)
+	}
+}
+
+func deadLetter(id string, firstFailedAt time.Time, attempts uint32) types.ChDeadLetter {
+	return types.ChDeadLetter{
+		ID:            id,
+		GTID:          "uuid:" + id,
+		AuditLog:      "{}",
+		Error:         "handle failed",
+		Attempts:      attempts,
+		FirstFailedAt: firstFailedAt,
+		LastFailedAt:  firstFailedAt,
+	}
+}
+
+func testDeadLetters(t *testing.T, s Store) {
+	letters := []types.ChDeadLetter{
+		deadLetter("2", testTime.Add(time.Minute), 1),
+		deadLetter("3", testTime.Add(2*time.Minute), 1),
+		deadLetter("1", testTime, 1),
+	}
+	for _, letter := range letters {
+		if err := s.InsertDeadLetter(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 相同的 ID 覆盖
+	if err := s.InsertDeadLetter(deadLetter("1", testTime, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		limit int
+		want  []string
+	}{
+		{limit: 2, want: []string{"1", "2"}},
+		{limit: 10, want: []string{"1", "2", "3"}},
+		{limit: 0, want: []string{"1", "2", "3"}},
+		{limit: -1, want: []string{"1", "2", "3"}},
+	}
+	for _, c := range cases {
+		got, err := s.ListDeadLetters(c.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := deadLetterIDs(got); !reflect.DeepEqual(ids, c.want) {
+			t.Fatalf("ListDeadLetters(%d) = %v, want %v", c.limit, ids, c.want)
+		}
+		if got[0].Attempts != 3 || !got[0].FirstFailedAt.Equal(testTime) {
+			t.Fatalf("overwritten dead letter = %+v", got[0])
+		}
+	}
+
+	if err := s.DeleteDeadLetter("2"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.ListDeadLetters(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := deadLetterIDs(got); !reflect.DeepEqual(ids, []string{"1", "3"}) {
+		t.Fatalf("ListDeadLetters after delete = %v, want [1 3]", ids)
+	}
+}
+
+func deadLetterIDs(letters []types.ChDeadLetter) []string {
+	ids := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		ids = append(ids, letter.ID)
+	}
+	return ids
+}
@@ -1,13 +1,15 @@
 package syncer
 
 import (
+	"context"
 	"github.com/juju/errors"
 	"github.com/obgnail/audit-log/broker"
 	"github.com/obgnail/audit-log/config"
 	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/store"
 	"github.com/obgnail/audit-log/types"
-	"github.com/obgnail/mysql-river/handler/kafka"
 	"github.com/obgnail/mysql-river/river"
+	"sync"
 	"time"
 )
 
@@ -15,27 +17,77 @@ const (
 	defaultSyncChanSize      = 1024
 	defaultBulkSize          = 512
 	defaultBatchSendInterval = 1 * time.Second
+
+	// defaultBinlogGroupID binlog 总是以消费者组的方式消费, 写入 store 之后才提交 offset
+	defaultBinlogGroupID = "audit_log_binlog"
 )
 
-// BinlogSynchronizer 将river中的数据通过broker流向clickhouse
+// BinlogSynchronizer 将river中的数据通过broker流向store
 type BinlogSynchronizer struct {
 	river  *river.River
-	broker *broker.BinlogKafkaBroker
+	broker *broker.BinlogBroker
+	store  store.Store
+	retry  RetryPolicy
+
+	syncChan  chan *binlogMessage
+	watermark *Watermark
+	join      *JoinWindow
+
+	embedded chan<- *auditMessage // embed 模式, 见 SetContextMarker
+
+	cancel    context.CancelFunc
+	abort     chan struct{}
+	abortOnce sync.Once
+	done      chan struct{}
+}
 
-	syncChan chan *types.BinlogEvent
+// binlogMessage 带有 transport ack 的事务, 事务中的 event 全部写入 store 成功后才会 ack 并推进 watermark
+type binlogMessage struct {
+	gtid   string
+	covers string // 写入后 watermark 覆盖的 GTID 集合, 见 types.BinlogTransaction.Covers
+	events []types.ChBinlogEvent
+	ack    broker.Ack
 }
 
-func NewBinlogSyncer(river *river.River, broker *broker.BinlogKafkaBroker) *BinlogSynchronizer {
+func NewBinlogSyncer(river *river.River, broker *broker.BinlogBroker, store store.Store) *BinlogSynchronizer {
 	s := &BinlogSynchronizer{
 		river:    river,
 		broker:   broker,
-		syncChan: make(chan *types.BinlogEvent, defaultSyncChanSize),
+		store:    store,
+		retry:    NewRetryPolicy(defaultRetryInterval, defaultRetryMaxInterval, 0),
+		syncChan: make(chan *binlogMessage, defaultSyncChanSize),
 	}
+	s.watermark = NewWatermark(store)
+	s.join = NewJoinWindow(defaultJoinWindow, defaultJoinMaxEvents)
 	return s
 }
 
+// SetJoinWindow 设置写入 store 的事务在内存中保留的窗口, 需要在 Start 之前调用
+func (s *BinlogSynchronizer) SetJoinWindow(join *JoinWindow) {
+	s.join = join
+}
+
+// JoinWindow 返回写入 store 的事务的窗口, 见 TxInfoSynchronizer.SetJoinWindow
+func (s *BinlogSynchronizer) JoinWindow() *JoinWindow {
+	return s.join
+}
+
+// Watermark 返回已经写入 store 的 GTID 集合, 见 TxInfoSynchronizer.SetWatermark
+func (s *BinlogSynchronizer) Watermark() *Watermark {
+	return s.watermark
+}
+
+// SetRetryPolicy 设置写入 store 失败时的重试策略, 需要在 Start 之前调用
+func (s *BinlogSynchronizer) SetRetryPolicy(retry RetryPolicy) {
+	s.retry = retry
+}
+
+// batchSend2Clickhouse 批量写入store, syncChan 关闭后将剩余的数据全部写入再返回
 func (s *BinlogSynchronizer) batchSend2Clickhouse() {
-	var bulk []types.ChBinlogEvent
+	var (
+		bulk     []*binlogMessage
+		bulkSize int
+	)
 
 	ticker := time.NewTicker(defaultBatchSendInterval)
 	defer ticker.Stop()
@@ -45,32 +97,101 @@ func (s *BinlogSynchronizer) batchSend2Clickhouse() {
 		select {
 		case <-ticker.C:
 			needSend = true
-		case event := <-s.syncChan:
-			chEvent := event.ChEvent()
-			bulk = append(bulk, chEvent)
-			needSend = len(bulk) >= defaultBulkSize
+		case msg, ok := <-s.syncChan:
+			if !ok {
+				s.send(bulk)
+				return
+			}
+			bulk = append(bulk, msg)
+			bulkSize += len(msg.events)
+			needSend = bulkSize >= defaultBulkSize
 		}
 
 		if needSend && len(bulk) != 0 {
-			err := types.InsertBinlogEvents(bulk)
-			if err != nil {
-				logger.ErrorDetails(errors.Trace(err))
-				logger.Error("error events:")
-				for _, e := range bulk {
-					logger.Error("%+v", e)
-				}
-			}
-			bulk = bulk[0:0]
+			s.send(bulk)
+			bulk, bulkSize = bulk[0:0], 0
 		}
 	}
 }
 
-func (s *BinlogSynchronizer) Sync() {
-	go s.batchSend2Clickhouse()
+// send 写入 store, 失败时按照重试策略一直重试, 成功后放入 join 窗口、推进 watermark 并 ack 这批消息以提交 offset.
+// 重试期间会阻塞 syncChan 的消费, 从而对 kafka 形成背压. 被中止时不提交 offset, 重启后重新消费
+func (s *BinlogSynchronizer) send(bulk []*binlogMessage) {
+	if len(bulk) == 0 {
+		return
+	}
+	var (
+		chEvents []types.ChBinlogEvent
+		gtids    = make([]string, len(bulk))
+	)
+	for i, msg := range bulk {
+		chEvents = append(chEvents, msg.events...)
+		gtids[i] = msg.covers
+	}
+
+	_, err := s.retry.Do(s.abort, func(attempt int) error {
+		if len(chEvents) == 0 {
+			return nil
+		}
+		err := s.store.InsertBinlogEvents(chEvents)
+		if err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+			logger.Warn("insert %d binlog events failed, attempt: %d", len(chEvents), attempt)
+		}
+		return err
+	})
+
+	commit := err == nil
+	if commit {
+		// 先放入窗口再推进 watermark, 被唤醒的 tx syncer 一定能在窗口中找到这批事务
+		for _, msg := range bulk {
+			s.join.put(msg.gtid, msg.events)
+		}
+		s.watermark.advance(gtids)
+	} else {
+		logger.Error("give up inserting %d binlog events, they will be consumed again after restart: %s",
+			len(chEvents), err)
+	}
+	for _, msg := range bulk {
+		msg.ack(commit)
+	}
+}
+
+// Start 启动 river -> transport -> store 的数据同步, ctx 被取消时停止消费 transport
+func (s *BinlogSynchronizer) Start(ctx context.Context) error {
+	if s.done != nil {
+		return errors.New("binlog syncer already started")
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.abort = make(chan struct{})
+	s.done = make(chan struct{})
+	// watermark 只会推进, 重启后从 store 中保存的位置继续
+	if err := s.watermark.load(); err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+	}
 
+	var wg sync.WaitGroup
+	wg.Add(3)
 	go func() {
-		err := s.broker.Consume(func(event *types.BinlogEvent) error {
-			s.syncChan <- event
+		defer wg.Done()
+		s.batchSend2Clickhouse()
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(s.syncChan)
+		if s.embedded != nil {
+			// Consume 返回时所有 binlog 消息都已经 ack 或者不再等待 ack, 不会再发送审计日志
+			defer close(s.embedded)
+		}
+		err := s.broker.Consume(ctx, func(tx *types.BinlogTransaction, ack broker.Ack) error {
+			if s.embedded == nil {
+				s.syncChan <- &binlogMessage{gtid: tx.GTID, covers: tx.CoveredGTIDs(), events: tx.ChEvents(), ack: ack}
+				return nil
+			}
+			// embed 模式下 event 写入 store 并且审计日志交给 handler 之后才 ack
+			acks := splitAck(ack, 2)
+			s.syncChan <- &binlogMessage{gtid: tx.GTID, covers: tx.CoveredGTIDs(), events: tx.ChEvents(), ack: acks[0]}
+			s.emitEmbedded(tx, acks[1])
 			return nil
 		})
 		if err != nil {
@@ -78,18 +199,59 @@ func (s *BinlogSynchronizer) Sync() {
 		}
 	}()
 	go func() {
+		defer wg.Done()
 		err := s.broker.Pipe(s.river, river.FromFile)
 		if err != nil {
 			logger.ErrorDetails(errors.Trace(err))
 		}
 	}()
+	go func() {
+		wg.Wait()
+		close(s.done)
+	}()
+	return nil
+}
+
+// Stop 关闭 river(保存 binlog position), 停止消费 kafka(提交 offset),
+// 并将 syncChan 中剩余的数据写入 store 后返回. ctx 超时则中止重试并返回 ctx.Err(),
+// 未写入的数据不会提交 offset
+func (s *BinlogSynchronizer) Stop(ctx context.Context) error {
+	if s.done == nil {
+		return nil
+	}
+	s.river.Close()
+	s.cancel()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		// 多次调用 Stop 时只中止一次
+		s.abortOnce.Do(func() { close(s.abort) })
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// SetPrimaryKeyResolver 设置没有在配置中指定主键的表的主键查询方式, 需要在 Start 之前调用
+func (s *BinlogSynchronizer) SetPrimaryKeyResolver(resolver broker.PrimaryKeyResolver) {
+	s.broker.SetPrimaryKeyResolver(resolver)
+}
+
+// SetOutbox 从 binlog 中读取 outbox 表中的审计 Context 并通过 pusher 推送 tx_info, 需要在 Start 之前调用
+func (s *BinlogSynchronizer) SetOutbox(table string, pusher broker.TxPusher) {
+	s.broker.SetOutbox(table, pusher)
 }
 
-func newRiver() *river.River {
-	MySQL := config.MySQL
-	PositionSaver := config.PositionSaver
-	HealthChecker := config.HealthChecker
-	cfg := &river.Config{
+// Close 释放 broker 占用的资源, 需要在 Stop 之后调用
+func (s *BinlogSynchronizer) Close() error {
+	return errors.Trace(s.broker.Close())
+}
+
+func newRiver(cfg *config.MainConfig) *river.River {
+	MySQL := cfg.Mysql
+	PositionSaver := cfg.PositionSaver
+	HealthChecker := cfg.HealthChecker
+	riverCfg := &river.Config{
 		MySQLConfig: &river.MySQLConfig{
 			Host:     MySQL.Host,
 			Port:     MySQL.Port,
@@ -105,38 +267,70 @@ func newRiver() *river.River {
 			CheckInterval:     time.Duration(HealthChecker.CheckInterval) * time.Second,
 		},
 	}
-	return river.New(cfg)
+	return river.New(riverCfg)
 }
 
-func newBroker() (*broker.BinlogKafkaBroker, error) {
-	KafkaCfg := config.Kafka
-	cfg := &broker.BinlogBrokerConfig{
-		KafkaConfig: &kafka.Config{
-			Addrs:           KafkaCfg.Addrs,
-			Topic:           KafkaCfg.BinlogTopic,
-			OffsetStoreDir:  KafkaCfg.OffsetStoreDir,
-			Offset:          KafkaCfg.Offset,
-			UseOldestOffset: KafkaCfg.UseOldestOffset,
-		},
-		Tables: config.AuditLog.HandleTables,
+func newBroker(cfg *config.MainConfig) (*broker.BinlogBroker, error) {
+	groupID := cfg.Kafka.BinlogGroupID
+	if groupID == "" {
+		groupID = defaultBinlogGroupID
 	}
-	b, err := broker.New(cfg)
+	transport, err := newTransport(cfg, cfg.Kafka.BinlogTopic, groupID)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	columnRules := make([]broker.ColumnRule, 0, len(cfg.AuditLog.ColumnRules))
+	for _, rule := range cfg.AuditLog.ColumnRules {
+		columnRules = append(columnRules, broker.ColumnRule{
+			Table:   rule.Table,
+			Include: rule.Include,
+			Exclude: rule.Exclude,
+			Mask:    rule.Mask,
+			Hash:    rule.Hash,
+		})
+	}
+	brokerCfg := &broker.BinlogBrokerConfig{
+		Transport:     transport,
+		Tables:        cfg.AuditLog.HandleTables,
+		ExcludeTables: cfg.AuditLog.ExcludeTables,
+		ColumnRules:   columnRules,
+		HashKey:       cfg.AuditLog.HashKey,
+		PrimaryKeys:   cfg.AuditLog.PrimaryKeys,
+	}
+	b, err := broker.New(brokerCfg)
+	if err != nil {
+		transport.Close()
+		return nil, errors.Trace(err)
+	}
 	return b, nil
 }
 
+// NewBinlogSyncerFromConfig 根据配置创建独立的 BinlogSynchronizer, 不依赖包级别的全局变量
+func NewBinlogSyncerFromConfig(cfg *config.MainConfig, store store.Store) (*BinlogSynchronizer, error) {
+	_broker, err := newBroker(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := NewBinlogSyncer(newRiver(cfg), _broker, store)
+	if cfg.Join != nil {
+		s.SetJoinWindow(NewJoinWindow(time.Duration(cfg.Join.Window)*time.Second, cfg.Join.MaxEvents))
+	}
+	s.SetRetryPolicy(NewRetryPolicy(
+		time.Duration(cfg.ClickHouse.RetryInterval)*time.Second,
+		time.Duration(cfg.ClickHouse.RetryMaxInterval)*time.Second,
+		0,
+	))
+	return s, nil
+}
+
 var (
 	BinlogSyncer *BinlogSynchronizer
 )
 
 func InitBinlogSyncer() (err error) {
-	_river := newRiver()
-	_broker, err := newBroker()
+	BinlogSyncer, err = NewBinlogSyncerFromConfig(config.Main, store.S)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	BinlogSyncer = NewBinlogSyncer(_river, _broker)
 	return nil
 }
@@ -0,0 +1,75 @@
+package syncer
+
+import (
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+)
+
+const defaultDedupCacheSize = 100000
+
+// deduplicator 按审计日志 ID(由 GTID 生成, 见 types.AuditLogID)去重, 同一个事务的审计日志只交给 handler 一次.
+// 外部变更的审计日志使用不同的 ID(见 types.UnattributedAuditLogID), 不影响之后收到 tx_info 时生成的审计日志.
+// kafka 重新投递、重启、pending 的重新检查都可能再次生成同一个事务的审计日志.
+// 最近交给 handler 的 ID 缓存在内存中, 缓存中没有时查询 store 中持久化的记录. 只在 HandleAuditLog 中使用, 不需要加锁
+type deduplicator struct {
+	store store.Store
+	size  int
+	seen  map[string]struct{}
+	order []string // 按加入的顺序排列, 超过 size 时淘汰最早的 ID
+}
+
+func newDeduplicator(store store.Store, size int) *deduplicator {
+	return &deduplicator{
+		store: store,
+		size:  size,
+		seen:  make(map[string]struct{}),
+	}
+}
+
+func auditLogID(audit *types.AuditLog) string {
+	if audit.ID != "" {
+		return audit.ID
+	}
+	return types.AuditLogID(audit.GTID)
+}
+
+// dispatched 审计日志是否已经交给过 handler, 查询 store 失败时当作没有, 宁可重复也不丢失
+func (d *deduplicator) dispatched(audit *types.AuditLog) bool {
+	id := auditLogID(audit)
+	if _, ok := d.seen[id]; ok {
+		return true
+	}
+	dispatched, err := d.store.IsDispatched(id)
+	if err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+		return false
+	}
+	if dispatched {
+		d.remember(id)
+	}
+	return dispatched
+}
+
+// markDispatched 记录审计日志已经交给 handler(成功或者写入死信), 持久化失败只记录日志
+func (d *deduplicator) markDispatched(audit *types.AuditLog) {
+	id := auditLogID(audit)
+	d.remember(id)
+	if err := d.store.SaveDispatched(id, audit.GTID); err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+	}
+}
+
+func (d *deduplicator) remember(id string) {
+	if _, ok := d.seen[id]; ok {
+		return
+	}
+	d.seen[id] = struct{}{}
+	d.order = append(d.order, id)
+	for len(d.order) > d.size {
+		delete(d.seen, d.order[0])
+		d.order[0] = ""
+		d.order = d.order[1:]
+	}
+}
@@ -0,0 +1,131 @@
+package syncer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/obgnail/audit-log/config"
+	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+)
+
+func initTestLogger(t *testing.T) {
+	t.Helper()
+	if logger.CommonLogger != nil {
+		return
+	}
+	l, err := logger.NewCommonLogger(&config.LogConfig{LogFile: filepath.Join(t.TempDir(), "test.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.CommonLogger = l
+}
+
+func TestDeduplicator(t *testing.T) {
+	initTestLogger(t)
+
+	attributed := func(gtid string) *types.AuditLog {
+		return &types.AuditLog{ID: types.AuditLogID(gtid), GTID: gtid}
+	}
+	unattributed := func(gtid string) *types.AuditLog {
+		return &types.AuditLog{ID: types.UnattributedAuditLogID(gtid), GTID: gtid}
+	}
+
+	cases := []struct {
+		name      string
+		size      int
+		persisted []*types.AuditLog // 之前的进程已经交给 handler 的审计日志
+		marked    []*types.AuditLog // 依次交给 handler 的审计日志
+		check     *types.AuditLog
+		restart   bool // 检查之前使用新的 deduplicator(清空缓存)
+		want      bool
+	}{
+		{
+			name:  "not dispatched",
+			size:  10,
+			check: attributed("uuid:1"),
+			want:  false,
+		},
+		{
+			name:   "dispatched",
+			size:   10,
+			marked: []*types.AuditLog{attributed("uuid:1")},
+			check:  attributed("uuid:1"),
+			want:   true,
+		},
+		{
+			name:   "id from gtid when empty",
+			size:   10,
+			marked: []*types.AuditLog{attributed("uuid:1")},
+			check:  &types.AuditLog{GTID: "uuid:1"},
+			want:   true,
+		},
+		{
+			name:   "other gtid",
+			size:   10,
+			marked: []*types.AuditLog{attributed("uuid:1")},
+			check:  attributed("uuid:2"),
+			want:   false,
+		},
+		{
+			name:   "evicted from cache found in store",
+			size:   1,
+			marked: []*types.AuditLog{attributed("uuid:1"), attributed("uuid:2"), attributed("uuid:3")},
+			check:  attributed("uuid:1"),
+			want:   true,
+		},
+		{
+			name:      "dispatched before restart",
+			size:      10,
+			persisted: []*types.AuditLog{attributed("uuid:1")},
+			check:     attributed("uuid:1"),
+			restart:   true,
+			want:      true,
+		},
+		{
+			name:   "late tx_info after unattributed",
+			size:   10,
+			marked: []*types.AuditLog{unattributed("uuid:1")},
+			check:  attributed("uuid:1"),
+			want:   false,
+		},
+		{
+			name:   "unattributed after tx_info",
+			size:   10,
+			marked: []*types.AuditLog{attributed("uuid:1")},
+			check:  unattributed("uuid:1"),
+			want:   false,
+		},
+		{
+			name:   "unattributed dispatched",
+			size:   10,
+			marked: []*types.AuditLog{unattributed("uuid:1")},
+			check:  unattributed("uuid:1"),
+			want:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := store.NewMemoryStore()
+			for _, audit := range c.persisted {
+				if err := s.SaveDispatched(audit.ID, audit.GTID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := newDeduplicator(s, c.size)
+			for _, audit := range c.marked {
+				d.markDispatched(audit)
+			}
+			if len(d.order) > c.size {
+				t.Fatalf("cache size = %d, want <= %d", len(d.order), c.size)
+			}
+			if c.restart {
+				d = newDeduplicator(s, c.size)
+			}
+			if got := d.dispatched(c.check); got != c.want {
+				t.Fatalf("dispatched(%s) = %v, want %v", c.check.GTID, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package syncer
+
+import (
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/broker"
+	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/types"
+	"sync"
+)
+
+const defaultEmbedChanSize = 1024
+
+// SetContextMarker 开启 embed 模式: broker 将 marker 表中的审计 Context 附加到所在的事务上,
+// 消费时直接组装成审计日志发送到 sink(见 TxInfoSynchronizer.EnableEmbedded), 停止消费后关闭 sink. 需要在 Start 之前调用
+func (s *BinlogSynchronizer) SetContextMarker(table string, sink chan<- *auditMessage) {
+	s.broker.SetContextMarker(table)
+	s.embedded = sink
+}
+
+// emitEmbedded 将带有审计 Context 的事务组装成审计日志发送到 sink, 审计日志交给 handler 之后调用 ack.
+// 没有审计日志时直接 ack
+func (s *BinlogSynchronizer) emitEmbedded(tx *types.BinlogTransaction, ack broker.Ack) {
+	if tx.Context == "" || len(tx.Events) == 0 {
+		ack(true)
+		return
+	}
+	events := tx.ChEvents()
+	info := types.ChTxInfo{Time: events[0].Time, Context: tx.Context, GTID: tx.GTID, Status: types.StatusTxInfoProcessed}
+	audit, err := types.NewAuditLog(info, events)
+	if err != nil {
+		// 重新消费也无法生成审计日志
+		logger.ErrorDetails(errors.Trace(err))
+		ack(true)
+		return
+	}
+	select {
+	case s.embedded <- &auditMessage{audit: audit, ack: ack}:
+	case <-s.abort:
+		logger.Error("binlog syncer aborted, embedded audit log dropped, gtid: %s", audit.GTID)
+		ack(false)
+	}
+}
+
+// splitAck 将 ack 拆分成 n 个, 全部 ack(true) 之后才调用 ack(true), 任意一个 ack(false) 时调用 ack(false)
+func splitAck(ack broker.Ack, n int) []broker.Ack {
+	var (
+		mu      sync.Mutex
+		pending = n
+		failed  bool
+	)
+	acks := make([]broker.Ack, n)
+	for i := range acks {
+		var once sync.Once
+		acks[i] = func(commit bool) {
+			once.Do(func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if failed {
+					return
+				}
+				if !commit {
+					failed = true
+					ack(false)
+					return
+				}
+				if pending--; pending == 0 {
+					ack(true)
+				}
+			})
+		}
+	}
+	return acks
+}
+
+// EnableEmbedded 开启 embed 模式, 返回接收 binlog syncer 组装好的审计日志的 channel,
+// 见 BinlogSynchronizer.SetContextMarker. 需要在 Start 之前调用.
+// channel 由 binlog syncer 停止消费后关闭, 之后 Stop 才会返回, 因此需要先停止 binlog syncer(见 AuditLogger.Stop)
+func (s *TxInfoSynchronizer) EnableEmbedded() chan<- *auditMessage {
+	if s.embedded == nil {
+		s.embedded = make(chan *auditMessage, defaultEmbedChanSize)
+	}
+	return s.embedded
+}
+
+// handleEmbedded 处理 binlog syncer 组装好的审计日志, 直到 binlog syncer 停止消费后关闭 channel.
+// 不随 ctx 退出: binlog syncer 停止消费之前仍可能发送审计日志, 这些 binlog 消息需要 ack 之后 binlog syncer 才能停止
+func (s *TxInfoSynchronizer) handleEmbedded() {
+	for msg := range s.embedded {
+		s.processEmbedded(msg)
+	}
+}
+
+func (s *TxInfoSynchronizer) processEmbedded(msg *auditMessage) {
+	audit := msg.audit
+	info := types.NewChTxInfo(audit.Time, audit.Context, audit.GTID, types.StatusTxInfoProcessed)
+	written, saved, err := s.saveTxInfo(info)
+	audit.Time = written.Time
+	if err == nil && !saved {
+		var redispatch bool
+		if redispatch, err = s.undispatched(audit); err == nil && !redispatch {
+			// 重新消费的 binlog 消息, 审计日志已经交给过 handler
+			msg.ack(true)
+			return
+		}
+	}
+	if err != nil {
+		// 不提交 binlog 消息, 重启后重新处理
+		logger.ErrorDetails(errors.Trace(err))
+		msg.ack(false)
+		return
+	}
+	s.saveAuditLog(audit)
+	s.dispatch(audit, msg.ack)
+}
@@ -0,0 +1,212 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/obgnail/audit-log/broker"
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+)
+
+// ackRecorder 记录 ack 的调用, calls 为调用次数
+type ackRecorder struct {
+	calls  int
+	commit bool
+}
+
+func (r *ackRecorder) ack(commit bool) {
+	r.calls++
+	r.commit = commit
+}
+
+func TestSplitAck(t *testing.T) {
+	cases := []struct {
+		name      string
+		commits   []bool // 依次调用拆分后的 ack
+		wantCalls int
+		want      bool
+	}{
+		{name: "all committed", commits: []bool{true, true}, wantCalls: 1, want: true},
+		{name: "partially committed", commits: []bool{true}, wantCalls: 0},
+		{name: "first failed", commits: []bool{false, true}, wantCalls: 1, want: false},
+		{name: "second failed", commits: []bool{true, false}, wantCalls: 1, want: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := &ackRecorder{}
+			acks := splitAck(r.ack, 2)
+			for i, commit := range c.commits {
+				acks[i](commit)
+			}
+			if r.calls != c.wantCalls || r.commit != c.want {
+				t.Fatalf("ack called %d times with %v, want %d times with %v", r.calls, r.commit, c.wantCalls, c.want)
+			}
+		})
+	}
+
+	// 同一个 ack 重复调用只计算一次
+	r := &ackRecorder{}
+	acks := splitAck(r.ack, 2)
+	acks[0](true)
+	acks[0](true)
+	if r.calls != 0 {
+		t.Fatalf("ack called after the same split ack committed twice")
+	}
+}
+
+func TestEmitEmbedded(t *testing.T) {
+	initTestLogger(t)
+
+	const gtid = testServer + ":1"
+	withContext := func(tx *types.BinlogTransaction) *types.BinlogTransaction {
+		tx.Context = "ctx"
+		return tx
+	}
+	cases := []struct {
+		name     string
+		tx       *types.BinlogTransaction
+		aborted  bool
+		wantSent bool
+		wantAck  *bool // nil 表示还没有 ack
+	}{
+		{name: "without context", tx: testBinlogTransaction(t, gtid), wantAck: newBool(true)},
+		{name: "without events", tx: &types.BinlogTransaction{GTID: gtid, Context: "ctx"}, wantAck: newBool(true)},
+		{name: "with context", tx: withContext(testBinlogTransaction(t, gtid)), wantSent: true},
+		{name: "aborted", tx: withContext(testBinlogTransaction(t, gtid)), aborted: true, wantAck: newBool(false)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sink := make(chan *auditMessage, 1)
+			s := &BinlogSynchronizer{embedded: sink, abort: make(chan struct{})}
+			if c.aborted {
+				// channel 已满并且被中止
+				sink <- &auditMessage{}
+				close(s.abort)
+			}
+			r := &ackRecorder{}
+			s.emitEmbedded(c.tx, r.ack)
+
+			if c.wantAck == nil {
+				if r.calls != 0 {
+					t.Fatalf("acked before the audit log is handled")
+				}
+			} else if r.calls != 1 || r.commit != *c.wantAck {
+				t.Fatalf("ack called %d times with %v, want %v", r.calls, r.commit, *c.wantAck)
+			}
+			if !c.wantSent {
+				return
+			}
+			msg := <-sink
+			if msg.audit.ID != types.AuditLogID(gtid) || msg.audit.Context != "ctx" || len(msg.audit.Changes) != 1 {
+				t.Fatalf("embedded audit log = %+v", msg.audit)
+			}
+			msg.ack(true)
+			if r.calls != 1 || !r.commit {
+				t.Fatalf("ack not committed after the audit log is handled")
+			}
+		})
+	}
+}
+
+func newBool(b bool) *bool {
+	return &b
+}
+
+func TestProcessEmbeddedRedelivered(t *testing.T) {
+	initTestLogger(t)
+
+	s := store.NewMemoryStore()
+	tx := testBinlogTransaction(t, testServer+":1")
+	tx.Context = "ctx"
+	info := types.ChTxInfo{Time: time.Now(), Context: tx.Context, GTID: tx.GTID, Status: types.StatusTxInfoProcessed}
+
+	handled := 0
+	handler := func(*types.AuditLog) error {
+		handled++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		// 每次使用新的 TxInfoSynchronizer, 相当于重启后重新消费同一条 binlog 消息
+		syncer := NewTxInfoSyncer(nil, s)
+		audit, err := types.NewAuditLog(info, tx.ChEvents())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &ackRecorder{}
+		syncer.processEmbedded(&auditMessage{audit: audit, ack: r.ack})
+		drainAuditLogs(syncer, handler)
+		if r.calls != 1 || !r.commit {
+			t.Fatalf("consume %d: ack called %d times with %v, want committed", i, r.calls, r.commit)
+		}
+	}
+	if handled != 1 {
+		t.Fatalf("handled %d audit logs, want 1", handled)
+	}
+	got, err := s.GetTxInfo(tx.GTID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Status != types.StatusTxInfoProcessed {
+		t.Fatalf("tx_info = %v, want processed", got)
+	}
+}
+
+// TestEmbeddedShutdown ctx 被取消之后 binlog syncer 仍在发送的审计日志也会被处理并 ack,
+// embed channel 关闭之后 Stop 才返回
+func TestEmbeddedShutdown(t *testing.T) {
+	initTestLogger(t)
+
+	transport := broker.NewChannelTransport(0)
+	defer transport.Close()
+	s := NewTxInfoSyncer(broker.NewTxBroker(transport), store.NewMemoryStore())
+	b := &BinlogSynchronizer{embedded: s.EnableEmbedded(), abort: make(chan struct{})}
+
+	handled := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	err := s.Start(ctx, func(audit *types.AuditLog) error {
+		handled <- audit.GTID
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	acked := make(chan bool, 2)
+	for i := 1; i <= 2; i++ {
+		tx := testBinlogTransaction(t, testServer+":"+string(rune('0'+i)))
+		tx.Context = "ctx"
+		b.emitEmbedded(tx, func(commit bool) { acked <- commit })
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case commit := <-acked:
+			if !commit {
+				t.Fatal("embedded audit log not committed")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("embedded audit log sent after cancel never acked")
+		}
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+		defer stopCancel()
+		stopped <- s.Stop(stopCtx)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("tx info syncer stopped before the binlog syncer closed the embed channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(b.embedded)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 2 {
+		t.Fatalf("handled %d audit logs, want 2", len(handled))
+	}
+}
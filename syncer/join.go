@@ -0,0 +1,120 @@
+package syncer
+
+import (
+	"github.com/obgnail/audit-log/types"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJoinWindow    = 5 * time.Minute
+	defaultJoinMaxEvents = 100000
+)
+
+// JoinWindow 在内存中按 GTID 关联 binlog 事务和 tx_info, 避免每条 tx_info 都查询一次 store.
+// binlog syncer 将写入 store 的事务放入窗口, tx syncer 在 watermark 覆盖 tx_info 的 GTID 后从窗口中取出;
+// 超过 window 或者窗口中的 event 超过 maxEvents 时淘汰最早的事务, 之后到达的 tx_info 从 store 中查询
+type JoinWindow struct {
+	window    time.Duration
+	maxEvents int
+
+	mu     sync.Mutex
+	txs    map[string]*joinEntry // map[gtid]entry
+	queue  []*joinEntry          // 按放入的顺序排列, 用于淘汰
+	events int
+}
+
+type joinEntry struct {
+	gtid   string
+	events []types.ChBinlogEvent
+	added  time.Time
+}
+
+// NewJoinWindow window、maxEvents 小于等于 0 时使用默认值
+func NewJoinWindow(window time.Duration, maxEvents int) *JoinWindow {
+	if window <= 0 {
+		window = defaultJoinWindow
+	}
+	if maxEvents <= 0 {
+		maxEvents = defaultJoinMaxEvents
+	}
+	return &JoinWindow{
+		window:    window,
+		maxEvents: maxEvents,
+		txs:       make(map[string]*joinEntry),
+	}
+}
+
+// put 放入已经写入 store 的事务, 没有 event 的事务不放入.
+// 窗口中已经有该事务时(重新消费, 或者停止时发送了一部分)按照 seq 合并, 与 store 相同, 相同 seq 的 event 使用新的数据
+func (j *JoinWindow) put(gtid string, events []types.ChBinlogEvent) {
+	if len(events) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	if old, ok := j.txs[gtid]; ok {
+		j.events -= len(old.events)
+		events = mergeBinlogEvents(old.events, events)
+		old.events = nil
+	}
+	entry := &joinEntry{gtid: gtid, events: events, added: now}
+	j.txs[gtid] = entry
+	j.queue = append(j.queue, entry)
+	j.events += len(events)
+	j.evict(now)
+}
+
+// take 取出 gtid 对应的事务, 每个事务只能取出一次
+func (j *JoinWindow) take(gtid string) ([]types.ChBinlogEvent, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.txs[gtid]
+	if !ok {
+		return nil, false
+	}
+	delete(j.txs, gtid)
+	j.events -= len(entry.events)
+	// 队列中的 entry 在淘汰前不再持有 event
+	events := entry.events
+	entry.events = nil
+	return events, true
+}
+
+// evict 淘汰超过窗口的事务, 需要持有 mu
+func (j *JoinWindow) evict(now time.Time) {
+	for len(j.queue) != 0 {
+		entry := j.queue[0]
+		if now.Sub(entry.added) < j.window && j.events <= j.maxEvents {
+			return
+		}
+		j.queue[0] = nil
+		j.queue = j.queue[1:]
+		// 已经被取出或者被覆盖的事务只需要出队
+		if j.txs[entry.gtid] == entry {
+			delete(j.txs, entry.gtid)
+			j.events -= len(entry.events)
+		}
+	}
+}
+
+// mergeBinlogEvents 按照 seq 合并同一个事务的 event, 相同 seq 时使用 events 中的数据, 结果按照 seq 排列
+func mergeBinlogEvents(old, events []types.ChBinlogEvent) []types.ChBinlogEvent {
+	bySeq := make(map[uint32]types.ChBinlogEvent, len(old)+len(events))
+	for _, event := range old {
+		bySeq[event.Seq] = event
+	}
+	for _, event := range events {
+		bySeq[event.Seq] = event
+	}
+	result := make([]types.ChBinlogEvent, 0, len(bySeq))
+	for _, event := range bySeq {
+		result = append(result, event)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Seq < result[j].Seq })
+	return result
+}
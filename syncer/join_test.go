@@ -0,0 +1,172 @@
+package syncer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/obgnail/audit-log/types"
+)
+
+func testBinlogEvents(gtid string, seqs ...uint32) []types.ChBinlogEvent {
+	events := make([]types.ChBinlogEvent, len(seqs))
+	for i, seq := range seqs {
+		events[i] = types.ChBinlogEvent{GTID: gtid, Seq: seq}
+	}
+	return events
+}
+
+func TestJoinWindowEviction(t *testing.T) {
+	type put struct {
+		gtid string
+		seqs []uint32
+	}
+
+	cases := []struct {
+		name       string
+		window     time.Duration
+		maxEvents  int
+		puts       []put
+		take       []string      // put 之后依次取出的事务
+		elapsed    time.Duration // 取出之后经过的时间
+		wantEvents int
+		wantTxs    []string // 最后仍在窗口中的事务
+	}{
+		{
+			name:       "within window",
+			window:     time.Minute,
+			maxEvents:  10,
+			puts:       []put{{"a", []uint32{0, 1}}, {"b", []uint32{0}}},
+			wantEvents: 3,
+			wantTxs:    []string{"a", "b"},
+		},
+		{
+			name:       "max events evicts oldest",
+			window:     time.Minute,
+			maxEvents:  3,
+			puts:       []put{{"a", []uint32{0, 1}}, {"b", []uint32{0}}, {"c", []uint32{0}}},
+			wantEvents: 2,
+			wantTxs:    []string{"b", "c"},
+		},
+		{
+			name:       "large transaction evicts all older",
+			window:     time.Minute,
+			maxEvents:  3,
+			puts:       []put{{"a", []uint32{0}}, {"b", []uint32{0}}, {"c", []uint32{0, 1, 2}}},
+			wantEvents: 3,
+			wantTxs:    []string{"c"},
+		},
+		{
+			name:       "transaction larger than window",
+			window:     time.Minute,
+			maxEvents:  2,
+			puts:       []put{{"a", []uint32{0}}, {"b", []uint32{0, 1, 2}}},
+			wantEvents: 0,
+			wantTxs:    []string{},
+		},
+		{
+			name:       "expired",
+			window:     time.Minute,
+			maxEvents:  10,
+			puts:       []put{{"a", []uint32{0}}, {"b", []uint32{0}}},
+			elapsed:    2 * time.Minute,
+			wantEvents: 0,
+			wantTxs:    []string{},
+		},
+		{
+			name:       "taken transaction frees events",
+			window:     time.Minute,
+			maxEvents:  3,
+			puts:       []put{{"a", []uint32{0, 1}}, {"b", []uint32{0}}},
+			take:       []string{"a"},
+			wantEvents: 1,
+			wantTxs:    []string{"b"},
+		},
+		{
+			name:       "empty transaction not put",
+			window:     time.Minute,
+			maxEvents:  10,
+			puts:       []put{{"a", nil}, {"b", []uint32{0}}},
+			wantEvents: 1,
+			wantTxs:    []string{"b"},
+		},
+		{
+			name:       "redelivered transaction counted once",
+			window:     time.Minute,
+			maxEvents:  10,
+			puts:       []put{{"a", []uint32{0, 1}}, {"a", []uint32{0, 1}}},
+			wantEvents: 2,
+			wantTxs:    []string{"a"},
+		},
+		{
+			name:       "fragments merged",
+			window:     time.Minute,
+			maxEvents:  10,
+			puts:       []put{{"a", []uint32{0, 1}}, {"a", []uint32{1, 2}}},
+			wantEvents: 3,
+			wantTxs:    []string{"a"},
+		},
+		{
+			name:       "stale queue entry of merged transaction",
+			window:     time.Minute,
+			maxEvents:  3,
+			puts:       []put{{"a", []uint32{0}}, {"b", []uint32{0}}, {"a", []uint32{1}}, {"c", []uint32{0}}},
+			wantEvents: 3,
+			wantTxs:    []string{"a", "c"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			j := NewJoinWindow(c.window, c.maxEvents)
+			for _, p := range c.puts {
+				j.put(p.gtid, testBinlogEvents(p.gtid, p.seqs...))
+			}
+			for _, gtid := range c.take {
+				if _, ok := j.take(gtid); !ok {
+					t.Fatalf("take(%s) not found", gtid)
+				}
+			}
+			j.mu.Lock()
+			j.evict(time.Now().Add(c.elapsed))
+			events := j.events
+			txs := make([]string, 0, len(j.txs))
+			for _, entry := range j.queue {
+				if j.txs[entry.gtid] == entry {
+					txs = append(txs, entry.gtid)
+				}
+			}
+			j.mu.Unlock()
+
+			if events != c.wantEvents {
+				t.Fatalf("events = %d, want %d", events, c.wantEvents)
+			}
+			if !reflect.DeepEqual(txs, c.wantTxs) {
+				t.Fatalf("transactions in window = %v, want %v", txs, c.wantTxs)
+			}
+		})
+	}
+}
+
+func TestJoinWindowTake(t *testing.T) {
+	j := NewJoinWindow(time.Minute, 10)
+	j.put("a", testBinlogEvents("a", 0, 2))
+	j.put("a", testBinlogEvents("a", 1, 2))
+
+	events, ok := j.take("a")
+	if !ok {
+		t.Fatal("take(a) not found")
+	}
+	var seqs []uint32
+	for _, event := range events {
+		seqs = append(seqs, event.Seq)
+	}
+	if want := []uint32{0, 1, 2}; !reflect.DeepEqual(seqs, want) {
+		t.Fatalf("seqs = %v, want %v", seqs, want)
+	}
+	if _, ok := j.take("a"); ok {
+		t.Fatal("take(a) found twice")
+	}
+	if _, ok := j.take("b"); ok {
+		t.Fatal("take(b) found")
+	}
+}
@@ -0,0 +1,68 @@
+package syncer
+
+import (
+	"github.com/juju/errors"
+	"time"
+)
+
+const (
+	defaultRetryInterval    = 1 * time.Second
+	defaultRetryMaxInterval = 30 * time.Second
+)
+
+var errRetryAborted = errors.New("retry aborted")
+
+// RetryPolicy 指数退避的重试策略, 每次失败后等待时间翻倍, 最长为 MaxInterval.
+// MaxAttempts 为 0 表示一直重试, 直到成功或被中止
+type RetryPolicy struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+	MaxAttempts int
+}
+
+func NewRetryPolicy(interval, maxInterval time.Duration, maxAttempts int) RetryPolicy {
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+	if maxInterval <= 0 {
+		maxInterval = defaultRetryMaxInterval
+	}
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	return RetryPolicy{Interval: interval, MaxInterval: maxInterval, MaxAttempts: maxAttempts}
+}
+
+// Do 执行 fn 直到成功、达到 MaxAttempts 或 abort 被关闭, 返回执行次数和最后一次的错误.
+// 被中止时返回 errRetryAborted
+func (p RetryPolicy) Do(abort <-chan struct{}, fn func(attempt int) error) (int, error) {
+	interval := p.Interval
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return attempt, nil
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return attempt, errors.Trace(err)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-abort:
+			timer.Stop()
+			return attempt, errRetryAborted
+		}
+
+		interval = p.next(interval)
+	}
+}
+
+// next 返回 interval 之后的等待时间: 翻倍, 最长为 MaxInterval
+func (p RetryPolicy) next(interval time.Duration) time.Duration {
+	interval *= 2
+	if interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	return interval
+}
@@ -0,0 +1,109 @@
+package syncer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	cases := []struct {
+		name                  string
+		interval, maxInterval time.Duration
+		want                  RetryPolicy
+	}{
+		{name: "defaults", want: RetryPolicy{Interval: defaultRetryInterval, MaxInterval: defaultRetryMaxInterval}},
+		{name: "custom", interval: time.Second, maxInterval: 5 * time.Second, want: RetryPolicy{Interval: time.Second, MaxInterval: 5 * time.Second}},
+		{name: "max below interval", interval: 10 * time.Second, maxInterval: time.Second, want: RetryPolicy{Interval: 10 * time.Second, MaxInterval: 10 * time.Second}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := NewRetryPolicy(c.interval, c.maxInterval, 0); got != c.want {
+				t.Fatalf("NewRetryPolicy = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	cases := []struct {
+		name  string
+		p     RetryPolicy
+		wants []time.Duration // 依次等待的时间
+	}{
+		{
+			name:  "doubled",
+			p:     NewRetryPolicy(time.Second, time.Minute, 0),
+			wants: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:  "capped",
+			p:     NewRetryPolicy(time.Second, 5*time.Second, 0),
+			wants: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:  "interval equals max",
+			p:     NewRetryPolicy(3*time.Second, 3*time.Second, 0),
+			wants: []time.Duration{3 * time.Second, 3 * time.Second},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := []time.Duration{c.p.Interval}
+			for len(got) < len(c.wants) {
+				got = append(got, c.p.next(got[len(got)-1]))
+			}
+			if !reflect.DeepEqual(got, c.wants) {
+				t.Fatalf("intervals = %v, want %v", got, c.wants)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	cases := []struct {
+		name         string
+		maxAttempts  int
+		failures     int  // 前 failures 次执行失败
+		abort        bool // 执行之前关闭 abort
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "success", maxAttempts: 3, failures: 0, wantAttempts: 1},
+		{name: "success after retry", maxAttempts: 3, failures: 2, wantAttempts: 3},
+		{name: "max attempts", maxAttempts: 3, failures: 5, wantAttempts: 3, wantErr: errFailed},
+		{name: "unlimited attempts", maxAttempts: 0, failures: 5, wantAttempts: 6},
+		{name: "aborted", maxAttempts: 0, failures: 5, abort: true, wantAttempts: 1, wantErr: errRetryAborted},
+		{name: "abort after success", maxAttempts: 0, failures: 0, abort: true, wantAttempts: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := NewRetryPolicy(time.Millisecond, 2*time.Millisecond, c.maxAttempts)
+			abort := make(chan struct{})
+			if c.abort {
+				close(abort)
+			}
+			calls := 0
+			attempts, err := p.Do(abort, func(attempt int) error {
+				calls++
+				if attempt != calls {
+					t.Fatalf("attempt = %d, want %d", attempt, calls)
+				}
+				if attempt <= c.failures {
+					return errFailed
+				}
+				return nil
+			})
+			if attempts != c.wantAttempts || calls != c.wantAttempts {
+				t.Fatalf("attempts = %d, calls = %d, want %d", attempts, calls, c.wantAttempts)
+			}
+			if errors.Cause(err) != c.wantErr {
+				t.Fatalf("err = %v, want %v", err, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/broker"
+	"github.com/obgnail/audit-log/config"
+	"path/filepath"
+)
+
+// newTransport 根据配置创建 topic 对应的 transport, 未配置 transport 时使用 kafka.
+// groupID 为空时 kafka 不以消费者组的方式消费
+func newTransport(cfg *config.MainConfig, topic, groupID string) (broker.Transport, error) {
+	typ := broker.TransportKafka
+	if cfg.Transport != nil && cfg.Transport.Type != "" {
+		typ = cfg.Transport.Type
+	}
+
+	switch typ {
+	case broker.TransportKafka:
+		t, err := broker.NewKafkaTransport(cfg.Kafka.Addrs, topic, groupID, cfg.Kafka.UseOldestOffset)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return t, nil
+	case broker.TransportChannel:
+		return broker.NewChannelTransport(cfg.Transport.ChannelSize), nil
+	case broker.TransportFile:
+		t, err := broker.NewFileTransport(filepath.Join(cfg.Transport.Dir, topic))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unknown transport type: %s", typ)
+	}
+}
@@ -1,11 +1,15 @@
 package syncer
 
 import (
+	"context"
 	"github.com/juju/errors"
 	"github.com/obgnail/audit-log/broker"
 	"github.com/obgnail/audit-log/config"
+	"github.com/obgnail/audit-log/deadletter"
 	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/store"
 	"github.com/obgnail/audit-log/types"
+	"sync"
 	"time"
 )
 
@@ -13,148 +17,402 @@ const (
 	defaultAuditChanSize = 1024
 
 	defaultRecheckInterval = 10 * time.Second
+	defaultPendingExpiry   = 72 * time.Hour     // pending 超过该时间仍没有被 watermark 覆盖则标记为 expired
+	defaultPendingLookback = 7 * 24 * time.Hour // 只检查最近 defaultPendingLookback 内的 pending
+	defaultPendingLimit    = 1000
 
-	defaultGetBinlogInterval = 1 * time.Second
-	defaultGenBinlogMaxRetry = 3
+	defaultHandleMaxAttempts = 3
+
+	// defaultTxInfoGroupID tx_info 总是以消费者组的方式消费, 停止期间产生的 tx_info 在重启后继续消费
+	defaultTxInfoGroupID = "audit_log_tx_info"
 )
 
 type TxInfoSynchronizer struct {
-	*broker.TxKafkaBroker
-	auditChan chan *types.AuditLog
+	*broker.TxBroker
+	store     store.Store
+	auditChan chan *auditMessage
+	watermark *Watermark
+	join      *JoinWindow // 为 nil 时从 store 中查询 binlog_event
+	dedup     *deduplicator
+	txInfoMu  sync.Mutex // 见 saveTxInfo
+
+	handleRetry RetryPolicy
+	deadLetters deadletter.Sink
+
+	unattributed   *UnattributedPolicy
+	sourceResolver SourceResolver
+	progress       txInfoProgress
+	embedded       chan *auditMessage // embed 模式, 见 EnableEmbedded
+
+	cancel    context.CancelFunc
+	abort     chan struct{}
+	abortOnce sync.Once
+	done      chan struct{}
+}
+
+// auditMessage 等待交给 handler 的审计日志. ack 不为 nil 时在审计日志交给 handler(成功或者写入死信)后调用,
+// 用于提交对应的 tx_info 消息, embed 模式下为 binlog 消息(见 BinlogSynchronizer.emitEmbedded)
+type auditMessage struct {
+	audit *types.AuditLog
+	ack   broker.Ack
+}
+
+func NewTxInfoSyncer(broker *broker.TxBroker, store store.Store) *TxInfoSynchronizer {
+	return &TxInfoSynchronizer{
+		TxBroker:    broker,
+		store:       store,
+		auditChan:   make(chan *auditMessage, defaultAuditChanSize),
+		watermark:   NewWatermark(store),
+		dedup:       newDeduplicator(store, defaultDedupCacheSize),
+		handleRetry: NewRetryPolicy(defaultRetryInterval, defaultRetryMaxInterval, defaultHandleMaxAttempts),
+	}
+}
+
+// SetWatermark 使用 binlog syncer 的 watermark(见 BinlogSynchronizer.Watermark), 推进时立即处理等待中的 tx_info.
+// 默认定时从 store 中加载 watermark, 用于 binlog syncer 在其他进程中运行的情况. 需要在 Start 之前调用
+func (s *TxInfoSynchronizer) SetWatermark(watermark *Watermark) {
+	s.watermark = watermark
+}
+
+// SetJoinWindow 使用 binlog syncer 的 join 窗口(见 BinlogSynchronizer.JoinWindow), 窗口中找不到的事务再查询 store.
+// 需要在 Start 之前调用
+func (s *TxInfoSynchronizer) SetJoinWindow(join *JoinWindow) {
+	s.join = join
 }
 
-func NewTxInfoSyncer(broker *broker.TxKafkaBroker) *TxInfoSynchronizer {
-	return &TxInfoSynchronizer{TxKafkaBroker: broker, auditChan: make(chan *types.AuditLog, defaultAuditChanSize)}
+// SetHandleRetryPolicy 设置 handler 处理审计日志失败时的重试策略, 需要在 Start 之前调用
+func (s *TxInfoSynchronizer) SetHandleRetryPolicy(retry RetryPolicy) {
+	s.handleRetry = retry
 }
 
+// SetDeadLetterSink 设置死信的存储, 重试耗尽的审计日志会写入 sink. 为 nil 时只记录日志
+func (s *TxInfoSynchronizer) SetDeadLetterSink(sink deadletter.Sink) {
+	s.deadLetters = sink
+}
+
+func (s *TxInfoSynchronizer) Store() store.Store {
+	return s.store
+}
+
+func (s *TxInfoSynchronizer) DeadLetterSink() deadletter.Sink {
+	return s.deadLetters
+}
+
+// HandleAuditLog 将 auditChan 中的审计日志交给 fn 处理, 失败时按照重试策略重试,
+// 重试耗尽后写入死信. 已经交给过 fn 的事务(相同的审计日志 ID)会被跳过. auditChan 关闭且处理完毕后返回
 func (s *TxInfoSynchronizer) HandleAuditLog(fn func(txEvent *types.AuditLog) error) {
-	for audit := range s.auditChan {
-		if err := fn(audit); err != nil {
+	for msg := range s.auditChan {
+		s.handleAuditLog(msg.audit, fn)
+		if msg.ack != nil {
+			msg.ack(true)
+		}
+	}
+}
+
+func (s *TxInfoSynchronizer) handleAuditLog(audit *types.AuditLog, fn func(txEvent *types.AuditLog) error) {
+	if s.dedup.dispatched(audit) {
+		logger.Warn("duplicate audit log skipped, gtid: %s", audit.GTID)
+		return
+	}
+	attempts, err := s.handleRetry.Do(s.abort, func(attempt int) error {
+		err := fn(audit)
+		if err != nil {
 			logger.ErrorDetails(errors.Trace(err))
 		}
+		return err
+	})
+	if err != nil {
+		s.putDeadLetter(audit, err, attempts)
 	}
+	s.dedup.markDispatched(audit)
+}
+
+// dispatch 将审计日志交给 HandleAuditLog, ack 可以为 nil
+func (s *TxInfoSynchronizer) dispatch(audit *types.AuditLog, ack broker.Ack) {
+	s.auditChan <- &auditMessage{audit: audit, ack: ack}
 }
 
-func (s *TxInfoSynchronizer) handleUnprocessedTxInfo() {
+func (s *TxInfoSynchronizer) putDeadLetter(audit *types.AuditLog, err error, attempts int) {
+	logger.Error("handle audit log failed after %d attempts, gtid: %s", attempts, audit.GTID)
+	failed := types.NewChTxInfo(audit.Time, audit.Context, audit.GTID, types.StatusTxInfoFailed)
+	if _, _, err := s.saveTxInfo(failed); err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+	}
+	if s.deadLetters == nil {
+		return
+	}
+	letter := deadletter.NewDeadLetter(audit, err, attempts)
+	if err := s.deadLetters.Put(letter); err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+		logger.Error("put dead letter failed: %+v", *audit)
+	}
+}
+
+// handlePendingTxInfo 定时处理等待 watermark 超时的 tx_info(pending), 见 processTxInfo
+func (s *TxInfoSynchronizer) handlePendingTxInfo(ctx context.Context) {
 	ticker := time.NewTicker(defaultRecheckInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			infos, err := getUnprocessedInfos()
+			audits, err := s.processPendingTxInfo()
 			if err != nil {
 				logger.ErrorDetails(errors.Trace(err))
 				continue
 			}
-			if infos.Empty() {
-				continue
+			for _, audit := range audits {
+				s.saveAuditLog(audit)
+				s.dispatch(audit, nil)
 			}
+		}
+	}
+}
 
-			toProcessInfoEvents, toProcessInfos, err := infos.getToProcess()
-			if err != nil {
-				logger.ErrorDetails(errors.Trace(err))
-				continue
-			}
+// processPendingTxInfo 写入 watermark 已经覆盖或者过期的 pending 转移后的状态, 返回需要交给 handler 的审计日志.
+// 读取 pending 和写入之间持有 txInfoMu, 写入失败时不返回审计日志, 之后重新处理
+func (s *TxInfoSynchronizer) processPendingTxInfo() ([]*types.AuditLog, error) {
+	s.txInfoMu.Lock()
+	defer s.txInfoMu.Unlock()
 
-			for _, audit := range toProcessInfoEvents {
-				s.auditChan <- audit
-			}
+	infos, err := getPendingInfos(s.store)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if infos.Empty() {
+		return nil, nil
+	}
+	audits, toProcessInfos, err := infos.getToProcess(s.store, s.watermark)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := s.store.BatchInsertTxInfo(toProcessInfos); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return audits, nil
+}
 
-			if err := types.BatchInsertTxInfo(toProcessInfos); err != nil {
-				logger.ErrorDetails(errors.Trace(err))
-				continue
-			}
+// saveTxInfo 将 gtid 当前的 tx_info 转移到 info.Status(见 types.ChTxInfo.Transit)后写入 store, 返回写入的版本.
+// 新版本使用 info 的 Context, Time 保持第一次写入时的值: tx_info 和 audit_log 按 time 分区,
+// ReplacingMergeTree 只合并同一个分区内的行(例如 unattributed 使用 binlog 的时间, 之后收到的 tx_info 的时间可能在另一个月).
+// 还没有 tx_info 时直接写入 info. 不允许的转移(例如重新消费已经处理过的 tx_info)只记录日志, 返回当前版本和 false.
+// 同一个进程中 tx_info 的写入持有 txInfoMu, 读取当前状态和写入之间不会插入其他的写入
+func (s *TxInfoSynchronizer) saveTxInfo(info types.ChTxInfo) (types.ChTxInfo, bool, error) {
+	s.txInfoMu.Lock()
+	defer s.txInfoMu.Unlock()
+
+	current, err := s.store.GetTxInfo(info.GTID)
+	if err != nil {
+		return info, false, errors.Trace(err)
+	}
+	if current != nil {
+		next, err := current.Transit(info.Status)
+		if err != nil {
+			logger.Warn("tx info not saved: %s", err)
+			return *current, false, nil
 		}
+		next.Context = info.Context
+		info = next
 	}
+	if err := s.store.InsertTxInfo(info); err != nil {
+		return info, false, errors.Trace(err)
+	}
+	return info, true, nil
 }
 
-func (s *TxInfoSynchronizer) handleFoundNoEventTxInfo(info *types.TxInfo) error {
-	logger.Warn("binlog not found for tx: %s", info.GTID)
-	chInfo := info.ChTxInfo(types.StatusTxInfoUnprocessed)
-	if err := types.InsertTxInfo(chInfo); err != nil {
+func (s *TxInfoSynchronizer) handleUncoveredTxInfo(info *types.TxInfo) error {
+	logger.Warn("binlog not written to store yet for tx: %s, watermark: %s", info.GTID, s.watermark)
+	if _, _, err := s.saveTxInfo(info.ChTxInfo(types.StatusTxInfoPending)); err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-// processTxInfo 如果一条 tx_info 轮训了3次（3s）, 仍然没有找到完整的 binlog_event 则将这个 tx_info
-// 存入 tx_info 表且状态标记为未完成，processTxInfo 继续消费 kafka 中另外的 tx_info message.
-// 另外开一个 goroutine 轮训 tx_info 中过去 72 小时未完成的数据。
-func (s *TxInfoSynchronizer) processTxInfo(info *types.TxInfo) error {
-	events, err := tryListBinlogEvents(info.GTID)
+// saveAuditLog 将审计日志写入 store 的 audit_log 表, 失败只记录日志, 不影响 handler 的处理
+func (s *TxInfoSynchronizer) saveAuditLog(audit *types.AuditLog) {
+	chAuditLogs, err := audit.ChAuditLogs()
+	if err == nil {
+		err = s.store.InsertAuditLogs(chAuditLogs)
+	}
+	if err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+		logger.Error("save audit log failed, gtid: %s", audit.GTID)
+	}
+}
+
+// processTxInfo 等待 watermark 覆盖 tx_info 的 GTID, 此时该事务的 binlog_event 一定已经写入 store:
+// 从 join 窗口或者 store 中查到则生成审计日志, 查不到说明事务没有修改需要审计的表, 标记为 ignored.
+// 超过 defaultWatermarkWait 仍没有覆盖(binlog syncer 落后或者停止)时标记为 pending, 由 handlePendingTxInfo
+// 在 watermark 覆盖之后处理, processTxInfo 继续消费 kafka 中另外的 tx_info message.
+// 审计日志交给 handler 之后, 或者 tx_info 的状态写入 store 之后才会 ack, 之前退出时重启后重新消费.
+// 重新消费时状态不会回退(见 saveTxInfo), 已经处理过的 tx_info 不会再生成审计日志(见 undispatched)
+func (s *TxInfoSynchronizer) processTxInfo(ctx context.Context, info *types.TxInfo, ack broker.Ack) error {
+	if !s.watermark.Wait(ctx, info.GTID, defaultWatermarkWait) {
+		if err := s.handleUncoveredTxInfo(info); err != nil {
+			return errors.Trace(err)
+		}
+		ack(true)
+		return nil
+	}
+
+	events, err := s.listBinlogEvents(info.GTID)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if len(events) == 0 {
-		if err := s.handleFoundNoEventTxInfo(info); err != nil {
+	if !types.CompleteBinlogEvents(events) {
+		if len(events) != 0 {
+			logger.Error("incomplete binlog events for covered tx: %s, got %d", info.GTID, len(events))
+		}
+		if _, _, err := s.saveTxInfo(info.ChTxInfo(types.StatusTxInfoIgnored)); err != nil {
 			return errors.Trace(err)
 		}
+		ack(true)
 		return nil
 	}
 
 	chInfo := info.ChTxInfo(types.StatusTxInfoProcessed)
-	infoEvents := types.NewAuditLog(chInfo, events)
+	infoEvents, err := types.NewAuditLog(chInfo, events)
+	if err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+		if _, _, err := s.saveTxInfo(info.ChTxInfo(types.StatusTxInfoFailed)); err != nil {
+			return errors.Trace(err)
+		}
+		ack(true)
+		return nil
+	}
+	// 先写入状态, 之后检查的外部变更(见 processUnattributed)不会再为该事务生成审计日志
+	written, saved, err := s.saveTxInfo(chInfo)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// 与 unattributed 的审计日志使用相同的时间, 写入 audit_log 的同一个分区
+	infoEvents.Time = written.Time
+	if !saved {
+		redispatch, err := s.undispatched(infoEvents)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !redispatch {
+			ack(true)
+			return nil
+		}
+	}
+	s.saveAuditLog(infoEvents)
+	s.dispatch(infoEvents, ack)
+	return nil
+}
 
-	s.auditChan <- infoEvents
+// undispatched 重新消费的 tx_info 被拒绝转移到 processed 时, 审计日志是否仍需要交给 handler:
+// 只有 tx_info 已经是 processed 但审计日志还没有交给过 handler(上次在写入状态之后、交给 handler 之前退出)时需要,
+// 其他情况(已经交给过 handler, 或者 ignored、failed 等最终状态)不再生成审计日志
+func (s *TxInfoSynchronizer) undispatched(audit *types.AuditLog) (bool, error) {
+	current, err := s.store.GetTxInfo(audit.GTID)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if current == nil || current.Status != types.StatusTxInfoProcessed {
+		return false, nil
+	}
+	dispatched, err := s.store.IsDispatched(auditLogID(audit))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return !dispatched, nil
+}
 
-	err = types.InsertTxInfo(chInfo)
-	return nil
+// listBinlogEvents 先从 join 窗口中查找事务的 binlog_event, 找不到(超出窗口)时查询 store
+func (s *TxInfoSynchronizer) listBinlogEvents(gtid string) ([]types.ChBinlogEvent, error) {
+	if s.join != nil {
+		if events, ok := s.join.take(gtid); ok {
+			return events, nil
+		}
+	}
+	events, err := s.store.ListBinlogEvents([]string{gtid})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return events, nil
 }
 
-// Sync 获取kafka中的txInfo数据,根据gtid从clickhouse中获取对应的binlogEvent
-// 然后将二者组合,流入auditChan,最后将txInfo存入clickhouse
-func (s *TxInfoSynchronizer) Sync() {
-	go s.handleUnprocessedTxInfo()
+// Start 获取kafka中的txInfo数据,根据gtid从store中获取对应的binlogEvent
+// 然后将二者组合,流入auditChan交给fn处理,最后将txInfo存入store. ctx 被取消时停止消费 kafka
+func (s *TxInfoSynchronizer) Start(ctx context.Context, fn func(txEvent *types.AuditLog) error) error {
+	if s.done != nil {
+		return errors.New("tx info syncer already started")
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.abort = make(chan struct{})
+	s.done = make(chan struct{})
 
+	var producers sync.WaitGroup
+	producers.Add(2)
+	go func() {
+		defer producers.Done()
+		s.handlePendingTxInfo(ctx)
+	}()
+	if s.embedded != nil {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			s.handleEmbedded()
+		}()
+	}
+	if s.unattributed != nil {
+		s.progress.start(time.Now())
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			s.handleUnattributed(ctx)
+		}()
+	}
 	go func() {
-		err := s.TxKafkaBroker.Consume(s.processTxInfo)
+		defer producers.Done()
+		err := s.TxBroker.Consume(ctx, func(info *types.TxInfo, ack broker.Ack) error {
+			s.progress.consumed(time.Unix(info.Time, 0), time.Now())
+			return s.processTxInfo(ctx, info, ack)
+		})
 		if err != nil {
 			logger.ErrorDetails(errors.Trace(err))
 		}
 	}()
+	go func() {
+		producers.Wait()
+		close(s.auditChan)
+	}()
+	go func() {
+		defer close(s.done)
+		s.HandleAuditLog(fn)
+	}()
+	return nil
 }
 
-func tryListBinlogEvents(gtid string) ([]types.ChBinlogEvent, error) {
-	events, err := types.ListBinlogEvent(gtid)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	if len(events) > 0 {
-		return events, nil
+// Stop 停止消费 kafka, 等待 auditChan 中剩余的审计日志处理完毕后返回.
+// ctx 超时则中止重试(正在重试的审计日志写入死信)并返回 ctx.Err()
+func (s *TxInfoSynchronizer) Stop(ctx context.Context) error {
+	if s.done == nil {
+		return nil
 	}
+	s.cancel()
 
-	ticker := time.NewTicker(defaultGetBinlogInterval)
-	defer ticker.Stop()
-
-	var retry uint16
-	for {
-		select {
-		case <-ticker.C:
-			events, err = types.ListBinlogEvent(gtid)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-			if len(events) == 0 {
-				retry++
-				if retry >= defaultGenBinlogMaxRetry {
-					return nil, nil
-				}
-				continue
-			}
-			return events, nil
-		}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		// 多次调用 Stop 时只中止一次
+		s.abortOnce.Do(func() { close(s.abort) })
+		return errors.Trace(ctx.Err())
 	}
 }
 
-type unprocessedInfos struct {
-	minTime      time.Time
+type pendingInfos struct {
 	gtidArr      []string
 	mapGtid2Info map[string]types.ChTxInfo
 }
 
-func getUnprocessedInfos() (*unprocessedInfos, error) {
-	infos, err := types.ListUnprocessedTxInfo()
+func getPendingInfos(store store.Store) (*pendingInfos, error) {
+	infos, err := store.ListPendingTxInfo(time.Now().Add(-defaultPendingLookback), defaultPendingLimit)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -162,36 +420,49 @@ func getUnprocessedInfos() (*unprocessedInfos, error) {
 		return nil, nil
 	}
 
-	result := &unprocessedInfos{
-		minTime:      infos[0].Time,
-		gtidArr:      make([]string, len(infos)),
+	result := &pendingInfos{
+		gtidArr:      make([]string, 0, len(infos)),
 		mapGtid2Info: make(map[string]types.ChTxInfo, len(infos)),
 	}
-
 	for _, info := range infos {
 		result.Add(info)
 	}
 	return result, nil
 }
 
-func (i *unprocessedInfos) Empty() bool {
+func (i *pendingInfos) Empty() bool {
 	return i == nil || len(i.gtidArr) == 0
 }
 
-func (i *unprocessedInfos) Add(info types.ChTxInfo) {
-	if info.Time.UnixNano() < i.minTime.UnixNano() {
-		i.minTime = info.Time
-	}
+func (i *pendingInfos) Add(info types.ChTxInfo) {
 	i.gtidArr = append(i.gtidArr, info.GTID)
 	i.mapGtid2Info[info.GTID] = info
 }
 
-func (i *unprocessedInfos) getToProcess() (
+// getToProcess 处理 watermark 已经覆盖的 pending: 有 binlog_event 的生成审计日志并转移到 processed,
+// 没有的转移到 ignored. 没有覆盖的 binlog_event 可能还没有写入 store, 留到之后处理, 超过 defaultPendingExpiry 的转移到 expired
+func (i *pendingInfos) getToProcess(store store.Store, watermark *Watermark) (
 	toProcessInfoEvents []*types.AuditLog,
 	toProcessInfo []types.ChTxInfo,
 	err error,
 ) {
-	toProcessEvents, err := types.ListBinlogEvents(i.gtidArr)
+	expiredBefore := time.Now().Add(-defaultPendingExpiry)
+	covered := make([]string, 0, len(i.gtidArr))
+	for _, gtid := range i.gtidArr {
+		if watermark.Covers(gtid) {
+			covered = append(covered, gtid)
+			continue
+		}
+		if info := i.mapGtid2Info[gtid]; info.Time.Before(expiredBefore) {
+			logger.Warn("tx info expired, gtid: %s, watermark: %s", gtid, watermark)
+			toProcessInfo = appendTransit(toProcessInfo, info, types.StatusTxInfoExpired)
+		}
+	}
+	if len(covered) == 0 {
+		return nil, toProcessInfo, nil
+	}
+
+	toProcessEvents, err := store.ListBinlogEvents(covered)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
@@ -201,30 +472,81 @@ func (i *unprocessedInfos) getToProcess() (
 		mapGtid2Events[event.GTID] = append(mapGtid2Events[event.GTID], event)
 	}
 
-	for gtid, gEvents := range mapGtid2Events {
-		info, found := i.mapGtid2Info[gtid]
-		if !found {
+	for _, gtid := range covered {
+		info := i.mapGtid2Info[gtid]
+		gEvents := mapGtid2Events[gtid]
+		if !types.CompleteBinlogEvents(gEvents) {
+			if len(gEvents) != 0 {
+				logger.Error("incomplete binlog events for covered tx: %s, got %d", gtid, len(gEvents))
+			}
+			toProcessInfo = appendTransit(toProcessInfo, info, types.StatusTxInfoIgnored)
 			continue
 		}
 
-		toProcessInfoEvent := types.NewAuditLog(info, gEvents)
+		toProcessInfoEvent, err := types.NewAuditLog(info, gEvents)
+		if err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+			toProcessInfo = appendTransit(toProcessInfo, info, types.StatusTxInfoFailed)
+			continue
+		}
 		toProcessInfoEvents = append(toProcessInfoEvents, toProcessInfoEvent)
-
-		info.Status = types.StatusTxInfoProcessed
-		toProcessInfo = append(toProcessInfo, info)
+		toProcessInfo = appendTransit(toProcessInfo, info, types.StatusTxInfoProcessed)
 	}
 	return toProcessInfoEvents, toProcessInfo, nil
 }
 
+// appendTransit 将 info 转移到状态 to 的新版本加入 infos, 不允许的转移只记录日志
+func appendTransit(infos []types.ChTxInfo, info types.ChTxInfo, to uint8) []types.ChTxInfo {
+	next, err := info.Transit(to)
+	if err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+		return infos
+	}
+	return append(infos, next)
+}
+
 var (
 	TxInfoSyncer *TxInfoSynchronizer
 )
 
+// NewTxInfoSyncerFromConfig 根据配置创建独立的 TxInfoSynchronizer, 不依赖包级别的全局变量
+func NewTxInfoSyncerFromConfig(cfg *config.MainConfig, store store.Store) (*TxInfoSynchronizer, error) {
+	groupID := cfg.Kafka.TxInfoGroupID
+	if groupID == "" {
+		groupID = defaultTxInfoGroupID
+	}
+	transport, err := newTransport(cfg, cfg.Kafka.TxInfoTopic, groupID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := NewTxInfoSyncer(broker.NewTxBroker(transport), store)
+	if cfg.DeadLetter != nil {
+		s.SetHandleRetryPolicy(NewRetryPolicy(
+			time.Duration(cfg.DeadLetter.RetryInterval)*time.Second,
+			time.Duration(cfg.DeadLetter.RetryMaxInterval)*time.Second,
+			cfg.DeadLetter.MaxAttempts,
+		))
+		sink, err := deadletter.New(cfg.DeadLetter, store)
+		if err != nil {
+			transport.Close()
+			return nil, errors.Trace(err)
+		}
+		s.SetDeadLetterSink(sink)
+	}
+	if cfg.Unattributed != nil && cfg.Unattributed.Enable {
+		s.SetUnattributedPolicy(NewUnattributedPolicy(
+			time.Duration(cfg.Unattributed.GracePeriod)*time.Second,
+			time.Duration(cfg.Unattributed.CheckInterval)*time.Second,
+			time.Duration(cfg.Unattributed.Lookback)*time.Second,
+		))
+	}
+	return s, nil
+}
+
 func InitTxInfoSyncer() (err error) {
-	TxInfoBroker, err := broker.NewTxKafkaBroker(config.Kafka.Addrs, config.Kafka.TxInfoTopic)
+	TxInfoSyncer, err = NewTxInfoSyncerFromConfig(config.Main, store.S)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	TxInfoSyncer = NewTxInfoSyncer(TxInfoBroker)
 	return nil
 }
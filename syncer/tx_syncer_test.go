@@ -0,0 +1,201 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+	"github.com/obgnail/mysql-river/river"
+)
+
+func TestSaveTxInfo(t *testing.T) {
+	initTestLogger(t)
+
+	cases := []struct {
+		name      string
+		statuses  []uint8 // 依次写入的状态
+		wantSaved []bool
+		want      uint8 // 最后的状态
+	}{
+		{
+			name:      "first write",
+			statuses:  []uint8{types.StatusTxInfoPending},
+			wantSaved: []bool{true},
+			want:      types.StatusTxInfoPending,
+		},
+		{
+			name:      "pending to processed",
+			statuses:  []uint8{types.StatusTxInfoPending, types.StatusTxInfoProcessed},
+			wantSaved: []bool{true, true},
+			want:      types.StatusTxInfoProcessed,
+		},
+		{
+			name:      "redelivered after processed",
+			statuses:  []uint8{types.StatusTxInfoProcessed, types.StatusTxInfoPending, types.StatusTxInfoProcessed},
+			wantSaved: []bool{true, false, false},
+			want:      types.StatusTxInfoProcessed,
+		},
+		{
+			name:      "processed to failed",
+			statuses:  []uint8{types.StatusTxInfoProcessed, types.StatusTxInfoFailed},
+			wantSaved: []bool{true, true},
+			want:      types.StatusTxInfoFailed,
+		},
+		{
+			name:      "unattributed to processed",
+			statuses:  []uint8{types.StatusTxInfoUnattributed, types.StatusTxInfoProcessed},
+			wantSaved: []bool{true, true},
+			want:      types.StatusTxInfoProcessed,
+		},
+		{
+			name:      "ignored not reopened",
+			statuses:  []uint8{types.StatusTxInfoIgnored, types.StatusTxInfoPending},
+			wantSaved: []bool{true, false},
+			want:      types.StatusTxInfoIgnored,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &TxInfoSynchronizer{store: store.NewMemoryStore()}
+			for i, status := range c.statuses {
+				info := types.NewChTxInfo(time.Now(), "ctx", "uuid:1", status)
+				_, saved, err := s.saveTxInfo(info)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if saved != c.wantSaved[i] {
+					t.Fatalf("saveTxInfo(%s) = %v, want %v",
+						types.TxInfoStatusName(status), saved, c.wantSaved[i])
+				}
+			}
+			got, err := s.store.GetTxInfo("uuid:1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || got.Status != c.want {
+				t.Fatalf("status = %v, want %s", got, types.TxInfoStatusName(c.want))
+			}
+		})
+	}
+}
+
+// testTransaction 返回 gtid 对应的事务中一行插入的 binlog_event
+func testTransaction(t *testing.T, gtid string) []types.ChBinlogEvent {
+	t.Helper()
+	return testBinlogTransaction(t, gtid).ChEvents()
+}
+
+// testBinlogTransaction 返回 gtid 对应的只插入了一行的事务
+func testBinlogTransaction(t *testing.T, gtid string) *types.BinlogTransaction {
+	t.Helper()
+	event, err := types.NewBinlogEvent(&river.EventData{
+		EventType: river.EventTypeInsert,
+		Db:        "shop",
+		Table:     "user",
+		After:     map[string]interface{}{"id": 1, "name": "alice"},
+		GTIDSet:   gtid,
+		Timestamp: uint32(time.Now().Unix()),
+	}, []string{"id"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.BinlogTransaction{GTID: gtid, RowCount: 1, Events: []*types.BinlogEvent{event}}
+}
+
+// drainAuditLogs 将 auditChan 中的审计日志交给 fn, 返回处理的数量
+func drainAuditLogs(s *TxInfoSynchronizer, fn func(*types.AuditLog) error) int {
+	n := 0
+	for {
+		select {
+		case msg := <-s.auditChan:
+			s.handleAuditLog(msg.audit, fn)
+			if msg.ack != nil {
+				msg.ack(true)
+			}
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+func TestProcessTxInfoRedelivered(t *testing.T) {
+	initTestLogger(t)
+
+	const gtid = testServer + ":1"
+	cases := []struct {
+		name        string
+		handleFirst bool  // 第一次消费后审计日志是否交给了 handler(否则在交给 handler 之前退出)
+		status      uint8 // 第一次消费之后修改的状态, 0 表示不修改
+		want        int   // handler 总共收到的审计日志
+		wantResent  int   // 重新消费时生成的审计日志
+	}{
+		{name: "processed", handleFirst: true, want: 1, wantResent: 0},
+		{name: "exit before handler", handleFirst: false, want: 1, wantResent: 1},
+		{name: "failed", handleFirst: true, status: types.StatusTxInfoFailed, want: 1, wantResent: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := store.NewMemoryStore()
+			if err := s.InsertBinlogEvents(testTransaction(t, gtid)); err != nil {
+				t.Fatal(err)
+			}
+			info := &types.TxInfo{Time: time.Now().Unix(), Context: "ctx", GTID: gtid}
+
+			handled := 0
+			handler := func(*types.AuditLog) error {
+				handled++
+				return nil
+			}
+			// 每次消费使用新的 TxInfoSynchronizer, 相当于重启
+			consume := func(handle bool) (bool, int) {
+				syncer := NewTxInfoSyncer(nil, s)
+				syncer.watermark.advance([]string{gtid})
+				acked := false
+				ack := func(commit bool) { acked = commit }
+				if err := syncer.processTxInfo(context.Background(), info, ack); err != nil {
+					t.Fatal(err)
+				}
+				dispatched := len(syncer.auditChan)
+				if handle {
+					drainAuditLogs(syncer, handler)
+				}
+				return acked, dispatched
+			}
+
+			consume(c.handleFirst)
+			if c.status != 0 {
+				current, err := s.GetTxInfo(gtid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				next, err := current.Transit(c.status)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.InsertTxInfo(next); err != nil {
+					t.Fatal(err)
+				}
+			}
+			acked, resent := consume(true)
+			if !acked {
+				t.Fatal("redelivered tx_info not acked")
+			}
+			if resent != c.wantResent {
+				t.Fatalf("redelivered tx_info dispatched %d audit logs, want %d", resent, c.wantResent)
+			}
+			if handled != c.want {
+				t.Fatalf("handled %d audit logs, want %d", handled, c.want)
+			}
+			records, _, err := s.QueryAuditLogs(&types.AuditLogQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("audit_log rows = %d, want 1", len(records))
+			}
+		})
+	}
+}
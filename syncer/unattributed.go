@@ -0,0 +1,227 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"github.com/juju/errors"
+	auditContext "github.com/obgnail/audit-log/context"
+	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUnattributedGracePeriod   = 60 * time.Second
+	defaultUnattributedCheckInterval = 10 * time.Second
+	defaultUnattributedLookback      = 1 * time.Hour
+	defaultUnattributedBatchSize     = 1000
+)
+
+// UnattributedPolicy 没有 tx_info 的事务的处理策略, tx_info 的消费追上 binlog 之后(见 txInfoProgress)
+// 再过 GracePeriod 仍没有 tx_info 则认为是外部的变更, 使用 auditContext.Unattributed 生成审计日志
+type UnattributedPolicy struct {
+	GracePeriod   time.Duration
+	CheckInterval time.Duration
+	Lookback      time.Duration // 只检查最近 Lookback 内的 binlog_event
+}
+
+func NewUnattributedPolicy(gracePeriod, checkInterval, lookback time.Duration) *UnattributedPolicy {
+	if gracePeriod <= 0 {
+		gracePeriod = defaultUnattributedGracePeriod
+	}
+	if checkInterval <= 0 {
+		checkInterval = defaultUnattributedCheckInterval
+	}
+	if lookback <= 0 {
+		lookback = defaultUnattributedLookback
+	}
+	return &UnattributedPolicy{GracePeriod: gracePeriod, CheckInterval: checkInterval, Lookback: lookback}
+}
+
+// txInfoProgress 记录 tx_info 的消费进度. 重启之后 kafka 中可能积压了停止期间的 tx_info,
+// 不能按 binlog 的时间判断 tx_info 是否已经到达, 而是以 tx_info 的消费追上的时间为准:
+// 正在消费时只追上了已经消费的 tx_info 中最新的时间; 连续 idle 时间没有消费到 tx_info 时认为已经没有积压, 追上了当前时间.
+// 多个 partition 之间的 tx_info 可能乱序, 由 GracePeriod 容忍
+type txInfoProgress struct {
+	mu           sync.Mutex
+	latest       time.Time // 已经消费的 tx_info 中最新的时间
+	lastConsumed time.Time // 最后一次消费到 tx_info 的时间, 启动时为启动时间
+}
+
+func (p *txInfoProgress) start(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastConsumed = now
+}
+
+func (p *txInfoProgress) consumed(infoTime, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if infoTime.After(p.latest) {
+		p.latest = infoTime
+	}
+	p.lastConsumed = now
+}
+
+// caughtUp 返回 tx_info 的消费已经追上的时间, 还没有启动或者启动之后还不能确定时返回零值
+func (p *txInfoProgress) caughtUp(now time.Time, idle time.Duration) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.lastConsumed.IsZero() && now.Sub(p.lastConsumed) >= idle {
+		return now
+	}
+	if p.latest.After(now) {
+		return now
+	}
+	return p.latest
+}
+
+// SourceResolver 查询执行事务的 MySQL 用户和主机, 查不到时返回空字符串
+type SourceResolver interface {
+	ResolveSource(gtid string) (user, host string, err error)
+}
+
+// MySQLSourceResolver 从 performance_schema 中查询执行事务的用户和主机.
+// row 格式的 binlog 中没有这些信息, 只有在 events_transactions_history(_long) 中还保留着该事务,
+// 并且执行事务的连接还没有断开时才能查到
+type MySQLSourceResolver struct {
+	db *sql.DB
+}
+
+func NewMySQLSourceResolver(db *sql.DB) *MySQLSourceResolver {
+	return &MySQLSourceResolver{db: db}
+}
+
+func (r *MySQLSourceResolver) ResolveSource(gtid string) (user, host string, err error) {
+	query := "SELECT t.PROCESSLIST_USER, t.PROCESSLIST_HOST FROM (" +
+		"SELECT THREAD_ID FROM performance_schema.events_transactions_history WHERE GTID=? " +
+		"UNION SELECT THREAD_ID FROM performance_schema.events_transactions_history_long WHERE GTID=?" +
+		") e JOIN performance_schema.threads t ON t.THREAD_ID=e.THREAD_ID LIMIT 1;"
+	var u, h sql.NullString
+	err = r.db.QueryRow(query, gtid, gtid).Scan(&u, &h)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	return u.String, h.String, nil
+}
+
+// SetUnattributedPolicy 开启外部变更的审计, 为 nil 时关闭. 需要在 Start 之前调用
+func (s *TxInfoSynchronizer) SetUnattributedPolicy(policy *UnattributedPolicy) {
+	s.unattributed = policy
+}
+
+// SetSourceResolver 设置外部变更的 MySQL 用户和主机的查询方式, 为 nil 时不查询
+func (s *TxInfoSynchronizer) SetSourceResolver(resolver SourceResolver) {
+	s.sourceResolver = resolver
+}
+
+// handleUnattributed 定时为 tx_info 的消费追上之后超过 GracePeriod 仍没有 tx_info 的 binlog_event 生成审计日志,
+// 并写入对应的 tx_info(unattributed), 之后不会再次生成. 之后收到 tx_info 时 processTxInfo 使用 tx_info 中的 Context
+// 重新生成审计日志(ID 不同, 不会被去重), 时间与 unattributed 的相同(见 saveTxInfo), 覆盖 audit_log 中的数据,
+// tx_info 转移到 processed
+func (s *TxInfoSynchronizer) handleUnattributed(ctx context.Context) {
+	policy := s.unattributed
+	ticker := time.NewTicker(policy.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			caughtUp := s.progress.caughtUp(time.Now(), policy.GracePeriod)
+			if caughtUp.IsZero() {
+				continue
+			}
+			until := caughtUp.Add(-policy.GracePeriod)
+			gtids, err := s.store.ListUnattributedGTIDs(until.Add(-policy.Lookback), until, defaultUnattributedBatchSize)
+			if err != nil {
+				logger.ErrorDetails(errors.Trace(err))
+				continue
+			}
+			if len(gtids) == 0 {
+				continue
+			}
+			if err := s.processUnattributed(gtids); err != nil {
+				logger.ErrorDetails(errors.Trace(err))
+			}
+		}
+	}
+}
+
+func (s *TxInfoSynchronizer) processUnattributed(gtids []string) error {
+	audits, err := s.saveUnattributed(gtids)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, audit := range audits {
+		logger.Warn("unattributed change found, gtid: %s, context: %s", audit.GTID, audit.Context)
+		s.saveAuditLog(audit)
+		s.dispatch(audit, nil)
+	}
+	return nil
+}
+
+// saveUnattributed 为仍然没有 tx_info 的事务写入 unattributed 状态, 返回需要交给 handler 的审计日志.
+// 检查和写入之间持有 txInfoMu, 与 saveTxInfo 互斥
+func (s *TxInfoSynchronizer) saveUnattributed(gtids []string) ([]*types.AuditLog, error) {
+	events, err := s.store.ListBinlogEvents(gtids)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	mapGtid2Events := make(map[string][]types.ChBinlogEvent)
+	for _, event := range events {
+		mapGtid2Events[event.GTID] = append(mapGtid2Events[event.GTID], event)
+	}
+
+	s.txInfoMu.Lock()
+	defer s.txInfoMu.Unlock()
+
+	audits := make([]*types.AuditLog, 0, len(mapGtid2Events))
+	infos := make([]types.ChTxInfo, 0, len(mapGtid2Events))
+	for gtid, gEvents := range mapGtid2Events {
+		if !types.CompleteBinlogEvents(gEvents) {
+			continue
+		}
+		// 查询之后 tx_info 可能已经到达
+		current, err := s.store.GetTxInfo(gtid)
+		if err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+			continue
+		}
+		if current != nil {
+			continue
+		}
+		info := types.NewChTxInfo(gEvents[0].Time, s.unattributedContext(gtid).String(), gtid, types.StatusTxInfoUnattributed)
+		audit, err := types.NewAuditLog(info, gEvents)
+		if err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+			continue
+		}
+		audit.ID = types.UnattributedAuditLogID(gtid)
+		audits = append(audits, audit)
+		infos = append(infos, info)
+	}
+
+	if err := s.store.BatchInsertTxInfo(infos); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return audits, nil
+}
+
+func (s *TxInfoSynchronizer) unattributedContext(gtid string) auditContext.Context {
+	var user, host string
+	if s.sourceResolver != nil {
+		var err error
+		if user, host, err = s.sourceResolver.ResolveSource(gtid); err != nil {
+			logger.ErrorDetails(errors.Trace(err))
+		}
+	}
+	serverUUID := strings.SplitN(gtid, ":", 2)[0]
+	return auditContext.Unattributed(user, host, serverUUID)
+}
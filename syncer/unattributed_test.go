@@ -0,0 +1,135 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	auditContext "github.com/obgnail/audit-log/context"
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+)
+
+func TestTxInfoProgress(t *testing.T) {
+	const idle = time.Minute
+	start := time.Unix(1700000000, 0)
+
+	cases := []struct {
+		name     string
+		started  bool
+		consumed []time.Time // 依次消费的 tx_info 的时间, 消费时的当前时间为 start
+		now      time.Time
+		want     time.Time
+	}{
+		{name: "not started", now: start.Add(2 * idle), want: time.Time{}},
+		{name: "started recently", started: true, now: start.Add(idle / 2), want: time.Time{}},
+		{name: "idle after start", started: true, now: start.Add(idle), want: start.Add(idle)},
+		{
+			name:     "consuming backlog",
+			started:  true,
+			consumed: []time.Time{start.Add(-time.Hour), start.Add(-2 * time.Hour)},
+			now:      start.Add(idle / 2),
+			want:     start.Add(-time.Hour),
+		},
+		{
+			name:     "idle after backlog",
+			started:  true,
+			consumed: []time.Time{start.Add(-time.Hour)},
+			now:      start.Add(idle),
+			want:     start.Add(idle),
+		},
+		{
+			name:     "tx_info time ahead of clock",
+			started:  true,
+			consumed: []time.Time{start.Add(time.Hour)},
+			now:      start.Add(idle / 2),
+			want:     start.Add(idle / 2),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := &txInfoProgress{}
+			if c.started {
+				p.start(start)
+			}
+			for _, infoTime := range c.consumed {
+				p.consumed(infoTime, start)
+			}
+			if got := p.caughtUp(c.now, idle); !got.Equal(c.want) {
+				t.Fatalf("caughtUp = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSaveUnattributed(t *testing.T) {
+	initTestLogger(t)
+
+	const (
+		external   = testServer + ":1"
+		attributed = testServer + ":2"
+		incomplete = testServer + ":3"
+	)
+	s := store.NewMemoryStore()
+	var events []types.ChBinlogEvent
+	events = append(events, testTransaction(t, external)...)
+	events = append(events, testTransaction(t, attributed)...)
+	partial := testTransaction(t, incomplete)
+	partial[0].RowCount = 2
+	events = append(events, partial...)
+	if err := s.InsertBinlogEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertTxInfo(types.NewChTxInfo(time.Now(), "ctx", attributed, types.StatusTxInfoPending)); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := NewTxInfoSyncer(nil, s)
+	gtids := []string{external, attributed, incomplete}
+	audits, err := syncer.saveUnattributed(gtids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 1 || audits[0].GTID != external {
+		t.Fatalf("saveUnattributed = %v, want only %s", audits, external)
+	}
+	audit := audits[0]
+	if audit.ID != types.UnattributedAuditLogID(external) {
+		t.Fatalf("audit log id = %s, want %s", audit.ID, types.UnattributedAuditLogID(external))
+	}
+	if ctx, err := auditContext.FromString(audit.Context); err != nil || ctx.Type != auditContext.TypeUnattributed {
+		t.Fatalf("audit log context = %s, err: %v", audit.Context, err)
+	}
+	info, err := s.GetTxInfo(external)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Status != types.StatusTxInfoUnattributed {
+		t.Fatalf("tx_info = %v, want unattributed", info)
+	}
+	if audits, err := syncer.saveUnattributed(gtids); err != nil || len(audits) != 0 {
+		t.Fatalf("saveUnattributed again = %v, %v, want none", audits, err)
+	}
+
+	// 迟到的 tx_info 的时间在另一个月, 审计日志和 tx_info 仍然使用 unattributed 的时间
+	late := &types.TxInfo{Time: info.Time.AddDate(0, 1, 0).Unix(), Context: "ctx", GTID: external}
+	syncer.watermark.advance([]string{external})
+	if err := syncer.processTxInfo(context.Background(), late, func(bool) {}); err != nil {
+		t.Fatal(err)
+	}
+	if len(syncer.auditChan) != 1 {
+		t.Fatalf("late tx_info dispatched %d audit logs, want 1", len(syncer.auditChan))
+	}
+	msg := <-syncer.auditChan
+	if msg.audit.ID != types.AuditLogID(external) || !msg.audit.Time.Equal(info.Time) {
+		t.Fatalf("late audit log = %s at %v, want %s at %v",
+			msg.audit.ID, msg.audit.Time, types.AuditLogID(external), info.Time)
+	}
+	processed, err := s.GetTxInfo(external)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed.Status != types.StatusTxInfoProcessed || !processed.Time.Equal(info.Time) {
+		t.Fatalf("tx_info = %v, want processed at %v", processed, info.Time)
+	}
+}
@@ -0,0 +1,121 @@
+package syncer
+
+import (
+	"context"
+	"github.com/juju/errors"
+	"github.com/obgnail/audit-log/logger"
+	"github.com/obgnail/audit-log/store"
+	"github.com/obgnail/audit-log/types"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatermarkWait         = 10 * time.Second
+	defaultWatermarkLoadInterval = 1 * time.Second
+)
+
+// Watermark binlog syncer 的进度: 已经写入 store 的 GTID 集合, 见 types.Watermark.
+// binlog syncer 每次写入 store 后推进并保存到 store; tx syncer 等待 watermark 覆盖 tx_info 的 GTID,
+// 覆盖后该事务的 binlog_event 一定已经写入 store(或者事务没有需要审计的 binlog_event).
+// 同一个进程中的 tx syncer 共享 binlog syncer 的 Watermark, 推进时立即被唤醒; 否则定时从 store 中加载
+type Watermark struct {
+	store store.Store
+
+	mu        sync.Mutex
+	watermark types.Watermark
+	advanced  chan struct{} // 推进时关闭并替换, 唤醒等待者
+}
+
+func NewWatermark(store store.Store) *Watermark {
+	return &Watermark{
+		store:     store,
+		watermark: make(types.Watermark),
+		advanced:  make(chan struct{}),
+	}
+}
+
+// load 合并 store 中保存的 watermark
+func (w *Watermark) load() error {
+	gtidSet, err := w.store.GetWatermark()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	saved, err := types.ParseWatermark(gtidSet)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watermark.Merge(saved) {
+		w.notify()
+	}
+	return nil
+}
+
+// advance 将已经写入 store 的消息覆盖的 GTID 集合加入 watermark 并保存到 store, 保存失败只记录日志, 之后的推进会再次保存.
+// 不同 partition 的消息可能乱序写入, 之前的事务还没有写入时不会被覆盖
+func (w *Watermark) advance(gtids []string) {
+	w.mu.Lock()
+	for _, gtid := range gtids {
+		if err := w.watermark.Advance(gtid); err != nil {
+			logger.Warn("invalid gtid in binlog: %s", gtid)
+		}
+	}
+	gtidSet := w.watermark.String()
+	w.notify()
+	w.mu.Unlock()
+
+	if err := w.store.SaveWatermark(gtidSet); err != nil {
+		logger.ErrorDetails(errors.Trace(err))
+	}
+}
+
+// notify 唤醒等待者, 需要持有 mu
+func (w *Watermark) notify() {
+	close(w.advanced)
+	w.advanced = make(chan struct{})
+}
+
+// Covers gtid 对应的事务是否已经写入 store
+func (w *Watermark) Covers(gtid string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.watermark.Covers(gtid)
+}
+
+func (w *Watermark) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.watermark.String()
+}
+
+// Wait 等待 watermark 覆盖 gtid, 超过 timeout 或者 ctx 被取消时返回 false
+func (w *Watermark) Wait(ctx context.Context, gtid string, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(defaultWatermarkLoadInterval)
+	defer ticker.Stop()
+
+	for {
+		w.mu.Lock()
+		covered, advanced := w.watermark.Covers(gtid), w.advanced
+		w.mu.Unlock()
+		if covered {
+			return true
+		}
+
+		select {
+		case <-advanced:
+		case <-ticker.C:
+			if err := w.load(); err != nil {
+				logger.ErrorDetails(errors.Trace(err))
+			}
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
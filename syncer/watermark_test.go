@@ -0,0 +1,97 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/obgnail/audit-log/store"
+)
+
+const testServer = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+func TestWatermarkBatchesOutOfOrder(t *testing.T) {
+	initTestLogger(t)
+
+	type batch []string // 一批消息覆盖的 GTID 集合
+
+	cases := []struct {
+		name    string
+		batches []batch // 依次写入 store 的批次
+		covered []string
+		pending []string
+	}{
+		{
+			name:    "in order",
+			batches: []batch{{testServer + ":1-3"}, {testServer + ":4-6"}},
+			covered: []string{testServer + ":1", testServer + ":6"},
+			pending: []string{testServer + ":7"},
+		},
+		{
+			name:    "later partition first",
+			batches: []batch{{testServer + ":4-6"}},
+			covered: []string{testServer + ":5"},
+			pending: []string{testServer + ":1", testServer + ":3"},
+		},
+		{
+			name:    "earlier partition finishes later",
+			batches: []batch{{testServer + ":4-6"}, {testServer + ":1-3"}},
+			covered: []string{testServer + ":1", testServer + ":3", testServer + ":6"},
+			pending: []string{testServer + ":7"},
+		},
+		{
+			name:    "interleaved partitions",
+			batches: []batch{{testServer + ":1", testServer + ":4"}, {testServer + ":6"}, {testServer + ":2-3"}},
+			covered: []string{testServer + ":1", testServer + ":3", testServer + ":4", testServer + ":6"},
+			pending: []string{testServer + ":5"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := store.NewMemoryStore()
+			w := NewWatermark(s)
+			for _, b := range c.batches {
+				w.advance(b)
+			}
+
+			// 其他进程从 store 中加载的结果相同
+			loaded := NewWatermark(s)
+			if err := loaded.load(); err != nil {
+				t.Fatal(err)
+			}
+			for _, watermark := range []*Watermark{w, loaded} {
+				for _, gtid := range c.covered {
+					if !watermark.Covers(gtid) {
+						t.Fatalf("Covers(%s) = false, want true, watermark: %s", gtid, watermark)
+					}
+				}
+				for _, gtid := range c.pending {
+					if watermark.Covers(gtid) {
+						t.Fatalf("Covers(%s) = true, want false, watermark: %s", gtid, watermark)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWatermarkWait(t *testing.T) {
+	initTestLogger(t)
+
+	w := NewWatermark(store.NewMemoryStore())
+	w.advance([]string{testServer + ":2"})
+
+	done := make(chan bool)
+	go func() {
+		done <- w.Wait(context.Background(), testServer+":1", time.Second)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Wait returned before the gtid was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.advance([]string{testServer + ":1"})
+	if !<-done {
+		t.Fatal("Wait = false, want true")
+	}
+}
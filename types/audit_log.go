@@ -0,0 +1,430 @@
+package types
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/juju/errors"
+	auditContext "github.com/obgnail/audit-log/context"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// ChAuditLog audit_log 表中的一行, 对应一个事务中一行数据的变更
+type ChAuditLog struct {
+	GTID          string    `ch:"gtid"`
+	Seq           uint32    `ch:"seq"` // 该变更在事务中的序号
+	Time          time.Time `ch:"time"`
+	Context       string    `ch:"context"`
+	ContextType   int64     `ch:"context_type"`
+	ContextParam1 string    `ch:"context_param_1"`
+	ContextParam2 string    `ch:"context_param_2"`
+	Db            string    `ch:"db"`
+	Table         string    `ch:"table"`
+	Action        int32     `ch:"action"`
+	PrimaryKey    string    `ch:"primary_key"` // json 格式的主键字段及其值, 查询时按字段比较, 见 PrimaryKeyCond
+	Columns       string    `ch:"columns"`     // json 格式的 []ColumnChange
+}
+
+// ChAuditLogs 将审计日志按照变更拆分成 audit_log 表中的行
+func (l *AuditLog) ChAuditLogs() ([]ChAuditLog, error) {
+	ctx, _ := auditContext.FromString(l.Context)
+
+	result := make([]ChAuditLog, 0, len(l.Changes))
+	for i, change := range l.Changes {
+		pk, err := json.Marshal(change.PrimaryKey)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		columns, err := json.Marshal(change.Columns)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		result = append(result, ChAuditLog{
+			GTID:          l.GTID,
+			Seq:           uint32(i),
+			Time:          l.Time,
+			Context:       l.Context,
+			ContextType:   int64(ctx.Type),
+			ContextParam1: ctx.Param1,
+			ContextParam2: ctx.Param2,
+			Db:            change.Db,
+			Table:         change.Table,
+			Action:        int32(change.Action),
+			PrimaryKey:    string(pk),
+			Columns:       string(columns),
+		})
+	}
+	return result, nil
+}
+
+// AuditLogRecord 审计日志查询的结果, 对应一行数据的变更以及其所在事务的信息
+type AuditLogRecord struct {
+	ID      string     `json:"id"` // 所在事务的审计日志 ID, 见 AuditLogID 和 UnattributedAuditLogID
+	GTID    string     `json:"gtid"`
+	Seq     int        `json:"seq"`
+	Time    time.Time  `json:"time"`
+	Context string     `json:"context"`
+	Change  *RowChange `json:"change"`
+}
+
+func (l *ChAuditLog) AuditLogRecord() (*AuditLogRecord, error) {
+	change := &RowChange{
+		Db:     l.Db,
+		Table:  l.Table,
+		Action: Action(l.Action),
+	}
+	if err := unmarshalUseNumber(l.PrimaryKey, &change.PrimaryKey); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := unmarshalUseNumber(l.Columns, &change.Columns); err != nil {
+		return nil, errors.Trace(err)
+	}
+	id := AuditLogID(l.GTID)
+	if l.ContextType == auditContext.TypeUnattributed {
+		id = UnattributedAuditLogID(l.GTID)
+	}
+	return &AuditLogRecord{
+		ID:      id,
+		GTID:    l.GTID,
+		Seq:     int(l.Seq),
+		Time:    l.Time,
+		Context: l.Context,
+		Change:  change,
+	}, nil
+}
+
+func unmarshalUseNumber(data string, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// AuditLogID 由 GTID 生成的审计日志 ID, 同一个事务的审计日志 ID 总是相同,
+// handler 和下游存储可以用它实现幂等
+func AuditLogID(gtid string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(gtid))))
+	return hex.EncodeToString(sum[:16])
+}
+
+// UnattributedAuditLogID 外部变更(没有 tx_info)的审计日志 ID, 与 AuditLogID 不同,
+// 之后收到 tx_info 时重新生成的审计日志不会被当作重复的审计日志跳过
+func UnattributedAuditLogID(gtid string) string {
+	return AuditLogID("unattributed:" + gtid)
+}
+
+// SaveDispatched 记录已经交给 handler 的审计日志
+func SaveDispatched(conn driver.Conn, id, gtid string) error {
+	sql := "INSERT INTO audit_log_dispatched (id, gtid, dispatched_at) VALUES ($1, $2, $3);"
+	if err := conn.Exec(context.Background(), sql, id, gtid, time.Now()); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// IsDispatched 审计日志是否已经交给过 handler
+func IsDispatched(conn driver.Conn, id string) (bool, error) {
+	sql := "SELECT count() FROM audit_log_dispatched WHERE id=$1;"
+	var count uint64
+	if err := conn.QueryRow(context.Background(), sql, id).Scan(&count); err != nil {
+		return false, errors.Trace(err)
+	}
+	return count > 0, nil
+}
+
+func InsertAuditLogs(conn driver.Conn, auditLogs []ChAuditLog) error {
+	if len(auditLogs) == 0 {
+		return nil
+	}
+	batch, err := conn.PrepareBatch(context.Background(),
+		"INSERT INTO audit_log (gtid, seq, time, context, context_type, context_param_1, context_param_2, "+
+			"db, table, action, primary_key, columns) VALUES")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, l := range auditLogs {
+		err := batch.Append(l.GTID, l.Seq, l.Time, l.Context, l.ContextType, l.ContextParam1, l.ContextParam2,
+			l.Db, l.Table, l.Action, l.PrimaryKey, l.Columns)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = batch.Send(); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// AuditLogQuery 审计日志的查询条件, 零值的字段不作为查询条件
+type AuditLogQuery struct {
+	StartTime     time.Time // 包含
+	EndTime       time.Time // 不包含
+	ContextType   *int
+	ContextParam1 string
+	ContextParam2 string
+	Db            string
+	Table         string
+	Action        *Action
+	PrimaryKey    map[string]interface{} // 每个字段的值都需要相等, 可以只指定部分主键字段
+	Cursor        string                 // 上一页返回的 nextCursor, 为空表示第一页
+	Limit         int                    // 默认 100, 最大 1000
+}
+
+// AuditLogCursor 分页游标, 记录上一页最后一条记录的排序键
+type AuditLogCursor struct {
+	Time int64  `json:"t"` // unix 毫秒
+	GTID string `json:"g"`
+	Seq  uint32 `json:"s"`
+}
+
+// Before 判断 l 是否排在游标之后(更旧), 排序键为 (time, gtid, seq) 倒序
+func (c *AuditLogCursor) Before(l *ChAuditLog) bool {
+	t := l.Time.UnixMilli()
+	if t != c.Time {
+		return t < c.Time
+	}
+	if l.GTID != c.GTID {
+		return l.GTID < c.GTID
+	}
+	return l.Seq < c.Seq
+}
+
+func encodeCursor(l *ChAuditLog) (string, error) {
+	b, err := json.Marshal(AuditLogCursor{Time: l.Time.UnixMilli(), GTID: l.GTID, Seq: l.Seq})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeCursor 解析查询条件中的游标, 没有游标时返回 nil
+func (q *AuditLogQuery) DecodeCursor() (*AuditLogCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, errors.Annotate(err, "invalid cursor")
+	}
+	cursor := new(AuditLogCursor)
+	if err := json.Unmarshal(b, cursor); err != nil {
+		return nil, errors.Annotate(err, "invalid cursor")
+	}
+	return cursor, nil
+}
+
+// PrimaryKeyCond 主键中一个字段的查询条件, 与 audit_log.primary_key 中该字段的值按 PrimaryKeyValue 比较
+type PrimaryKeyCond struct {
+	Column string
+	Value  string
+}
+
+// PrimaryKeyConds 返回按字段名排序的主键查询条件
+func (q *AuditLogQuery) PrimaryKeyConds() ([]PrimaryKeyCond, error) {
+	conds := make([]PrimaryKeyCond, 0, len(q.PrimaryKey))
+	for column, v := range q.PrimaryKey {
+		value, err := PrimaryKeyValue(v)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		conds = append(conds, PrimaryKeyCond{Column: column, Value: value})
+	}
+	sort.Slice(conds, func(i, j int) bool {
+		return conds[i].Column < conds[j].Column
+	})
+	return conds, nil
+}
+
+// PrimaryKeyValue 主键字段的值用于比较的字符串形式: 字符串为本身, 其他类型为 json 格式,
+// 与 clickhouse 的 JSONExtractString/JSONExtractRaw、sqlite 的 json_extract 的结果一致
+func PrimaryKeyValue(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case []byte:
+		return string(value), nil
+	case json.Number:
+		return value.String(), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(b), nil
+}
+
+// matchPrimaryKey 判断 json 格式的主键是否满足所有字段的条件
+func matchPrimaryKey(primaryKey string, conds []PrimaryKeyCond) bool {
+	if len(conds) == 0 {
+		return true
+	}
+	var pk map[string]interface{}
+	if err := unmarshalUseNumber(primaryKey, &pk); err != nil {
+		return false
+	}
+	for _, cond := range conds {
+		v, ok := pk[cond.Column]
+		if !ok {
+			return false
+		}
+		if value, err := PrimaryKeyValue(v); err != nil || value != cond.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// PageLimit 返回每页的数量, 默认 100, 最大 1000
+func (q *AuditLogQuery) PageLimit() int {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+	return limit
+}
+
+// Filter 将查询条件(包括游标)编译为过滤函数, 用于不支持 sql 的 store
+func (q *AuditLogQuery) Filter() (func(l *ChAuditLog) bool, error) {
+	pkConds, err := q.PrimaryKeyConds()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cursor, err := q.DecodeCursor()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return func(l *ChAuditLog) bool {
+		switch {
+		case !q.StartTime.IsZero() && l.Time.Before(q.StartTime),
+			!q.EndTime.IsZero() && !l.Time.Before(q.EndTime),
+			q.ContextType != nil && l.ContextType != int64(*q.ContextType),
+			q.ContextParam1 != "" && l.ContextParam1 != q.ContextParam1,
+			q.ContextParam2 != "" && l.ContextParam2 != q.ContextParam2,
+			q.Db != "" && l.Db != q.Db,
+			q.Table != "" && l.Table != q.Table,
+			q.Action != nil && l.Action != int32(*q.Action),
+			!matchPrimaryKey(l.PrimaryKey, pkConds),
+			cursor != nil && !cursor.Before(l):
+			return false
+		}
+		return true
+	}, nil
+}
+
+// NewAuditLogPage 将按照 (time, gtid, seq) 倒序排列、最多 limit+1 条的查询结果转换为一页审计日志,
+// 多出的一条用于判断是否还有下一页
+func NewAuditLogPage(rows []ChAuditLog, limit int) (records []*AuditLogRecord, nextCursor string, err error) {
+	if len(rows) > limit {
+		rows = rows[:limit]
+		if nextCursor, err = encodeCursor(&rows[limit-1]); err != nil {
+			return nil, "", errors.Trace(err)
+		}
+	}
+	records = make([]*AuditLogRecord, 0, len(rows))
+	for i := range rows {
+		record, err := rows[i].AuditLogRecord()
+		if err != nil {
+			return nil, "", errors.Trace(err)
+		}
+		records = append(records, record)
+	}
+	return records, nextCursor, nil
+}
+
+// QueryAuditLogs 按照时间从新到旧查询审计日志, nextCursor 为空表示没有更多数据
+func QueryAuditLogs(conn driver.Conn, q *AuditLogQuery) (records []*AuditLogRecord, nextCursor string, err error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	addCond := func(format string, values ...interface{}) {
+		placeholders := make([]interface{}, len(values))
+		for i, v := range values {
+			args = append(args, v)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		conds = append(conds, fmt.Sprintf(format, placeholders...))
+	}
+	formatTime := func(t time.Time) string {
+		return t.In(defaultLoc).Format(timeLayout)
+	}
+
+	if !q.StartTime.IsZero() {
+		addCond("time>=toDateTime64(%s, 3, 'Asia/Shanghai')", formatTime(q.StartTime))
+	}
+	if !q.EndTime.IsZero() {
+		addCond("time<toDateTime64(%s, 3, 'Asia/Shanghai')", formatTime(q.EndTime))
+	}
+	if q.ContextType != nil {
+		addCond("context_type=%s", int64(*q.ContextType))
+	}
+	if q.ContextParam1 != "" {
+		addCond("context_param_1=%s", q.ContextParam1)
+	}
+	if q.ContextParam2 != "" {
+		addCond("context_param_2=%s", q.ContextParam2)
+	}
+	if q.Db != "" {
+		addCond("db=%s", q.Db)
+	}
+	if q.Table != "" {
+		addCond("table=%s", q.Table)
+	}
+	if q.Action != nil {
+		addCond("action=%s", int32(*q.Action))
+	}
+	pkConds, err := q.PrimaryKeyConds()
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	for _, cond := range pkConds {
+		// 按字段比较, 与 json 中 key 的顺序和数字的类型无关
+		addCond("if(JSONType(primary_key, %s)='String', JSONExtractString(primary_key, %s), JSONExtractRaw(primary_key, %s))=%s",
+			cond.Column, cond.Column, cond.Column, cond.Value)
+	}
+	cursor, err := q.DecodeCursor()
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	if cursor != nil {
+		t := formatTime(time.UnixMilli(cursor.Time))
+		// 单独的 time 条件用于分区裁剪和 idx_time 索引, 元组比较无法使用它们
+		addCond("time<=toDateTime64(%s, 3, 'Asia/Shanghai')", t)
+		addCond("(time, gtid, seq)<(toDateTime64(%s, 3, 'Asia/Shanghai'), %s, %s)", t, cursor.GTID, cursor.Seq)
+	}
+
+	limit := q.PageLimit()
+	var sql strings.Builder
+	sql.WriteString("SELECT gtid, seq, time, context, context_type, context_param_1, context_param_2, " +
+		"db, table, action, primary_key, columns FROM audit_log FINAL")
+	if len(conds) != 0 {
+		sql.WriteString(" WHERE ")
+		sql.WriteString(strings.Join(conds, " AND "))
+	}
+	// 多查一条用于判断是否还有下一页
+	sql.WriteString(fmt.Sprintf(" ORDER BY time DESC, gtid DESC, seq DESC LIMIT %d;", limit+1))
+
+	rows := make([]ChAuditLog, 0)
+	if err := conn.Select(context.Background(), &rows, sql.String(), args...); err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	records, nextCursor, err = NewAuditLogPage(rows, limit)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	return records, nextCursor, nil
+}
@@ -0,0 +1,253 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testAuditTime = time.UnixMilli(1700000000000)
+
+func testAuditLogRow(gtid string, seq uint32, t time.Time) ChAuditLog {
+	return ChAuditLog{
+		GTID:       gtid,
+		Seq:        seq,
+		Time:       t,
+		Context:    "ctx",
+		Db:         "shop",
+		Table:      "user",
+		Action:     int32(EventActionUpdate),
+		PrimaryKey: `{"id":1}`,
+		Columns:    `[]`,
+	}
+}
+
+// sortAuditLogRows 按照 (time, gtid, seq) 倒序排列, 与 store 的查询顺序相同
+func sortAuditLogRows(rows []ChAuditLog) {
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.After(b.Time)
+		}
+		if a.GTID != b.GTID {
+			return a.GTID > b.GTID
+		}
+		return a.Seq > b.Seq
+	})
+}
+
+// queryPage 按照 Filter 和 limit+1 的预读查询一页, 与 MemoryStore.QueryAuditLogs 相同
+func queryPage(t *testing.T, rows []ChAuditLog, q *AuditLogQuery) ([]*AuditLogRecord, string) {
+	t.Helper()
+	filter, err := q.Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := q.PageLimit()
+	page := make([]ChAuditLog, 0, limit+1)
+	for i := range rows {
+		if len(page) > limit {
+			break
+		}
+		if filter(&rows[i]) {
+			page = append(page, rows[i])
+		}
+	}
+	records, nextCursor, err := NewAuditLogPage(page, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records, nextCursor
+}
+
+func TestNewAuditLogPage(t *testing.T) {
+	rows := []ChAuditLog{
+		testAuditLogRow("uuid:3", 0, testAuditTime.Add(2*time.Second)),
+		testAuditLogRow("uuid:2", 0, testAuditTime.Add(time.Second)),
+		testAuditLogRow("uuid:1", 0, testAuditTime),
+	}
+	cases := []struct {
+		name       string
+		rows       []ChAuditLog
+		limit      int
+		wantGTIDs  []string
+		wantCursor *AuditLogCursor
+	}{
+		{name: "empty", rows: nil, limit: 2, wantGTIDs: []string{}},
+		{name: "less than limit", rows: rows[:1], limit: 2, wantGTIDs: []string{"uuid:3"}},
+		{name: "exactly limit", rows: rows[:2], limit: 2, wantGTIDs: []string{"uuid:3", "uuid:2"}},
+		{
+			name:       "look ahead row",
+			rows:       rows,
+			limit:      2,
+			wantGTIDs:  []string{"uuid:3", "uuid:2"},
+			wantCursor: &AuditLogCursor{Time: testAuditTime.Add(time.Second).UnixMilli(), GTID: "uuid:2", Seq: 0},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			records, nextCursor, err := NewAuditLogPage(c.rows, c.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gtids := make([]string, 0, len(records))
+			for _, r := range records {
+				gtids = append(gtids, r.GTID)
+			}
+			if !reflect.DeepEqual(gtids, c.wantGTIDs) {
+				t.Fatalf("records = %v, want %v", gtids, c.wantGTIDs)
+			}
+			if c.wantCursor == nil {
+				if nextCursor != "" {
+					t.Fatalf("nextCursor = %q, want empty", nextCursor)
+				}
+				return
+			}
+			cursor, err := (&AuditLogQuery{Cursor: nextCursor}).DecodeCursor()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cursor, c.wantCursor) {
+				t.Fatalf("cursor = %+v, want %+v", cursor, c.wantCursor)
+			}
+		})
+	}
+}
+
+func TestAuditLogCursorBefore(t *testing.T) {
+	cursor := &AuditLogCursor{Time: testAuditTime.UnixMilli(), GTID: "uuid:5", Seq: 1}
+	cases := []struct {
+		name string
+		row  ChAuditLog
+		want bool
+	}{
+		{name: "older", row: testAuditLogRow("uuid:9", 9, testAuditTime.Add(-time.Millisecond)), want: true},
+		{name: "newer", row: testAuditLogRow("uuid:1", 0, testAuditTime.Add(time.Millisecond)), want: false},
+		{name: "same time smaller gtid", row: testAuditLogRow("uuid:4", 9, testAuditTime), want: true},
+		{name: "same time larger gtid", row: testAuditLogRow("uuid:6", 0, testAuditTime), want: false},
+		{name: "same gtid smaller seq", row: testAuditLogRow("uuid:5", 0, testAuditTime), want: true},
+		{name: "cursor row itself", row: testAuditLogRow("uuid:5", 1, testAuditTime), want: false},
+		{name: "same gtid larger seq", row: testAuditLogRow("uuid:5", 2, testAuditTime), want: false},
+		// 游标只保存到毫秒, 同一毫秒内的时间按 gtid、seq 比较
+		{name: "sub millisecond", row: testAuditLogRow("uuid:4", 0, testAuditTime.Add(500*time.Microsecond)), want: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := cursor.Before(&c.row); got != c.want {
+				t.Fatalf("Before = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// TestAuditLogPagination 逐页查询时每条记录出现且只出现一次, 页的边界落在相同时间的记录之间也不会重复或遗漏
+func TestAuditLogPagination(t *testing.T) {
+	var rows []ChAuditLog
+	for i := 0; i < 3; i++ {
+		// 同一时间的多个事务, 每个事务多行变更
+		for _, gtid := range []string{"uuid:1", "uuid:2"} {
+			for seq := uint32(0); seq < 2; seq++ {
+				rows = append(rows, testAuditLogRow(fmt.Sprintf("%s%d", gtid, i), seq, testAuditTime.Add(time.Duration(i)*time.Second)))
+			}
+		}
+	}
+	sortAuditLogRows(rows)
+
+	for _, limit := range []int{1, 3, 4, 5, len(rows), len(rows) + 1} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			var (
+				got    []string
+				cursor string
+				pages  int
+			)
+			for {
+				records, next := queryPage(t, rows, &AuditLogQuery{Limit: limit, Cursor: cursor})
+				if len(records) == 0 {
+					t.Fatalf("empty page %d returned with a cursor", pages)
+				}
+				for _, r := range records {
+					got = append(got, fmt.Sprintf("%s/%d", r.GTID, r.Seq))
+				}
+				pages++
+				if cursor = next; cursor == "" {
+					break
+				}
+			}
+			want := make([]string, 0, len(rows))
+			for _, r := range rows {
+				want = append(want, fmt.Sprintf("%s/%d", r.GTID, r.Seq))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("paged records = %v, want %v", got, want)
+			}
+			if wantPages := (len(rows) + limit - 1) / limit; pages != wantPages {
+				t.Fatalf("pages = %d, want %d", pages, wantPages)
+			}
+		})
+	}
+
+	// 没有数据时返回空页, 没有游标
+	records, next := queryPage(t, nil, &AuditLogQuery{})
+	if len(records) != 0 || next != "" {
+		t.Fatalf("empty query = %d records, cursor %q", len(records), next)
+	}
+}
+
+func TestAuditLogQueryFilter(t *testing.T) {
+	userType, otherType := 1, 2
+	update := EventActionUpdate
+	row := testAuditLogRow("uuid:1", 0, testAuditTime)
+	row.ContextType, row.ContextParam1 = int64(userType), "alice"
+	row.PrimaryKey = `{"id":12345678901234567890,"tenant":"t1"}`
+
+	cases := []struct {
+		name string
+		q    AuditLogQuery
+		want bool
+	}{
+		{name: "no condition", want: true},
+		{name: "start time inclusive", q: AuditLogQuery{StartTime: testAuditTime}, want: true},
+		{name: "end time exclusive", q: AuditLogQuery{EndTime: testAuditTime}, want: false},
+		{name: "context type", q: AuditLogQuery{ContextType: &userType, ContextParam1: "alice"}, want: true},
+		{name: "other context type", q: AuditLogQuery{ContextType: &otherType}, want: false},
+		{name: "action", q: AuditLogQuery{Action: &update, Db: "shop", Table: "user"}, want: true},
+		{name: "other table", q: AuditLogQuery{Table: "order"}, want: false},
+		{name: "partial primary key", q: AuditLogQuery{PrimaryKey: map[string]interface{}{"tenant": "t1"}}, want: true},
+		{name: "big integer primary key", q: AuditLogQuery{PrimaryKey: map[string]interface{}{"id": uint64(12345678901234567890)}}, want: true},
+		{name: "other primary key", q: AuditLogQuery{PrimaryKey: map[string]interface{}{"id": 1}}, want: false},
+		{name: "missing primary key column", q: AuditLogQuery{PrimaryKey: map[string]interface{}{"uid": 1}}, want: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			filter, err := c.q.Filter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter(&row); got != c.want {
+				t.Fatalf("filter = %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	for _, cursor := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := (&AuditLogQuery{Cursor: cursor}).Filter(); err == nil {
+			t.Fatalf("invalid cursor %q accepted", cursor)
+		}
+	}
+}
+
+func TestAuditLogQueryPageLimit(t *testing.T) {
+	cases := []struct{ limit, want int }{
+		{limit: 0, want: defaultQueryLimit},
+		{limit: -1, want: defaultQueryLimit},
+		{limit: 10, want: 10},
+		{limit: maxQueryLimit + 1, want: maxQueryLimit},
+	}
+	for _, c := range cases {
+		if got := (&AuditLogQuery{Limit: c.limit}).PageLimit(); got != c.want {
+			t.Fatalf("PageLimit(%d) = %d, want %d", c.limit, got, c.want)
+		}
+	}
+}
@@ -2,66 +2,127 @@ package types
 
 import (
 	"context"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/juju/errors"
-	"github.com/obgnail/audit-log/clickhouse"
 	"time"
 )
 
 type AuditLog struct {
+	ID           string    // 由 GTID 生成, 见 AuditLogID 和 UnattributedAuditLogID
 	Time         time.Time `ch:"time"`
 	Context      string    `ch:"context"`
 	GTID         string    `ch:"gtid"`
 	BinlogEvents []ChBinlogEvent
+	Changes      []*RowChange // 与 BinlogEvents 一一对应, 解析后的字段级别变更
 }
 
-func NewAuditLog(txInfo ChTxInfo, events []ChBinlogEvent) *AuditLog {
+func NewAuditLog(txInfo ChTxInfo, events []ChBinlogEvent) (*AuditLog, error) {
+	changes := make([]*RowChange, len(events))
+	for i := range events {
+		change, err := events[i].RowChange()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		changes[i] = change
+	}
+
 	txBinlogEvent := &AuditLog{
+		ID:           AuditLogID(txInfo.GTID),
 		Time:         txInfo.Time,
 		Context:      txInfo.Context,
 		GTID:         txInfo.GTID,
 		BinlogEvents: events,
+		Changes:      changes,
 	}
-	return txBinlogEvent
+	return txBinlogEvent, nil
 }
 
 type ChBinlogEvent struct {
-	Db     string `ch:"db"`
-	Table  string `ch:"table"`
-	Action int32  `ch:"action"`
-	GTID   string `ch:"gtid"`
-	Data   string `ch:"data"`
+	Db       string    `ch:"db"`
+	Table    string    `ch:"table"`
+	Action   int32     `ch:"action"`
+	GTID     string    `ch:"gtid"`
+	Data     string    `ch:"data"`
+	Time     time.Time `ch:"time"`
+	Seq      uint32    `ch:"seq"`       // 在事务中的序号, 从 0 开始
+	LogFile  string    `ch:"log_file"`  // binlog 文件名
+	LogPos   uint32    `ch:"log_pos"`   // binlog 位置
+	RowCount uint32    `ch:"row_count"` // 事务中 binlog event 的总数, 0 表示未知(旧数据)
+}
+
+// CompleteBinlogEvents 判断一个事务的 binlog event 是否已经完整: 查到的数量达到 RowCount(多次写入时取最大的 RowCount).
+// 没有 RowCount 的旧数据只要查到就认为完整
+func CompleteBinlogEvents(events []ChBinlogEvent) bool {
+	if len(events) == 0 {
+		return false
+	}
+	var rowCount uint32
+	for _, event := range events {
+		if event.RowCount > rowCount {
+			rowCount = event.RowCount
+		}
+	}
+	return rowCount == 0 || len(events) >= int(rowCount)
 }
 
-func ListBinlogEvent(gtid string) ([]ChBinlogEvent, error) {
+// ListBinlogEvent 返回事务中的所有 binlog event, 按照在事务中执行的顺序排列.
+// binlog_event 不会合并重复数据, 重新消费写入的相同 event 在查询时按 (gtid, seq) 去重,
+// 其他列(例如 log_pos、time)不同的重复数据也只保留一条
+func ListBinlogEvent(conn driver.Conn, gtid string) ([]ChBinlogEvent, error) {
 	var result []ChBinlogEvent
-	s := "SELECT db, table, action, data, gtid FROM binlog_event WHERE gtid=$1;"
-	err := clickhouse.CH.Select(context.Background(), &result, s, gtid)
+	s := "SELECT db, table, action, data, gtid, time, seq, log_file, log_pos, row_count FROM binlog_event " +
+		"WHERE gtid=$1 ORDER BY seq, log_file, log_pos LIMIT 1 BY gtid, seq;"
+	err := conn.Select(context.Background(), &result, s, gtid)
 	return result, errors.Trace(err)
 }
 
-func ListBinlogEvents(gtidList []string) ([]ChBinlogEvent, error) {
+// ListBinlogEvents 返回多个事务中的所有 binlog event, 同一个事务中的 event 按照执行的顺序排列, 去重方式见 ListBinlogEvent
+func ListBinlogEvents(conn driver.Conn, gtidList []string) ([]ChBinlogEvent, error) {
 	var result []ChBinlogEvent
-	s := "SELECT db, table, action, data, gtid FROM binlog_event WHERE gtid IN ($1);"
-	err := clickhouse.CH.Select(context.Background(), &result, s, gtidList)
+	s := "SELECT db, table, action, data, gtid, time, seq, log_file, log_pos, row_count FROM binlog_event " +
+		"WHERE gtid IN ($1) ORDER BY gtid, seq, log_file, log_pos LIMIT 1 BY gtid, seq;"
+	err := conn.Select(context.Background(), &result, s, gtidList)
 	return result, errors.Trace(err)
 }
 
-func InsertBinlogEvents(binlogEvents []ChBinlogEvent) error {
+// ListUnattributedGTIDs 返回 [since, until) 时间内有 binlog event 但没有 tx_info 的事务, 最多 limit 个
+func ListUnattributedGTIDs(conn driver.Conn, since, until time.Time, limit int) ([]string, error) {
+	var result []struct {
+		GTID string `ch:"gtid"`
+	}
+	s := "SELECT DISTINCT gtid FROM binlog_event " +
+		"WHERE time>=toDateTime($1) AND time<toDateTime($2) AND gtid NOT IN (SELECT gtid FROM tx_info) LIMIT $3;"
+	if err := conn.Select(context.Background(), &result, s, since.Unix(), until.Unix(), limit); err != nil {
+		return nil, errors.Trace(err)
+	}
+	gtids := make([]string, len(result))
+	for i := range result {
+		gtids[i] = result[i].GTID
+	}
+	return gtids, nil
+}
+
+func InsertBinlogEvents(conn driver.Conn, binlogEvents []ChBinlogEvent) error {
 	length := len(binlogEvents)
 	if length == 0 {
 		return nil
 	}
-	batch, err := clickhouse.CH.PrepareBatch(context.Background(),
-		"INSERT INTO binlog_event (db, table, action, gtid, data) VALUES")
+	batch, err := conn.PrepareBatch(context.Background(),
+		"INSERT INTO binlog_event (db, table, action, gtid, data, time, seq, log_file, log_pos, row_count) VALUES")
 	if err != nil {
 		return errors.Trace(err)
 	}
 	var (
-		dbs    = make([]string, length)
-		tables = make([]string, length)
-		action = make([]int32, length)
-		GTIDs  = make([]string, length)
-		events = make([]string, length)
+		dbs      = make([]string, length)
+		tables   = make([]string, length)
+		action   = make([]int32, length)
+		GTIDs    = make([]string, length)
+		events   = make([]string, length)
+		times    = make([]time.Time, length)
+		seqs     = make([]uint32, length)
+		logFiles = make([]string, length)
+		logPos   = make([]uint32, length)
+		rowCount = make([]uint32, length)
 	)
 	for i, event := range binlogEvents {
 		dbs[i] = event.Db
@@ -69,6 +130,11 @@ func InsertBinlogEvents(binlogEvents []ChBinlogEvent) error {
 		action[i] = event.Action
 		GTIDs[i] = event.GTID
 		events[i] = event.Data
+		times[i] = event.Time
+		seqs[i] = event.Seq
+		logFiles[i] = event.LogFile
+		logPos[i] = event.LogPos
+		rowCount[i] = event.RowCount
 	}
 	if err := batch.Column(0).Append(dbs); err != nil {
 		return errors.Trace(err)
@@ -85,6 +151,21 @@ func InsertBinlogEvents(binlogEvents []ChBinlogEvent) error {
 	if err := batch.Column(4).Append(events); err != nil {
 		return errors.Trace(err)
 	}
+	if err := batch.Column(5).Append(times); err != nil {
+		return errors.Trace(err)
+	}
+	if err := batch.Column(6).Append(seqs); err != nil {
+		return errors.Trace(err)
+	}
+	if err := batch.Column(7).Append(logFiles); err != nil {
+		return errors.Trace(err)
+	}
+	if err := batch.Column(8).Append(logPos); err != nil {
+		return errors.Trace(err)
+	}
+	if err := batch.Column(9).Append(rowCount); err != nil {
+		return errors.Trace(err)
+	}
 
 	if err = batch.Send(); err != nil {
 		return errors.Trace(err)
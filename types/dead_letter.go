@@ -0,0 +1,114 @@
+package types
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/juju/errors"
+	"time"
+)
+
+// DeadLetter 处理失败(重试次数耗尽)的审计日志
+type DeadLetter struct {
+	ID            string    `json:"id"`
+	AuditLog      *AuditLog `json:"audit_log"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+}
+
+// Fail 记录一次失败的处理
+func (l *DeadLetter) Fail(err error, attempts int) {
+	now := time.Now()
+	if l.FirstFailedAt.IsZero() {
+		l.FirstFailedAt = now
+	}
+	l.LastFailedAt = now
+	l.Attempts += attempts
+	l.Error = err.Error()
+}
+
+type ChDeadLetter struct {
+	ID            string    `ch:"id"`
+	GTID          string    `ch:"gtid"`
+	AuditLog      string    `ch:"audit_log"`
+	Error         string    `ch:"error"`
+	Attempts      uint32    `ch:"attempts"`
+	FirstFailedAt time.Time `ch:"first_failed_at"`
+	LastFailedAt  time.Time `ch:"last_failed_at"`
+}
+
+func (l *DeadLetter) ChDeadLetter() (ChDeadLetter, error) {
+	auditLog, err := json.Marshal(l.AuditLog)
+	if err != nil {
+		return ChDeadLetter{}, errors.Trace(err)
+	}
+	return ChDeadLetter{
+		ID:            l.ID,
+		GTID:          l.AuditLog.GTID,
+		AuditLog:      string(auditLog),
+		Error:         l.Error,
+		Attempts:      uint32(l.Attempts),
+		FirstFailedAt: l.FirstFailedAt,
+		LastFailedAt:  l.LastFailedAt,
+	}, nil
+}
+
+func (l *ChDeadLetter) DeadLetter() (*DeadLetter, error) {
+	auditLog := new(AuditLog)
+	if err := json.Unmarshal([]byte(l.AuditLog), auditLog); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &DeadLetter{
+		ID:            l.ID,
+		AuditLog:      auditLog,
+		Error:         l.Error,
+		Attempts:      int(l.Attempts),
+		FirstFailedAt: l.FirstFailedAt,
+		LastFailedAt:  l.LastFailedAt,
+	}, nil
+}
+
+func InsertDeadLetter(conn driver.Conn, letter ChDeadLetter) error {
+	sql := "INSERT INTO dead_letter (id, gtid, audit_log, error, attempts, first_failed_at, last_failed_at) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7);"
+
+	err := conn.Exec(context.Background(), sql,
+		letter.ID,
+		letter.GTID,
+		letter.AuditLog,
+		letter.Error,
+		letter.Attempts,
+		letter.FirstFailedAt,
+		letter.LastFailedAt,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// ListDeadLetters 按首次失败时间从早到晚列出最多 limit 条死信, limit <= 0 时列出全部
+func ListDeadLetters(conn driver.Conn, limit int) ([]ChDeadLetter, error) {
+	sql := "SELECT id, gtid, audit_log, error, attempts, first_failed_at, last_failed_at " +
+		"FROM dead_letter FINAL ORDER BY first_failed_at"
+	var args []interface{}
+	if limit > 0 {
+		sql += " LIMIT $1"
+		args = append(args, limit)
+	}
+	results := make([]ChDeadLetter, 0)
+	if err := conn.Select(context.Background(), &results, sql+";", args...); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return results, nil
+}
+
+func DeleteDeadLetter(conn driver.Conn, id string) error {
+	sql := "ALTER TABLE dead_letter DELETE WHERE id=$1;"
+	if err := conn.Exec(context.Background(), sql, id); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
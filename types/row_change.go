@@ -0,0 +1,84 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/juju/errors"
+	"reflect"
+	"sort"
+)
+
+// ColumnChange 单个字段的变更. insert 的 Old 为 nil, delete 的 New 为 nil
+type ColumnChange struct {
+	Column string      `json:"column"`
+	Old    interface{} `json:"old"`
+	New    interface{} `json:"new"`
+}
+
+// String 返回可读的变更, 比如 "name: Alice → Bob"
+func (c ColumnChange) String() string {
+	return fmt.Sprintf("%s: %v → %v", c.Column, c.Old, c.New)
+}
+
+// RowChange 解析后的一行数据的变更
+type RowChange struct {
+	Db         string                 `json:"db"`
+	Table      string                 `json:"table"`
+	Action     Action                 `json:"action"`
+	PrimaryKey map[string]interface{} `json:"primary_key"` // 主键字段及其值, 表没有主键时为空
+	Columns    []ColumnChange         `json:"columns"`     // update 只包含发生变化的字段, 按字段名排序
+}
+
+// RowChange 解析 Data 中的 before/after, 计算出字段级别的变更.
+// 数字以 json.Number 的形式保存, 避免大整数丢失精度
+func (e *ChBinlogEvent) RowChange() (*RowChange, error) {
+	var data FormatData
+	decoder := json.NewDecoder(bytes.NewReader([]byte(e.Data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	action := Action(e.Action)
+	change := &RowChange{
+		Db:         e.Db,
+		Table:      e.Table,
+		Action:     action,
+		PrimaryKey: make(map[string]interface{}, len(data.Primary)),
+		Columns:    diffColumns(data.Before, data.After, action == EventActionUpdate),
+	}
+
+	row := data.After
+	if action == EventActionDelete {
+		row = data.Before
+	}
+	for _, pk := range data.Primary {
+		change.PrimaryKey[pk] = row[pk]
+	}
+	return change, nil
+}
+
+// diffColumns onlyChanged 为 false 时(insert/delete)返回所有字段, 包括值为 NULL 的字段
+func diffColumns(before, after map[string]interface{}, onlyChanged bool) []ColumnChange {
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]ColumnChange, 0, len(names))
+	for _, name := range names {
+		oldValue, newValue := before[name], after[name]
+		if onlyChanged && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		changes = append(changes, ColumnChange{Column: name, Old: oldValue, New: newValue})
+	}
+	return changes
+}
@@ -0,0 +1,189 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/obgnail/mysql-river/river"
+)
+
+// broker 按字段规则脱敏后写入的值: mask 为固定的 ******, hash 为原始值的 HMAC(见 broker.ColumnRule)
+const (
+	testMasked = "******"
+	testHashA  = "4f2d7c0ea1c5b2bf8b1f5c1a9b7e0d3c6a8f9e2b1d4c7a0f3e6b9c2d5a8f1e4b"
+	testHashB  = "0b9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c"
+)
+
+func testChBinlogEvent(t *testing.T, eventType string, before, after map[string]interface{}, primary []string) ChBinlogEvent {
+	t.Helper()
+	event, err := NewBinlogEvent(&river.EventData{
+		EventType: eventType,
+		Db:        "shop",
+		Table:     "user",
+		Before:    before,
+		After:     after,
+		GTIDSet:   "uuid:1",
+	}, primary, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event.ChEvent()
+}
+
+func TestRowChange(t *testing.T) {
+	cases := []struct {
+		name    string
+		event   string
+		before  map[string]interface{}
+		after   map[string]interface{}
+		primary []string
+		want    *RowChange
+	}{
+		{
+			name:    "insert",
+			event:   river.EventTypeInsert,
+			after:   map[string]interface{}{"id": 1, "name": "alice", "email": nil},
+			primary: []string{"id"},
+			want: &RowChange{
+				Action:     EventActionInsert,
+				PrimaryKey: map[string]interface{}{"id": json.Number("1")},
+				Columns: []ColumnChange{
+					{Column: "email"},
+					{Column: "id", New: json.Number("1")},
+					{Column: "name", New: "alice"},
+				},
+			},
+		},
+		{
+			name:    "update only changed columns",
+			event:   river.EventTypeUpdate,
+			before:  map[string]interface{}{"id": 1, "name": "alice", "age": 18, "email": nil},
+			after:   map[string]interface{}{"id": 1, "name": "bob", "age": 18, "email": "bob@example.com"},
+			primary: []string{"id"},
+			want: &RowChange{
+				Action:     EventActionUpdate,
+				PrimaryKey: map[string]interface{}{"id": json.Number("1")},
+				Columns: []ColumnChange{
+					{Column: "email", New: "bob@example.com"},
+					{Column: "name", Old: "alice", New: "bob"},
+				},
+			},
+		},
+		{
+			// mask 之后无法判断值是否变化, 不出现在变更中; hash 之后值变化时 hash 也变化
+			name:    "update masked and hashed columns",
+			event:   river.EventTypeUpdate,
+			before:  map[string]interface{}{"id": 1, "password": testMasked, "email": testHashA, "phone": testHashA},
+			after:   map[string]interface{}{"id": 1, "password": testMasked, "email": testHashB, "phone": testHashA},
+			primary: []string{"id"},
+			want: &RowChange{
+				Action:     EventActionUpdate,
+				PrimaryKey: map[string]interface{}{"id": json.Number("1")},
+				Columns:    []ColumnChange{{Column: "email", Old: testHashA, New: testHashB}},
+			},
+		},
+		{
+			name:    "delete",
+			event:   river.EventTypeDelete,
+			before:  map[string]interface{}{"id": 1, "password": testMasked},
+			primary: []string{"id"},
+			want: &RowChange{
+				Action:     EventActionDelete,
+				PrimaryKey: map[string]interface{}{"id": json.Number("1")},
+				Columns: []ColumnChange{
+					{Column: "id", Old: json.Number("1")},
+					{Column: "password", Old: testMasked},
+				},
+			},
+		},
+		{
+			name:  "big integer and no primary key",
+			event: river.EventTypeInsert,
+			after: map[string]interface{}{"n": uint64(9007199254740993)},
+			want: &RowChange{
+				Action:     EventActionInsert,
+				PrimaryKey: map[string]interface{}{},
+				Columns:    []ColumnChange{{Column: "n", New: json.Number("9007199254740993")}},
+			},
+		},
+		{
+			name:    "composite primary key",
+			event:   river.EventTypeUpdate,
+			before:  map[string]interface{}{"tenant": "t1", "id": 1, "name": "alice"},
+			after:   map[string]interface{}{"tenant": "t1", "id": 1, "name": "bob"},
+			primary: []string{"tenant", "id"},
+			want: &RowChange{
+				Action:     EventActionUpdate,
+				PrimaryKey: map[string]interface{}{"tenant": "t1", "id": json.Number("1")},
+				Columns:    []ColumnChange{{Column: "name", Old: "alice", New: "bob"}},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			event := testChBinlogEvent(t, c.event, c.before, c.after, c.primary)
+			got, err := event.RowChange()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.want.Db, c.want.Table = "shop", "user"
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("RowChange = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRowChangeInvalidData(t *testing.T) {
+	event := ChBinlogEvent{Db: "shop", Table: "user", Action: int32(EventActionInsert), Data: "{"}
+	if _, err := event.RowChange(); err == nil {
+		t.Fatal("invalid data parsed")
+	}
+}
+
+func TestDiffColumns(t *testing.T) {
+	cases := []struct {
+		name        string
+		before      map[string]interface{}
+		after       map[string]interface{}
+		onlyChanged bool
+		want        []ColumnChange
+	}{
+		{name: "empty", want: []ColumnChange{}},
+		{
+			name:        "null to value",
+			before:      map[string]interface{}{"a": nil},
+			after:       map[string]interface{}{"a": "x"},
+			onlyChanged: true,
+			want:        []ColumnChange{{Column: "a", New: "x"}},
+		},
+		{
+			name:        "null unchanged",
+			before:      map[string]interface{}{"a": nil, "b": "x"},
+			after:       map[string]interface{}{"a": nil, "b": "x"},
+			onlyChanged: true,
+			want:        []ColumnChange{},
+		},
+		{
+			// 只在一侧出现的字段(例如字段规则变化前后的数据)也作为变更
+			name:        "column only on one side",
+			before:      map[string]interface{}{"a": "x"},
+			after:       map[string]interface{}{"b": "y"},
+			onlyChanged: true,
+			want:        []ColumnChange{{Column: "a", Old: "x"}, {Column: "b", New: "y"}},
+		},
+		{
+			name:  "all columns sorted",
+			after: map[string]interface{}{"c": "3", "a": "1", "b": nil},
+			want:  []ColumnChange{{Column: "a", New: "1"}, {Column: "b"}, {Column: "c", New: "3"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := diffColumns(c.before, c.after, c.onlyChanged); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("diffColumns = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
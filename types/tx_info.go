@@ -2,35 +2,117 @@ package types
 
 import (
 	"context"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/juju/errors"
-	"github.com/obgnail/audit-log/clickhouse"
+	"sync/atomic"
 	"time"
 )
 
+// tx_info 的状态, 只能按照以下方向转移, 见 CanTransitTxInfo:
+//
+//	pending -> processed / ignored / expired / failed
+//	processed -> failed
+//	unattributed -> processed / failed
 const (
-	StatusTxInfoUnprocessed = 1
-	StatusTxInfoProcessed   = 2
+	StatusTxInfoPending      = 1 // 等待 watermark 覆盖
+	StatusTxInfoProcessed    = 2 // 已经生成审计日志
+	StatusTxInfoIgnored      = 3 // watermark 已经覆盖但没有 binlog_event: 事务没有修改需要审计的表
+	StatusTxInfoExpired      = 4 // 超过有效期仍没有被 watermark 覆盖
+	StatusTxInfoFailed       = 5 // 无法生成审计日志, 或者 handler 重试耗尽(见死信)
+	StatusTxInfoUnattributed = 6 // 没有 tx_info 的外部变更, 已经生成审计日志. 之后收到的 tx_info 会重新生成审计日志并覆盖
 )
 
 const (
 	timeLayout = "2006-01-02 15:04:05.000"
 )
 
+// TxInfoStatusName 返回状态的名称, 用于日志和查询
+func TxInfoStatusName(status uint8) string {
+	switch status {
+	case StatusTxInfoPending:
+		return "pending"
+	case StatusTxInfoProcessed:
+		return "processed"
+	case StatusTxInfoIgnored:
+		return "ignored"
+	case StatusTxInfoExpired:
+		return "expired"
+	case StatusTxInfoFailed:
+		return "failed"
+	case StatusTxInfoUnattributed:
+		return "unattributed"
+	default:
+		return "unknown"
+	}
+}
+
+// CanTransitTxInfo 状态 from 是否可以转移到 to, from 为 0 表示新的 tx_info, 可以是任意状态
+func CanTransitTxInfo(from, to uint8) bool {
+	switch from {
+	case 0:
+		return true
+	case StatusTxInfoPending:
+		return to != StatusTxInfoPending
+	case StatusTxInfoProcessed:
+		return to == StatusTxInfoFailed
+	case StatusTxInfoUnattributed:
+		return to == StatusTxInfoProcessed || to == StatusTxInfoFailed
+	default:
+		return false
+	}
+}
+
+var lastTxInfoVersion uint64
+
+// NextTxInfoVersion 返回单调递增的版本号(unix 纳秒), 同一个 gtid 的 tx_info 保留版本号最大的一行
+func NextTxInfoVersion() uint64 {
+	for {
+		last := atomic.LoadUint64(&lastTxInfoVersion)
+		next := uint64(time.Now().UnixNano())
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&lastTxInfoVersion, last, next) {
+			return next
+		}
+	}
+}
+
+// ChTxInfo tx_info 表中的一行, 每次状态变化写入一行新的版本, 见 Transit
 type ChTxInfo struct {
 	Time    time.Time `json:"time" ch:"time"`
 	Context string    `json:"context" ch:"context"`
 	GTID    string    `json:"gtid" ch:"gtid"`
-	Status  uint8     `json:"-" ch:"-"`
+	Status  uint8     `json:"status" ch:"status"`
+	Version uint64    `json:"version" ch:"version"`
 }
 
-func InsertTxInfo(txInfo ChTxInfo) error {
-	sql := "INSERT INTO tx_info (gtid, context, time, `status`) VALUES ($1, $2, $3, $4);"
+// NewChTxInfo 创建一个新的 tx_info
+func NewChTxInfo(t time.Time, ctx, gtid string, status uint8) ChTxInfo {
+	return ChTxInfo{Time: t, Context: ctx, GTID: gtid, Status: status, Version: NextTxInfoVersion()}
+}
 
-	err := clickhouse.CH.Exec(context.Background(), sql,
+// Transit 返回转移到状态 to 的新版本, 不允许的转移返回错误
+func (t ChTxInfo) Transit(to uint8) (ChTxInfo, error) {
+	if !CanTransitTxInfo(t.Status, to) {
+		return t, fmt.Errorf("invalid tx_info status transition %s -> %s, gtid: %s",
+			TxInfoStatusName(t.Status), TxInfoStatusName(to), t.GTID)
+	}
+	t.Status = to
+	t.Version = NextTxInfoVersion()
+	return t, nil
+}
+
+func InsertTxInfo(conn driver.Conn, txInfo ChTxInfo) error {
+	sql := "INSERT INTO tx_info (gtid, context, time, `status`, version) VALUES ($1, $2, $3, $4, $5);"
+
+	err := conn.Exec(context.Background(), sql,
 		txInfo.GTID,
 		txInfo.Context,
 		txInfo.Time,
 		txInfo.Status,
+		txInfo.Version,
 	)
 	if err != nil {
 		return errors.Trace(err)
@@ -38,13 +120,13 @@ func InsertTxInfo(txInfo ChTxInfo) error {
 	return nil
 }
 
-func BatchInsertTxInfo(txInfoArr []ChTxInfo) error {
+func BatchInsertTxInfo(conn driver.Conn, txInfoArr []ChTxInfo) error {
 	length := len(txInfoArr)
 	if length == 0 {
 		return nil
 	}
 
-	batch, err := clickhouse.CH.PrepareBatch(context.Background(), "INSERT INTO tx_info VALUES")
+	batch, err := conn.PrepareBatch(context.Background(), "INSERT INTO tx_info (gtid, context, time, `status`, version) VALUES")
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -53,12 +135,14 @@ func BatchInsertTxInfo(txInfoArr []ChTxInfo) error {
 	ctx := make([]string, length)
 	TimeArr := make([]time.Time, length)
 	statusArr := make([]uint8, length)
+	versionArr := make([]uint64, length)
 
 	for i := range txInfoArr {
 		gtidArr[i] = txInfoArr[i].GTID
 		ctx[i] = txInfoArr[i].Context
 		TimeArr[i] = txInfoArr[i].Time
 		statusArr[i] = txInfoArr[i].Status
+		versionArr[i] = txInfoArr[i].Version
 	}
 
 	if err := batch.Column(0).Append(gtidArr); err != nil {
@@ -73,6 +157,9 @@ func BatchInsertTxInfo(txInfoArr []ChTxInfo) error {
 	if err := batch.Column(3).Append(statusArr); err != nil {
 		return errors.Trace(err)
 	}
+	if err := batch.Column(4).Append(versionArr); err != nil {
+		return errors.Trace(err)
+	}
 
 	if err = batch.Send(); err != nil {
 		return errors.Trace(err)
@@ -80,14 +167,30 @@ func BatchInsertTxInfo(txInfoArr []ChTxInfo) error {
 	return nil
 }
 
-func ListUnprocessedTxInfo() ([]ChTxInfo, error) {
-	sql := "SELECT gtid, context, time FROM tx_info " +
-		"WHERE `status`=$1 AND time>=toDateTime64($2, 3) ORDER BY time DESC LIMIT 1000;"
+// ListPendingTxInfo 返回 since 之后最新版本为 pending 的 tx_info. FINAL 先合并出每个 gtid 版本最大的一行再过滤状态,
+// 已经转移到其他状态的 tx_info 不会再返回
+func ListPendingTxInfo(conn driver.Conn, since time.Time, limit int) ([]ChTxInfo, error) {
+	sql := "SELECT gtid, context, time, `status`, version FROM tx_info FINAL " +
+		"WHERE `status`=$1 AND time>=toDateTime64($2, 3) ORDER BY time DESC LIMIT $3;"
 	results := make([]ChTxInfo, 0)
-	t := time.Now().Add(time.Hour * 72 * -1)
-	err := clickhouse.CH.Select(context.Background(), &results, sql, StatusTxInfoUnprocessed, t.Format(timeLayout))
+	err := conn.Select(context.Background(), &results, sql, uint8(StatusTxInfoPending), since.Format(timeLayout), limit)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	return results, nil
 }
+
+// GetTxInfo 返回 gtid 最新版本的 tx_info, 不存在时返回 nil
+func GetTxInfo(conn driver.Conn, gtid string) (*ChTxInfo, error) {
+	sql := "SELECT gtid, argMax(context, version) AS context, argMax(time, version) AS time, " +
+		"argMax(`status`, version) AS `status`, max(version) AS version " +
+		"FROM tx_info WHERE gtid=$1 GROUP BY gtid;"
+	results := make([]ChTxInfo, 0)
+	if err := conn.Select(context.Background(), &results, sql, gtid); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return &results[0], nil
+}
@@ -30,21 +30,28 @@ func (a Action) String() string {
 }
 
 type BinlogEvent struct {
-	Db     string       `json:"db"`
-	Table  string       `json:"table"`
-	Action Action       `json:"action"`
-	GTID   string       `json:"gtid"`
-	Time   int64        `json:"time"`
-	Data   sql.RawBytes `json:"data"`
+	Db      string       `json:"db"`
+	Table   string       `json:"table"`
+	Action  Action       `json:"action"`
+	GTID    string       `json:"gtid"`
+	Time    int64        `json:"time"`
+	Seq     uint32       `json:"seq"`
+	LogFile string       `json:"log_file"`
+	LogPos  uint32       `json:"log_pos"`
+	Data    sql.RawBytes `json:"data"`
 }
 
 func (e *BinlogEvent) ChEvent() ChBinlogEvent {
 	return ChBinlogEvent{
-		Db:     e.Db,
-		Table:  e.Table,
-		Action: int32(e.Action),
-		GTID:   e.GTID,
-		Data:   string(e.Data),
+		Db:      e.Db,
+		Table:   e.Table,
+		Action:  int32(e.Action),
+		GTID:    e.GTID,
+		Data:    string(e.Data),
+		Time:    time.Unix(e.Time, 0),
+		Seq:     e.Seq,
+		LogFile: e.LogFile,
+		LogPos:  e.LogPos,
 	}
 }
 
@@ -56,8 +63,46 @@ func (e *BinlogEvent) Marshal() ([]byte, error) {
 	return b, nil
 }
 
-func NewBinlogEvent(event *river.EventData) (*BinlogEvent, error) {
-	data, err := marshal(event.Before, event.After)
+// BinlogTransaction 一个事务中所有需要处理的 binlog event, broker 按事务发送.
+// 没有 event 的事务只用于推进消费者的 watermark, 见 Watermark
+type BinlogTransaction struct {
+	GTID     string         `json:"gtid"`
+	Covers   string         `json:"covers,omitempty"`  // 写入后 watermark 覆盖的 GTID 集合, 包括之前被丢弃的事务, 为空时只覆盖 GTID
+	Context  string         `json:"context,omitempty"` // embed 模式下事务的审计 Context, 见 BinlogBroker.SetContextMarker
+	RowCount uint32         `json:"row_count"`         // 事务中 binlog event 的数量, 与 len(Events) 相同
+	Events   []*BinlogEvent `json:"events"`
+}
+
+// CoveredGTIDs 返回写入后 watermark 覆盖的 GTID 集合
+func (t *BinlogTransaction) CoveredGTIDs() string {
+	if t.Covers != "" {
+		return t.Covers
+	}
+	return t.GTID
+}
+
+func (t *BinlogTransaction) Marshal() ([]byte, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return []byte{}, errors.Trace(err)
+	}
+	return b, nil
+}
+
+// ChEvents 返回写入 store 的 binlog event, 每个 event 都带有事务的 RowCount
+func (t *BinlogTransaction) ChEvents() []ChBinlogEvent {
+	events := make([]ChBinlogEvent, len(t.Events))
+	for i, e := range t.Events {
+		events[i] = e.ChEvent()
+		events[i].RowCount = t.RowCount
+	}
+	return events
+}
+
+// NewBinlogEvent primary 为该表的主键字段, 会写入 Data 中以便之后解析出 RowChange.PrimaryKey.
+// seq 为该 event 在事务中的序号
+func NewBinlogEvent(event *river.EventData, primary []string, seq uint32) (*BinlogEvent, error) {
+	data, err := marshal(event.Before, event.After, primary)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -73,23 +118,27 @@ func NewBinlogEvent(event *river.EventData) (*BinlogEvent, error) {
 	}
 
 	b := &BinlogEvent{
-		Db:     event.Db,
-		Table:  event.Table,
-		Action: action,
-		GTID:   event.GTIDSet,
-		Time:   int64(event.Timestamp),
-		Data:   data,
+		Db:      event.Db,
+		Table:   event.Table,
+		Action:  action,
+		GTID:    event.GTIDSet,
+		Time:    int64(event.Timestamp),
+		Seq:     seq,
+		LogFile: event.Pos.Name,
+		LogPos:  event.Pos.Pos,
+		Data:    data,
 	}
 	return b, nil
 }
 
 type FormatData struct {
-	Before map[string]interface{} `json:"before"` // 变更前数据, insert 类型的 before 为空
-	After  map[string]interface{} `json:"after"`  // 变更后数据, delete 类型的 after 为空
+	Before  map[string]interface{} `json:"before"`            // 变更前数据, insert 类型的 before 为空
+	After   map[string]interface{} `json:"after"`             // 变更后数据, delete 类型的 after 为空
+	Primary []string               `json:"primary,omitempty"` // 主键字段
 }
 
-func marshal(before, after map[string]interface{}) ([]byte, error) {
-	data := &FormatData{Before: before, After: after}
+func marshal(before, after map[string]interface{}, primary []string) ([]byte, error) {
+	data := &FormatData{Before: before, After: after, Primary: primary}
 	res, err := json.Marshal(data)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -108,12 +157,7 @@ type TxInfo struct {
 }
 
 func (t *TxInfo) ChTxInfo(status uint8) ChTxInfo {
-	return ChTxInfo{
-		Time:    time.Unix(t.Time, 0),
-		Context: t.Context,
-		GTID:    t.GTID,
-		Status:  status,
-	}
+	return NewChTxInfo(time.Unix(t.Time, 0), t.Context, t.GTID, status)
 }
 
 func (t *TxInfo) Marshal() ([]byte, error) {
@@ -0,0 +1,217 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/juju/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxWatermarkIntervals 每个 server 最多保留的区间数, 超过时合并最早的两个区间, 见 Advance
+const maxWatermarkIntervals = 1024
+
+// Watermark binlog syncer 已经写入 store 的 GTID 集合, 记录每个 server 已经写入的序号区间.
+// 消费者组同时消费多个 partition, 不同 partition 中的事务可能乱序写入, 因此不能只记录最大的序号:
+// 只有事务所在的消息写入之后它的 GTID 才会被覆盖. broker 按照提交顺序读取 binlog, 每条消息同时覆盖
+// 同一个 server 上一条消息之后被丢弃的事务(见 BinlogTransaction.Covers), 没有发送过的 GTID 之间不会留下空洞.
+// 格式与 MySQL 的 gtid_executed 相同(uuid:1-5:7-9,uuid:1-m)
+type Watermark map[string][]GTIDInterval // map[server uuid]按照起始序号排列且不相邻的区间
+
+// GTIDInterval 闭区间 [Start, End]
+type GTIDInterval struct {
+	Start int64
+	End   int64
+}
+
+// ParseWatermark 解析 GTID 集合
+func ParseWatermark(gtidSet string) (Watermark, error) {
+	w := make(Watermark)
+	for _, gtid := range strings.Split(gtidSet, ",") {
+		if strings.TrimSpace(gtid) == "" {
+			continue
+		}
+		if err := w.Advance(gtid); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return w, nil
+}
+
+// parseGTIDSet 返回 GTID(uuid:n) 或者一个 server 的 GTID 集合(uuid:1-5:7-9)的 server uuid 和序号区间
+func parseGTIDSet(gtid string) (string, []GTIDInterval, error) {
+	sep := strings.Split(strings.TrimSpace(gtid), ":")
+	if len(sep) < 2 || sep[0] == "" {
+		return "", nil, fmt.Errorf("invalid gtid: %s", gtid)
+	}
+	intervals := make([]GTIDInterval, 0, len(sep)-1)
+	for _, s := range sep[1:] {
+		bounds := strings.SplitN(s, "-", 2)
+		start, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid gtid: %s", gtid)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || end < start {
+				return "", nil, fmt.Errorf("invalid gtid: %s", gtid)
+			}
+		}
+		intervals = append(intervals, GTIDInterval{Start: start, End: end})
+	}
+	return strings.ToLower(sep[0]), intervals, nil
+}
+
+// GTIDRange 返回同一个 server 从 from 之后到 to 的 GTID 集合(uuid:from+1-to), 用于 BinlogTransaction.Covers.
+// from+1 不小于 to 时只包含 to
+func GTIDRange(uuid string, from, to int64) string {
+	if from+1 >= to {
+		return fmt.Sprintf("%s:%d", uuid, to)
+	}
+	return fmt.Sprintf("%s:%d-%d", uuid, from+1, to)
+}
+
+// ParseGTID 返回 GTID(uuid:n) 的 server uuid 和序号
+func ParseGTID(gtid string) (string, int64, error) {
+	uuid, intervals, err := parseGTIDSet(gtid)
+	if err != nil {
+		return "", 0, errors.Trace(err)
+	}
+	if len(intervals) != 1 || intervals[0].Start != intervals[0].End {
+		return "", 0, fmt.Errorf("invalid gtid: %s", gtid)
+	}
+	return uuid, intervals[0].End, nil
+}
+
+// Advance 将 gtid(或者一个 server 的 GTID 集合)加入 watermark
+func (w Watermark) Advance(gtid string) error {
+	uuid, intervals, err := parseGTIDSet(gtid)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, interval := range intervals {
+		w[uuid] = addInterval(w[uuid], interval)
+	}
+	return nil
+}
+
+// addInterval 将 interval 合并到按照起始序号排列的 intervals 中, 相交或者相邻的区间合并为一个
+func addInterval(intervals []GTIDInterval, interval GTIDInterval) []GTIDInterval {
+	i := sort.Search(len(intervals), func(i int) bool { return intervals[i].End+1 >= interval.Start })
+	j := i
+	for j < len(intervals) && intervals[j].Start <= interval.End+1 {
+		if intervals[j].Start < interval.Start {
+			interval.Start = intervals[j].Start
+		}
+		if intervals[j].End > interval.End {
+			interval.End = intervals[j].End
+		}
+		j++
+	}
+	result := make([]GTIDInterval, 0, len(intervals)-(j-i)+1)
+	result = append(result, intervals[:i]...)
+	result = append(result, interval)
+	result = append(result, intervals[j:]...)
+	// 永远不会被填上的空洞(比如重启时丢失的事务)不能让区间无限增长, 最早的空洞中的 tx_info 早已过期
+	if len(result) > maxWatermarkIntervals {
+		result[1].Start = result[0].Start
+		result = result[1:]
+	}
+	return result
+}
+
+// Covers gtid(或者一个 server 的 GTID 集合)是否已经全部写入 store. 无法解析的 gtid 永远不会被覆盖
+func (w Watermark) Covers(gtid string) bool {
+	uuid, intervals, err := parseGTIDSet(gtid)
+	if err != nil {
+		return false
+	}
+	for _, interval := range intervals {
+		if !coversInterval(w[uuid], interval) {
+			return false
+		}
+	}
+	return true
+}
+
+// coversInterval 按照起始序号排列的 intervals 是否包含 interval
+func coversInterval(intervals []GTIDInterval, interval GTIDInterval) bool {
+	i := sort.Search(len(intervals), func(i int) bool { return intervals[i].End >= interval.End })
+	return i != len(intervals) && intervals[i].Start <= interval.Start
+}
+
+// Merge 将 other 中的 GTID 加入 watermark, 返回是否有变化
+func (w Watermark) Merge(other Watermark) bool {
+	changed := false
+	for uuid, intervals := range other {
+		for _, interval := range intervals {
+			if !coversInterval(w[uuid], interval) {
+				w[uuid] = addInterval(w[uuid], interval)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func (w Watermark) Clone() Watermark {
+	c := make(Watermark, len(w))
+	for uuid, intervals := range w {
+		c[uuid] = append([]GTIDInterval(nil), intervals...)
+	}
+	return c
+}
+
+func (w Watermark) String() string {
+	uuids := make([]string, 0, len(w))
+	for uuid := range w {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	sets := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		if len(w[uuid]) == 0 {
+			continue
+		}
+		var b strings.Builder
+		b.WriteString(uuid)
+		for _, interval := range w[uuid] {
+			if interval.Start == interval.End {
+				fmt.Fprintf(&b, ":%d", interval.Start)
+			} else {
+				fmt.Fprintf(&b, ":%d-%d", interval.Start, interval.End)
+			}
+		}
+		sets = append(sets, b.String())
+	}
+	return strings.Join(sets, ",")
+}
+
+type ChWatermark struct {
+	GTIDSet   string    `ch:"gtid_set"`
+	UpdatedAt time.Time `ch:"updated_at"`
+}
+
+func SaveWatermark(conn driver.Conn, gtidSet string) error {
+	sql := "INSERT INTO binlog_watermark (id, gtid_set, updated_at) VALUES ($1, $2, $3);"
+	if err := conn.Exec(context.Background(), sql, uint8(0), gtidSet, time.Now()); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func GetWatermark(conn driver.Conn) (string, error) {
+	sql := "SELECT gtid_set, updated_at FROM binlog_watermark FINAL WHERE id=0;"
+	results := make([]ChWatermark, 0)
+	if err := conn.Select(context.Background(), &results, sql); err != nil {
+		return "", errors.Trace(err)
+	}
+	if len(results) == 0 {
+		return "", nil
+	}
+	return results[0].GTIDSet, nil
+}
@@ -0,0 +1,173 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const (
+	testUUID1 = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	testUUID2 = "4a22fb58-82db-22f2-af44-d91bb0530673"
+)
+
+func TestParseWatermark(t *testing.T) {
+	cases := []struct {
+		name    string
+		gtidSet string
+		want    Watermark
+		wantErr bool
+	}{
+		{name: "empty", gtidSet: "", want: Watermark{}},
+		{name: "blank", gtidSet: " , ", want: Watermark{}},
+		{name: "single gtid", gtidSet: testUUID1 + ":5", want: Watermark{testUUID1: {{5, 5}}}},
+		{name: "interval", gtidSet: testUUID1 + ":1-100", want: Watermark{testUUID1: {{1, 100}}}},
+		{name: "intervals with gap", gtidSet: testUUID1 + ":1-5:7-9", want: Watermark{testUUID1: {{1, 5}, {7, 9}}}},
+		{name: "adjacent intervals merged", gtidSet: testUUID1 + ":1-5:6-9", want: Watermark{testUUID1: {{1, 9}}}},
+		{
+			name:    "multiple servers",
+			gtidSet: testUUID1 + ":1-100," + testUUID2 + ":1-20",
+			want:    Watermark{testUUID1: {{1, 100}}, testUUID2: {{1, 20}}},
+		},
+		{
+			name:    "same server merged",
+			gtidSet: testUUID1 + ":1-100," + testUUID1 + ":50-120",
+			want:    Watermark{testUUID1: {{1, 120}}},
+		},
+		{name: "upper case uuid", gtidSet: "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-3", want: Watermark{testUUID1: {{1, 3}}}},
+		{
+			name:    "spaces",
+			gtidSet: " " + testUUID1 + ":1-3 ,\n" + testUUID2 + ":1-4",
+			want:    Watermark{testUUID1: {{1, 3}}, testUUID2: {{1, 4}}},
+		},
+		{name: "missing sequence", gtidSet: testUUID1, wantErr: true},
+		{name: "missing uuid", gtidSet: ":1-3", wantErr: true},
+		{name: "invalid sequence", gtidSet: testUUID1 + ":1-x", wantErr: true},
+		{name: "reversed interval", gtidSet: testUUID1 + ":5-3", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ParseWatermark(c.gtidSet)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("ParseWatermark(%q) error = %v, wantErr %v", c.gtidSet, err, c.wantErr)
+			}
+			if c.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("ParseWatermark(%q) = %v, want %v", c.gtidSet, got, c.want)
+			}
+		})
+	}
+}
+
+func TestWatermarkCovers(t *testing.T) {
+	w := Watermark{testUUID1: {{1, 100}, {200, 300}}}
+
+	cases := []struct {
+		name string
+		gtid string
+		want bool
+	}{
+		{name: "first", gtid: testUUID1 + ":1", want: true},
+		{name: "end of interval", gtid: testUUID1 + ":100", want: true},
+		{name: "in gap", gtid: testUUID1 + ":150", want: false},
+		{name: "second interval", gtid: testUUID1 + ":250", want: true},
+		{name: "after", gtid: testUUID1 + ":301", want: false},
+		{name: "before", gtid: testUUID1 + ":0", want: false},
+		{name: "upper case uuid", gtid: "3E11FA47-71CA-11E1-9E33-C80AA9429562:50", want: true},
+		{name: "other server", gtid: testUUID2 + ":1", want: false},
+		{name: "interval", gtid: testUUID1 + ":1-100", want: true},
+		{name: "intervals", gtid: testUUID1 + ":1-100:200-210", want: true},
+		{name: "interval across gap", gtid: testUUID1 + ":90-210", want: false},
+		{name: "invalid", gtid: "invalid", want: false},
+		{name: "empty", gtid: "", want: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := w.Covers(c.gtid); got != c.want {
+				t.Fatalf("Covers(%q) = %v, want %v", c.gtid, got, c.want)
+			}
+		})
+	}
+}
+
+func TestWatermarkAdvance(t *testing.T) {
+	cases := []struct {
+		name    string
+		gtids   []string
+		want    string
+		wantErr bool
+	}{
+		{name: "in order", gtids: []string{testUUID1 + ":1", testUUID1 + ":2"}, want: testUUID1 + ":1-2"},
+		{name: "out of order leaves gap", gtids: []string{testUUID1 + ":5", testUUID1 + ":3"}, want: testUUID1 + ":3:5"},
+		{name: "gap filled", gtids: []string{testUUID1 + ":5", testUUID1 + ":3", testUUID1 + ":4"}, want: testUUID1 + ":3-5"},
+		{name: "covered range", gtids: []string{testUUID1 + ":1-3", testUUID1 + ":7-9", testUUID1 + ":4-6"}, want: testUUID1 + ":1-9"},
+		{name: "already covered", gtids: []string{testUUID1 + ":1-9", testUUID1 + ":4"}, want: testUUID1 + ":1-9"},
+		{
+			name:  "servers sorted",
+			gtids: []string{testUUID2 + ":7", testUUID1 + ":3"},
+			want:  testUUID1 + ":3," + testUUID2 + ":7",
+		},
+		{name: "invalid", gtids: []string{"invalid"}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := make(Watermark)
+			var err error
+			for _, gtid := range c.gtids {
+				if err = w.Advance(gtid); err != nil {
+					break
+				}
+			}
+			if (err != nil) != c.wantErr {
+				t.Fatalf("Advance error = %v, wantErr %v", err, c.wantErr)
+			}
+			if c.wantErr {
+				return
+			}
+			if got := w.String(); got != c.want {
+				t.Fatalf("String() = %q, want %q", got, c.want)
+			}
+			parsed, err := ParseWatermark(w.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parsed, w) {
+				t.Fatalf("ParseWatermark(String()) = %v, want %v", parsed, w)
+			}
+		})
+	}
+}
+
+func TestWatermarkMaxIntervals(t *testing.T) {
+	w := make(Watermark)
+	for i := 0; i <= maxWatermarkIntervals; i++ {
+		if err := w.Advance(fmt.Sprintf("%s:%d", testUUID1, 2*i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(w[testUUID1]); n != maxWatermarkIntervals {
+		t.Fatalf("intervals = %d, want %d", n, maxWatermarkIntervals)
+	}
+	if want := (GTIDInterval{Start: 1, End: 3}); w[testUUID1][0] != want {
+		t.Fatalf("first interval = %v, want %v", w[testUUID1][0], want)
+	}
+}
+
+func TestGTIDRange(t *testing.T) {
+	cases := []struct {
+		from, to int64
+		want     string
+	}{
+		{from: 0, to: 5, want: testUUID1 + ":1-5"},
+		{from: 5, to: 5, want: testUUID1 + ":5"},
+		{from: 2, to: 5, want: testUUID1 + ":3-5"},
+		{from: 4, to: 5, want: testUUID1 + ":5"},
+	}
+	for _, c := range cases {
+		if got := GTIDRange(testUUID1, c.from, c.to); got != c.want {
+			t.Fatalf("GTIDRange(%d, %d) = %q, want %q", c.from, c.to, got, c.want)
+		}
+	}
+}